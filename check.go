@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phuslu/log"
+
+	"github.com/pliu/kmon/pkg/kmon"
+)
+
+const (
+	exitCheckPassed = 0
+	exitCheckFailed = 1
+	exitCheckError  = 2
+)
+
+// runCheck runs a one-shot health check of the cluster and returns the process' exit code.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	configPath := flags.String("config.path", "config.yaml", "Path to the configuration file")
+	probes := flags.Int("probes", 10, "Number of probes to send to each partition")
+	latencyThresholdMs := flags.Int64("latency.threshold.ms", 1000, "Maximum p99 e2e latency of each broker's probes in milliseconds")
+	lossThreshold := flags.Float64("loss.threshold", 0, "Maximum ratio of each broker's probes that may be lost")
+	output := flags.String("output", "table", "Report format, table or json")
+	_ = flags.Parse(args)
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return exitCheckError
+	}
+
+	setupLogging(*debug)
+	config := loadConfig(*configPath)
+
+	report, err := kmon.RunCheck(signalContext(), config, kmon.CheckOptions{
+		ProbesPerPartition: *probes,
+		LatencyThresholdMs: *latencyThresholdMs,
+		LossThreshold:      *lossThreshold,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to run check")
+		return exitCheckError
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		err = report.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write report")
+		return exitCheckError
+	}
+
+	if !report.Passed {
+		return exitCheckFailed
+	}
+	return exitCheckPassed
+}
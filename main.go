@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
@@ -11,10 +12,12 @@ import (
 	"time"
 
 	"github.com/phuslu/log"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 
 	"github.com/pliu/kmon/pkg/config"
 	"github.com/pliu/kmon/pkg/kmon"
+	"github.com/pliu/kmon/pkg/metrics"
 )
 
 var (
@@ -24,39 +27,31 @@ var (
 )
 
 func main() {
-	flag.Parse()
-
-	log.DefaultLogger = log.Logger{
-		Caller:     1,
-		TimeFormat: "2006-01-02 15:04:05",
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
 	}
-
-	if *debug {
-		log.DefaultLogger.Level = log.DebugLevel
-		log.Debug().Msg("Debug logging enabled")
+	if len(os.Args) > 1 && os.Args[1] == "topic" {
+		os.Exit(runTopic(os.Args[2:]))
 	}
 
-	data, err := os.ReadFile(*configPath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to read config file")
-	}
-	config, err := config.GetKMonConfigFromBytes(&data)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse config file")
-	}
+	flag.Parse()
+
+	setupLogging(*debug)
+	config := loadConfig(*configPath)
 	fmt.Printf("Using config from %s: %s\n", *configPath, config.String())
 
-	ctx, cancel := context.WithCancel(context.Background())
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	ctx := signalContext()
 
-	go func() {
-		<-c
-		log.Info().Msg("Shutdown signal received")
-		cancel()
-	}()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	prometheusSink := metrics.NewPrometheusSink(registry)
+	sink, err := metrics.NewSinkFromConfig(ctx, config.Metrics, prometheusSink)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create metrics sink")
+	}
+	defer sink.Close()
 
-	k, err := kmon.NewKMonFromConfig(config, ctx)
+	k, err := kmon.NewKMonFromConfig(config, sink, ctx)
 	if err != nil {
 		// TODO log inside
 		log.Fatal().Err(err).Msg("failed to create monitor instance")
@@ -66,7 +61,21 @@ func main() {
 	// Setup Prometheus metrics server
 	addr := fmt.Sprintf(":%d", *metricsPort)
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", prometheusSink.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		report := k.Preflight()
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Passed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Error().Err(err).Msg("failed to write status")
+		}
+	})
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard", k.DashboardHandler()))
+	if probeHistory := k.ProbeHistoryHandler(); probeHistory != nil {
+		mux.Handle("/history", probeHistory)
+	}
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: mux,
@@ -82,6 +91,7 @@ func main() {
 	log.Info().Msg("kmon started")
 	<-ctx.Done()
 
+	k.Shutdown()
 	log.Info().Msg("Shutting down server...")
 
 	// The context is used to inform the server it has 5 seconds to finish
@@ -94,3 +104,41 @@ func main() {
 
 	log.Info().Msg("kmon stopped")
 }
+
+func setupLogging(debug bool) {
+	log.DefaultLogger = log.Logger{
+		Caller:     1,
+		TimeFormat: "2006-01-02 15:04:05",
+	}
+
+	if debug {
+		log.DefaultLogger.Level = log.DebugLevel
+		log.Debug().Msg("Debug logging enabled")
+	}
+}
+
+func loadConfig(path string) *config.KMonConfig {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read config file")
+	}
+	config, err := config.GetKMonConfigFromBytes(&data)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse config file")
+	}
+	return config
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		log.Info().Msg("Shutdown signal received")
+		cancel()
+	}()
+	return ctx
+}
@@ -0,0 +1,190 @@
+// Package alerting delivers alerts raised by kmon to external systems without requiring an Alertmanager.
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+)
+
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Alert is a single notification about a rule for a given set of labels. Fingerprint is stable across the firing and
+// resolved notifications of the same alert, so receivers can use it to deduplicate.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Status      string            `json:"status"`
+	Severity    string            `json:"severity"`
+	Summary     string            `json:"summary"`
+	Labels      map[string]string `json:"labels"`
+	Value       float64           `json:"value"`
+	Threshold   float64           `json:"threshold"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt,omitempty"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// Fingerprint identifies an alert by its rule and labels.
+func Fingerprint(rule string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(rule)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%s", k, labels[k])
+	}
+	return b.String()
+}
+
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert *Alert) error
+}
+
+func NewNotifierFromConfig(cfg *config.NotifierConfig) (Notifier, error) {
+	url := cfg.GetURL()
+	if url == "" {
+		return nil, fmt.Errorf("%s notifier requires a URL", cfg.Type)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch cfg.Type {
+	case config.NotifierTypeWebhook:
+		return &WebhookNotifier{url: url, client: client}, nil
+	case config.NotifierTypeSlack:
+		return &SlackNotifier{url: url, client: client}, nil
+	case config.NotifierTypePagerDuty:
+		if cfg.RoutingKey == "" {
+			return nil, fmt.Errorf("PagerDuty notifier requires a routing key")
+		}
+		return &PagerDutyNotifier{url: url, routingKey: cfg.RoutingKey, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported notifier type %q", cfg.Type)
+	}
+}
+
+// WebhookNotifier posts the alert as JSON.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *WebhookNotifier) Name() string {
+	return config.NotifierTypeWebhook
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert *Alert) error {
+	return postJSON(ctx, n.client, n.url, alert)
+}
+
+// SlackNotifier posts to a Slack-compatible incoming webhook.
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *SlackNotifier) Name() string {
+	return config.NotifierTypeSlack
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, alert *Alert) error {
+	emoji := ":red_circle:"
+	if alert.Status == StatusResolved {
+		emoji = ":large_green_circle:"
+	}
+	text := fmt.Sprintf("%s [%s] %s: %s", emoji, strings.ToUpper(alert.Status), alert.Rule, alert.Summary)
+	return postJSON(ctx, n.client, n.url, map[string]string{"text": text})
+}
+
+// PagerDutyNotifier sends PagerDuty Events API v2 trigger and resolve events, using the alert's fingerprint as the
+// dedup key so that a resolve closes the incident opened by the matching trigger.
+type PagerDutyNotifier struct {
+	url        string
+	routingKey string
+	client     *http.Client
+}
+
+func (n *PagerDutyNotifier) Name() string {
+	return config.NotifierTypePagerDuty
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     string            `json:"timestamp"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+func (n *PagerDutyNotifier) Notify(ctx context.Context, alert *Alert) error {
+	event := &pagerDutyEvent{
+		RoutingKey:  n.routingKey,
+		EventAction: "trigger",
+		DedupKey:    alert.Fingerprint,
+	}
+	if alert.Status == StatusResolved {
+		event.EventAction = "resolve"
+	} else {
+		event.Payload = &pagerDutyPayload{
+			Summary:       fmt.Sprintf("%s: %s", alert.Rule, alert.Summary),
+			Source:        "kmon",
+			Severity:      pagerDutySeverity(alert.Severity),
+			Timestamp:     alert.StartsAt.Format(time.RFC3339),
+			CustomDetails: alert.Labels,
+		}
+	}
+	return postJSON(ctx, n.client, n.url, event)
+}
+
+// PagerDuty rejects events with any severity other than these.
+func pagerDutySeverity(severity string) string {
+	switch severity {
+	case "critical", "error", "warning", "info":
+		return severity
+	default:
+		return "warning"
+	}
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification to %s failed with status %s", url, resp.Status)
+	}
+	return nil
+}
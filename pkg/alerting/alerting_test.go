@@ -0,0 +1,105 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, status int) (*httptest.Server, chan map[string]any) {
+	bodies := make(chan map[string]any, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(data, &body))
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+func newTestAlert(status string) *Alert {
+	labels := map[string]string{"partition": "0", "broker": "1"}
+	return &Alert{
+		Rule:        "e2e-p99",
+		Status:      status,
+		Severity:    "critical",
+		Summary:     "e2e p99 latency (ms) is 800.000 (threshold 500.000) on partition 0 (broker 1)",
+		Labels:      labels,
+		Value:       800,
+		Threshold:   500,
+		StartsAt:    time.Now(),
+		Fingerprint: Fingerprint("e2e-p99", labels),
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	require.Equal(t, "rule,broker=1,partition=0", Fingerprint("rule", map[string]string{"partition": "0", "broker": "1"}))
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	srv, bodies := newTestServer(t, http.StatusOK)
+	notifier, err := NewNotifierFromConfig(&config.NotifierConfig{Type: config.NotifierTypeWebhook, URL: srv.URL})
+	require.NoError(t, err)
+
+	require.NoError(t, notifier.Notify(context.Background(), newTestAlert(StatusFiring)))
+	body := <-bodies
+	require.Equal(t, "e2e-p99", body["rule"])
+	require.Equal(t, StatusFiring, body["status"])
+	require.Equal(t, "e2e-p99,broker=1,partition=0", body["fingerprint"])
+}
+
+func TestSlackNotifier(t *testing.T) {
+	srv, bodies := newTestServer(t, http.StatusOK)
+	notifier, err := NewNotifierFromConfig(&config.NotifierConfig{Type: config.NotifierTypeSlack, URL: srv.URL})
+	require.NoError(t, err)
+
+	require.NoError(t, notifier.Notify(context.Background(), newTestAlert(StatusResolved)))
+	body := <-bodies
+	require.Contains(t, body["text"], "[RESOLVED] e2e-p99")
+}
+
+func TestPagerDutyNotifier(t *testing.T) {
+	srv, bodies := newTestServer(t, http.StatusAccepted)
+	notifier, err := NewNotifierFromConfig(&config.NotifierConfig{Type: config.NotifierTypePagerDuty, URL: srv.URL, RoutingKey: "key"})
+	require.NoError(t, err)
+
+	require.NoError(t, notifier.Notify(context.Background(), newTestAlert(StatusFiring)))
+	body := <-bodies
+	require.Equal(t, "key", body["routing_key"])
+	require.Equal(t, "trigger", body["event_action"])
+	require.Equal(t, "e2e-p99,broker=1,partition=0", body["dedup_key"])
+	payload := body["payload"].(map[string]any)
+	require.Equal(t, "critical", payload["severity"])
+	require.Equal(t, "kmon", payload["source"])
+
+	require.NoError(t, notifier.Notify(context.Background(), newTestAlert(StatusResolved)))
+	body = <-bodies
+	require.Equal(t, "resolve", body["event_action"])
+	require.Equal(t, "e2e-p99,broker=1,partition=0", body["dedup_key"])
+	require.NotContains(t, body, "payload")
+}
+
+func TestNotifierErrors(t *testing.T) {
+	srv, _ := newTestServer(t, http.StatusInternalServerError)
+	notifier, err := NewNotifierFromConfig(&config.NotifierConfig{Type: config.NotifierTypeWebhook, URL: srv.URL})
+	require.NoError(t, err)
+	require.Error(t, notifier.Notify(context.Background(), newTestAlert(StatusFiring)))
+
+	_, err = NewNotifierFromConfig(&config.NotifierConfig{Type: config.NotifierTypePagerDuty})
+	require.Error(t, err)
+	_, err = NewNotifierFromConfig(&config.NotifierConfig{Type: config.NotifierTypeSlack})
+	require.Error(t, err)
+	_, err = NewNotifierFromConfig(&config.NotifierConfig{Type: "email", URL: srv.URL})
+	require.Error(t, err)
+}
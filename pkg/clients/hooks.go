@@ -0,0 +1,175 @@
+package clients
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pliu/kmon/pkg/metrics"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Role is what kmon uses a client for, which client metrics are labeled with.
+type Role string
+
+const (
+	RoleProducer Role = "producer"
+	RoleConsumer Role = "consumer"
+	RoleAdmin    Role = "admin"
+)
+
+// Buckets for client latency histograms, in milliseconds
+var clientLatencyBucketsMs = []float64{0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// ClientMetrics exports the internals of kmon's own franz-go clients through kgo hooks, to tell client-side problems
+// apart from broker-side ones. Every client with the same role shares the same hooks, so that gauges like the number
+// of open connections add up across clients instead of overwriting each other. Request latencies are labeled by
+// request type as well as role, as a single client may both produce and consume.
+type ClientMetrics struct {
+	connections            metrics.GaugeVec
+	connectErrorCount      metrics.CounterVec
+	writeLatency           metrics.HistogramVec
+	readLatency            metrics.HistogramVec
+	throttle               metrics.HistogramVec
+	bufferedProduceRecords metrics.GaugeVec
+
+	mu    sync.Mutex
+	hooks map[Role]*clientHooks
+}
+
+func NewClientMetrics(sink metrics.Sink) *ClientMetrics {
+	return &ClientMetrics{
+		connections: sink.NewGaugeVec(
+			"kmon_client_connections",
+			"Number of open connections from kmon's clients to each broker",
+			[]string{"role", "broker"},
+		),
+		connectErrorCount: sink.NewCounterVec(
+			"kmon_client_connect_error_count",
+			"Total number of failed connection attempts from kmon's clients to each broker",
+			[]string{"role", "broker"},
+		),
+		writeLatency: sink.NewHistogramVec(
+			"kmon_client_write_latency_ms",
+			"Time kmon's clients waited to write requests of each type to each broker plus the time writing took in milliseconds",
+			clientLatencyBucketsMs,
+			[]string{"role", "request", "broker"},
+		),
+		readLatency: sink.NewHistogramVec(
+			"kmon_client_read_latency_ms",
+			"Time kmon's clients waited for responses to requests of each type from each broker plus the time reading took in milliseconds",
+			clientLatencyBucketsMs,
+			[]string{"role", "request", "broker"},
+		),
+		throttle: sink.NewHistogramVec(
+			"kmon_client_throttle_ms",
+			"Throttle time imposed by each broker on kmon's clients in milliseconds",
+			clientLatencyBucketsMs,
+			[]string{"role", "broker"},
+		),
+		bufferedProduceRecords: sink.NewGaugeVec(
+			"kmon_client_buffered_produce_records",
+			"Number of records buffered in kmon's clients waiting to be produced",
+			[]string{"role"},
+		),
+		hooks: make(map[Role]*clientHooks),
+	}
+}
+
+// Hooks returns the kgo hooks for clients with the given role.
+func (m *ClientMetrics) Hooks(role Role) kgo.Hook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.hooks[role]
+	if !ok {
+		h = &clientHooks{metrics: m, role: string(role), connections: make(map[int32]int)}
+		m.hooks[role] = h
+	}
+	return h
+}
+
+type clientHooks struct {
+	metrics *ClientMetrics
+	role    string
+
+	mu          sync.Mutex
+	connections map[int32]int
+
+	bufferedRecords atomic.Int64
+}
+
+var (
+	_ kgo.HookBrokerConnect           = (*clientHooks)(nil)
+	_ kgo.HookBrokerDisconnect        = (*clientHooks)(nil)
+	_ kgo.HookBrokerWrite             = (*clientHooks)(nil)
+	_ kgo.HookBrokerRead              = (*clientHooks)(nil)
+	_ kgo.HookBrokerThrottle          = (*clientHooks)(nil)
+	_ kgo.HookProduceRecordBuffered   = (*clientHooks)(nil)
+	_ kgo.HookProduceRecordUnbuffered = (*clientHooks)(nil)
+)
+
+// brokerLabel labels seed brokers, which kgo gives negative IDs until their real ID is learned from metadata, by their
+// address.
+func brokerLabel(meta kgo.BrokerMetadata) string {
+	if meta.NodeID < 0 {
+		return "seed " + net.JoinHostPort(meta.Host, strconv.Itoa(int(meta.Port)))
+	}
+	return strconv.Itoa(int(meta.NodeID))
+}
+
+// requestLabel returns the name of the request type with the given key, e.g. Produce or Fetch.
+func requestLabel(key int16) string {
+	return kmsg.NameForKey(key)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (h *clientHooks) OnBrokerConnect(meta kgo.BrokerMetadata, _ time.Duration, _ net.Conn, err error) {
+	if err != nil {
+		h.metrics.connectErrorCount.WithLabelValues(h.role, brokerLabel(meta)).Inc()
+		return
+	}
+	h.addConnections(meta, 1)
+}
+
+func (h *clientHooks) OnBrokerDisconnect(meta kgo.BrokerMetadata, _ net.Conn) {
+	h.addConnections(meta, -1)
+}
+
+func (h *clientHooks) addConnections(meta kgo.BrokerMetadata, delta int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connections[meta.NodeID] += delta
+	h.metrics.connections.WithLabelValues(h.role, brokerLabel(meta)).Set(float64(h.connections[meta.NodeID]))
+}
+
+func (h *clientHooks) OnBrokerWrite(meta kgo.BrokerMetadata, key int16, _ int, writeWait, timeToWrite time.Duration, err error) {
+	if err == nil {
+		h.metrics.writeLatency.WithLabelValues(h.role, requestLabel(key), brokerLabel(meta)).Observe(millis(writeWait + timeToWrite))
+	}
+}
+
+func (h *clientHooks) OnBrokerRead(meta kgo.BrokerMetadata, key int16, _ int, readWait, timeToRead time.Duration, err error) {
+	if err == nil {
+		h.metrics.readLatency.WithLabelValues(h.role, requestLabel(key), brokerLabel(meta)).Observe(millis(readWait + timeToRead))
+	}
+}
+
+// OnBrokerThrottle isn't told which request was throttled, but producer clients are throttled on produce requests
+// and consumer clients on fetch requests, which the role label tells apart.
+func (h *clientHooks) OnBrokerThrottle(meta kgo.BrokerMetadata, throttleInterval time.Duration, _ bool) {
+	h.metrics.throttle.WithLabelValues(h.role, brokerLabel(meta)).Observe(millis(throttleInterval))
+}
+
+func (h *clientHooks) OnProduceRecordBuffered(*kgo.Record) {
+	h.metrics.bufferedProduceRecords.WithLabelValues(h.role).Set(float64(h.bufferedRecords.Add(1)))
+}
+
+func (h *clientHooks) OnProduceRecordUnbuffered(*kgo.Record, error) {
+	h.metrics.bufferedProduceRecords.WithLabelValues(h.role).Set(float64(h.bufferedRecords.Add(-1)))
+}
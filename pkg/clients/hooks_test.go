@@ -0,0 +1,89 @@
+package clients
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestClientHooks(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	clientMetrics := NewClientMetrics(metrics.NewPrometheusSink(registry))
+	broker := kgo.BrokerMetadata{NodeID: 1}
+
+	// Clients with the same role share their hooks, so their connections add up
+	first := clientMetrics.Hooks(RoleProducer).(*clientHooks)
+	second := clientMetrics.Hooks(RoleProducer).(*clientHooks)
+	require.Same(t, first, second)
+	first.OnBrokerConnect(broker, time.Millisecond, nil, nil)
+	second.OnBrokerConnect(broker, time.Millisecond, nil, nil)
+	second.OnBrokerDisconnect(broker, nil)
+	first.OnBrokerConnect(kgo.BrokerMetadata{NodeID: math.MinInt32, Host: "localhost", Port: 9092}, time.Millisecond, nil, errors.New("connection refused"))
+
+	// Latencies are labeled by role and request, as a single client may both produce and consume
+	consumer := clientMetrics.Hooks(RoleConsumer).(*clientHooks)
+	consumer.OnBrokerConnect(broker, time.Millisecond, nil, nil)
+	first.OnBrokerWrite(broker, 0, 100, time.Millisecond, time.Millisecond, nil)
+	first.OnBrokerWrite(broker, 1, 100, time.Millisecond, time.Millisecond, nil)
+	consumer.OnBrokerWrite(broker, 1, 100, time.Millisecond, time.Millisecond, nil)
+	consumer.OnBrokerWrite(broker, 1, 100, time.Millisecond, time.Millisecond, nil)
+
+	admin := clientMetrics.Hooks(RoleAdmin).(*clientHooks)
+	admin.OnBrokerThrottle(broker, 100*time.Millisecond, true)
+	consumer.OnBrokerThrottle(broker, 200*time.Millisecond, true)
+
+	first.OnProduceRecordBuffered(nil)
+	first.OnProduceRecordBuffered(nil)
+	first.OnProduceRecordUnbuffered(nil, nil)
+
+	expected := `
+# HELP kmon_client_buffered_produce_records Number of records buffered in kmon's clients waiting to be produced
+# TYPE kmon_client_buffered_produce_records gauge
+kmon_client_buffered_produce_records{role="producer"} 1
+# HELP kmon_client_connect_error_count Total number of failed connection attempts from kmon's clients to each broker
+# TYPE kmon_client_connect_error_count counter
+kmon_client_connect_error_count{broker="seed localhost:9092",role="producer"} 1
+# HELP kmon_client_connections Number of open connections from kmon's clients to each broker
+# TYPE kmon_client_connections gauge
+kmon_client_connections{broker="1",role="consumer"} 1
+kmon_client_connections{broker="1",role="producer"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"kmon_client_buffered_produce_records", "kmon_client_connect_error_count", "kmon_client_connections"))
+
+	require.Equal(t, map[string]uint64{"producer,Produce,1": 1, "producer,Fetch,1": 1, "consumer,Fetch,1": 2}, sampleCounts(t, registry, "kmon_client_write_latency_ms", "role", "request", "broker"))
+	require.Equal(t, map[string]uint64{"admin,1": 1, "consumer,1": 1}, sampleCounts(t, registry, "kmon_client_throttle_ms", "role", "broker"))
+}
+
+// sampleCounts returns the sample count of every series of the histogram, keyed by the values of labels joined with
+// commas.
+func sampleCounts(t *testing.T, registry *prometheus.Registry, name string, labels ...string) map[string]uint64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	counts := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			values := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				values[label.GetName()] = label.GetValue()
+			}
+			key := []string{}
+			for _, label := range labels {
+				key = append(key, values[label])
+			}
+			counts[strings.Join(key, ",")] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return counts
+}
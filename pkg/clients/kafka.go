@@ -11,18 +11,25 @@ type KgoClient interface {
 	Close()
 	Produce(context.Context, *kgo.Record, func(*kgo.Record, error))
 	PollFetches(context.Context) kgo.Fetches
+	CommitUncommittedOffsets(context.Context) error
 }
 
-func GetFranzGoClient(cfg *config.KafkaConfig, consumeTopics ...string) (*kgo.Client, error) {
-	opts := []kgo.Opt{
+// GetFranzGoClient returns a client for the cluster with kmon's defaults, which the given options are applied on top
+// of (e.g. kgo.ConsumeTopics to consume). If clientMetrics is not nil, the client's internals are reported labeled
+// with role.
+func GetFranzGoClient(cfg *config.KafkaConfig, role Role, clientMetrics *ClientMetrics, opts ...kgo.Opt) (*kgo.Client, error) {
+	defaultOpts := []kgo.Opt{
 		kgo.SeedBrokers(cfg.SeedBrokers...),
 		kgo.RecordPartitioner(kgo.ManualPartitioner()),
 		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
 	}
-
-	if len(consumeTopics) > 0 {
-		opts = append(opts, kgo.ConsumeTopics(consumeTopics...))
+	if cfg.ClientID != "" {
+		defaultOpts = append(defaultOpts, kgo.ClientID(cfg.ClientID))
+	}
+	if clientMetrics != nil {
+		defaultOpts = append(defaultOpts, kgo.WithHooks(clientMetrics.Hooks(role)))
 	}
+	opts = append(defaultOpts, opts...)
 
 	return kgo.NewClient(opts...)
 }
@@ -2,20 +2,438 @@ package config
 
 import (
 	"encoding/json"
+	"os"
 )
 
 type KMonConfig struct {
-	ProducerKafkaConfig             *KafkaConfig `json:"producerKafkaConfig" validate:"required"`
-	ConsumerKafkaConfig             *KafkaConfig `json:"consumerKafkaConfig,omitempty"`
-	ProducerMonitoringTopic         string       `json:"producerMonitoringTopic" validate:"required,min=1"`
-	ConsumerMonitoringTopic         string       `json:"consumerMonitoringTopic,omitempty"`
-	SampleFrequencyMs               int          `json:"sampleFrequencyMs,omitempty"`
-	StatsWindowSeconds              int          `json:"statsWindowSeconds,omitempty"`
-	TopicReconciliationFrequencyMin int          `json:"topicReconciliationFrequencyMin,omitempty"`
+	ProducerKafkaConfig             *KafkaConfig               `json:"producerKafkaConfig" validate:"required"`
+	ConsumerKafkaConfig             *KafkaConfig               `json:"consumerKafkaConfig,omitempty"`
+	ProducerMonitoringTopic         string                     `json:"producerMonitoringTopic" validate:"required,min=1"`
+	ConsumerMonitoringTopic         string                     `json:"consumerMonitoringTopic,omitempty"`
+	SampleFrequencyMs               int                        `json:"sampleFrequencyMs,omitempty"`
+	StatsWindowSeconds              int                        `json:"statsWindowSeconds,omitempty"`
+	TopicReconciliationFrequencyMin int                        `json:"topicReconciliationFrequencyMin,omitempty"`
+	Metrics                         *MetricsConfig             `json:"metrics,omitempty"`
+	ProbeTimeoutMs                  int                        `json:"probeTimeoutMs,omitempty"`
+	SLOs                            []*SLOConfig               `json:"slos,omitempty" validate:"dive"`
+	Alerting                        *AlertingConfig            `json:"alerting,omitempty"`
+	ConsumerGroup                   *ConsumerGroupConfig       `json:"consumerGroup,omitempty"`
+	TransactionalProbes             *TransactionalProbesConfig `json:"transactionalProbes,omitempty"`
+	GroupCanary                     *GroupCanaryConfig         `json:"groupCanary,omitempty"`
+	BrokerPings                     *BrokerPingsConfig         `json:"brokerPings,omitempty"`
+	AdminCanary                     *AdminCanaryConfig         `json:"adminCanary,omitempty"`
+	// Latency samples taken while a broker throttled the monitoring clients are always reported separately, and are
+	// also left out of the main quantile gauges if this is set
+	ExcludeThrottledSamples bool `json:"excludeThrottledSamples,omitempty"`
+	// In dry run mode, the monitoring topic is never created, altered or deleted: the actions reconciling it would
+	// take are only logged and exported
+	DryRun bool `json:"dryRun,omitempty"`
+	// kmon only deletes or alters monitoring topics it created, unless this is set to take over an existing topic
+	AdoptTopic bool            `json:"adoptTopic,omitempty"`
+	ReadOnly   *ReadOnlyConfig `json:"readOnly,omitempty"`
+	// How often the cluster ID of every client is verified against the clusterId of its KafkaConfig
+	ClusterIDCheckIntervalSeconds int                     `json:"clusterIdCheckIntervalSeconds,omitempty"`
+	HighAvailability              *HighAvailabilityConfig `json:"highAvailability,omitempty"`
+	// How often the preflight checks run at startup are re-run, so that permissions granted or revoked since show up
+	PreflightIntervalSeconds int `json:"preflightIntervalSeconds,omitempty"`
+	// Name this instance identifies its probes with, which defaults to the hostname and must be unique among the
+	// instances sharing the monitoring topic
+	InstanceName string `json:"instanceName,omitempty"`
+	// In mesh mode, the probes of every instance sharing the monitoring topic are measured, not only this one's
+	Mesh          bool                 `json:"mesh,omitempty"`
+	StatsSnapshot *StatsSnapshotConfig `json:"statsSnapshot,omitempty"`
+	ProbeHistory  *ProbeHistoryConfig  `json:"probeHistory,omitempty"`
+	ResultsTopic  *ResultsTopicConfig  `json:"resultsTopic,omitempty"`
 }
 
 type KafkaConfig struct {
 	SeedBrokers []string `json:"seedBrokers" validate:"required,min=1,dive,min=1"`
+	// ClientID is sent with every request, which quotas can be applied to (or exempted from) by
+	ClientID string `json:"clientId,omitempty"`
+	// If set, probing and topic reconciliation stop while kmon's clients are connected to a cluster with another ID
+	ClusterID string `json:"clusterId,omitempty"`
+}
+
+// ConsumerGroupConfig makes the Monitor consume as a member of a consumer group, committing its offsets, instead of
+// consuming partitions directly. Every kmon instance needs its own group, as the partitions of a group are split
+// between its members.
+type ConsumerGroupConfig struct {
+	GroupID          string `json:"groupId" validate:"required,min=1"`
+	CommitIntervalMs int    `json:"commitIntervalMs,omitempty"`
+}
+
+func (cfg *ConsumerGroupConfig) GetCommitIntervalMs() int {
+	if cfg.CommitIntervalMs != 0 {
+		return cfg.CommitIntervalMs
+	}
+	return 5000
+}
+
+// TransactionalProbesConfig enables a transactional probe stream on the producer cluster's monitoring topic, with one
+// transactional producer per transaction coordinator.
+type TransactionalProbesConfig struct {
+	IntervalMs            int    `json:"intervalMs,omitempty"`
+	TransactionalIDPrefix string `json:"transactionalIdPrefix,omitempty"`
+}
+
+func (cfg *TransactionalProbesConfig) GetIntervalMs() int {
+	if cfg.IntervalMs != 0 {
+		return cfg.IntervalMs
+	}
+	return 10000
+}
+
+func (cfg *TransactionalProbesConfig) GetTransactionalIDPrefix() string {
+	if cfg.TransactionalIDPrefix != "" {
+		return cfg.TransactionalIDPrefix
+	}
+	return "kmon-txn"
+}
+
+// ReadOnlyConfig makes kmon monitor an externally managed topic as it is, without ever issuing mutating admin
+// requests. The topic's partitions and leaders are discovered through metadata every refreshIntervalSeconds.
+type ReadOnlyConfig struct {
+	RefreshIntervalSeconds int `json:"refreshIntervalSeconds,omitempty"`
+}
+
+func (cfg *ReadOnlyConfig) GetRefreshIntervalSeconds() int {
+	if cfg.RefreshIntervalSeconds != 0 {
+		return cfg.RefreshIntervalSeconds
+	}
+	return 30
+}
+
+// StatsSnapshotConfig makes kmon save its latency and loss windows to path every intervalSeconds and on shutdown, and
+// restore them when a Monitor starts if the snapshot is at most maxAgeSeconds old.
+type StatsSnapshotConfig struct {
+	Path            string `json:"path" validate:"required,min=1"`
+	IntervalSeconds int    `json:"intervalSeconds,omitempty"`
+	MaxAgeSeconds   int    `json:"maxAgeSeconds,omitempty"`
+}
+
+func (cfg *StatsSnapshotConfig) GetIntervalSeconds() int {
+	if cfg.IntervalSeconds != 0 {
+		return cfg.IntervalSeconds
+	}
+	return 30
+}
+
+func (cfg *StatsSnapshotConfig) GetMaxAgeSeconds() int {
+	if cfg.MaxAgeSeconds != 0 {
+		return cfg.MaxAgeSeconds
+	}
+	return 300
+}
+
+// ProbeHistoryConfig makes kmon record the result of every probe to segment files in dir, starting a new segment
+// every segmentMinutes. Segments are deleted once they are older than retentionHours, or oldest first while they take
+// more than maxSizeMB.
+type ProbeHistoryConfig struct {
+	Dir            string `json:"dir" validate:"required,min=1"`
+	SegmentMinutes int    `json:"segmentMinutes,omitempty"`
+	RetentionHours int    `json:"retentionHours,omitempty"`
+	MaxSizeMB      int    `json:"maxSizeMB,omitempty"`
+}
+
+func (cfg *ProbeHistoryConfig) GetSegmentMinutes() int {
+	if cfg.SegmentMinutes != 0 {
+		return cfg.SegmentMinutes
+	}
+	return 60
+}
+
+func (cfg *ProbeHistoryConfig) GetRetentionHours() int {
+	if cfg.RetentionHours != 0 {
+		return cfg.RetentionHours
+	}
+	return 24
+}
+
+func (cfg *ProbeHistoryConfig) GetMaxSizeMB() int {
+	if cfg.MaxSizeMB != 0 {
+		return cfg.MaxSizeMB
+	}
+	return 1024
+}
+
+// ResultsTopicConfig makes kmon publish the result of every probe as JSON to topic, on the cluster of kafkaConfig
+// which defaults to the producer cluster. The topic must already exist.
+type ResultsTopicConfig struct {
+	Topic       string       `json:"topic" validate:"required,min=1"`
+	KafkaConfig *KafkaConfig `json:"kafkaConfig,omitempty"`
+}
+
+func (cfg *ResultsTopicConfig) GetKafkaConfig(producerKafkaConfig *KafkaConfig) *KafkaConfig {
+	if cfg.KafkaConfig != nil {
+		return cfg.KafkaConfig
+	}
+	return producerKafkaConfig
+}
+
+// HighAvailabilityConfig makes the kmon replicas monitoring the same topic elect a leader through a consumer group
+// on a single-partition lease topic, which defaults to kmon-leader-<producerMonitoringTopic>. Only the leader
+// reconciles the monitoring topic and runs the admin and group coordinator canaries, while the other replicas
+// discover the topic's layout every refreshIntervalSeconds.
+type HighAvailabilityConfig struct {
+	LeaseTopic             string `json:"leaseTopic,omitempty"`
+	SessionTimeoutMs       int    `json:"sessionTimeoutMs,omitempty"`
+	RefreshIntervalSeconds int    `json:"refreshIntervalSeconds,omitempty"`
+}
+
+func (cfg *HighAvailabilityConfig) GetLeaseTopic(monitoringTopic string) string {
+	if cfg.LeaseTopic != "" {
+		return cfg.LeaseTopic
+	}
+	return "kmon-leader-" + monitoringTopic
+}
+
+func (cfg *HighAvailabilityConfig) GetSessionTimeoutMs() int {
+	if cfg.SessionTimeoutMs != 0 {
+		return cfg.SessionTimeoutMs
+	}
+	return 10000
+}
+
+func (cfg *HighAvailabilityConfig) GetRefreshIntervalSeconds() int {
+	if cfg.RefreshIntervalSeconds != 0 {
+		return cfg.RefreshIntervalSeconds
+	}
+	return 30
+}
+
+// GroupCanaryConfig enables offset commit canaries against the group coordinator on every broker of the producer
+// cluster.
+type GroupCanaryConfig struct {
+	IntervalMs    int    `json:"intervalMs,omitempty"`
+	GroupIDPrefix string `json:"groupIdPrefix,omitempty"`
+}
+
+func (cfg *GroupCanaryConfig) GetIntervalMs() int {
+	if cfg.IntervalMs != 0 {
+		return cfg.IntervalMs
+	}
+	return 10000
+}
+
+func (cfg *GroupCanaryConfig) GetGroupIDPrefix() string {
+	if cfg.GroupIDPrefix != "" {
+		return cfg.GroupIDPrefix
+	}
+	return "kmon-canary"
+}
+
+// BrokerPingsConfig enables ApiVersions and Metadata pings sent directly to every broker of the producer cluster.
+type BrokerPingsConfig struct {
+	IntervalMs int `json:"intervalMs,omitempty"`
+	TimeoutMs  int `json:"timeoutMs,omitempty"`
+}
+
+func (cfg *BrokerPingsConfig) GetIntervalMs() int {
+	if cfg.IntervalMs != 0 {
+		return cfg.IntervalMs
+	}
+	return 5000
+}
+
+func (cfg *BrokerPingsConfig) GetTimeoutMs() int {
+	if cfg.TimeoutMs != 0 {
+		return cfg.TimeoutMs
+	}
+	return 2000
+}
+
+// AdminCanaryConfig enables a canary that creates, describes, alters and deletes a scratch topic on the producer
+// cluster. The scratch topic is named <topicPrefix>-<producerMonitoringTopic>.
+type AdminCanaryConfig struct {
+	IntervalMs  int    `json:"intervalMs,omitempty"`
+	TimeoutMs   int    `json:"timeoutMs,omitempty"`
+	TopicPrefix string `json:"topicPrefix,omitempty"`
+	// How long creations and deletions are given to propagate to every live broker, defaulting to timeoutMs
+	PropagationTimeoutMs int `json:"propagationTimeoutMs,omitempty"`
+}
+
+func (cfg *AdminCanaryConfig) GetIntervalMs() int {
+	if cfg.IntervalMs != 0 {
+		return cfg.IntervalMs
+	}
+	return 60000
+}
+
+func (cfg *AdminCanaryConfig) GetTimeoutMs() int {
+	if cfg.TimeoutMs != 0 {
+		return cfg.TimeoutMs
+	}
+	return 30000
+}
+
+func (cfg *AdminCanaryConfig) GetPropagationTimeoutMs() int {
+	if cfg.PropagationTimeoutMs != 0 {
+		return cfg.PropagationTimeoutMs
+	}
+	return cfg.GetTimeoutMs()
+}
+
+func (cfg *AdminCanaryConfig) GetTopicPrefix() string {
+	if cfg.TopicPrefix != "" {
+		return cfg.TopicPrefix
+	}
+	return "kmon-admin-canary"
+}
+
+// MetricsConfig enables push-based metrics sinks. Metrics are always served in the Prometheus format regardless.
+type MetricsConfig struct {
+	OTLP   *OTLPConfig   `json:"otlp,omitempty"`
+	StatsD *StatsDConfig `json:"statsd,omitempty"`
+}
+
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http"
+)
+
+type OTLPConfig struct {
+	Endpoint            string            `json:"endpoint" validate:"required,min=1"`
+	Protocol            string            `json:"protocol,omitempty"`
+	URLPath             string            `json:"urlPath,omitempty"`
+	Insecure            bool              `json:"insecure,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	PushIntervalSeconds int               `json:"pushIntervalSeconds,omitempty"`
+}
+
+type StatsDConfig struct {
+	Address   string `json:"address" validate:"required,min=1"`
+	Prefix    string `json:"prefix,omitempty"`
+	DogStatsD bool   `json:"dogStatsD,omitempty"`
+}
+
+const (
+	LatencyTypeE2E = "e2e"
+	LatencyTypeP2B = "p2b"
+	LatencyTypeB2C = "b2c"
+	LatencyTypeAck = "ack"
+)
+
+// SLOConfig defines a latency SLO of the form "Target of probes have a LatencyType latency of at most
+// LatencyThresholdMs". Probes that fail to produce or are never consumed always count against the SLO.
+type SLOConfig struct {
+	Name                   string  `json:"name" validate:"required,min=1"`
+	LatencyType            string  `json:"latencyType,omitempty"`
+	LatencyThresholdMs     int     `json:"latencyThresholdMs" validate:"required,min=1"`
+	Target                 float64 `json:"target,omitempty" validate:"omitempty,gt=0,lt=1"`
+	ComplianceWindowDays   int     `json:"complianceWindowDays,omitempty"`
+	BurnRateWindowsMinutes []int   `json:"burnRateWindowsMinutes,omitempty"`
+}
+
+func (cfg *SLOConfig) GetLatencyType() string {
+	if cfg.LatencyType != "" {
+		return cfg.LatencyType
+	}
+	return LatencyTypeE2E
+}
+
+func (cfg *SLOConfig) GetTarget() float64 {
+	if cfg.Target != 0 {
+		return cfg.Target
+	}
+	return 0.999
+}
+
+func (cfg *SLOConfig) GetComplianceWindowDays() int {
+	if cfg.ComplianceWindowDays != 0 {
+		return cfg.ComplianceWindowDays
+	}
+	return 30
+}
+
+// The defaults are the windows of the usual multi-window, multi-burn-rate alerts (5m/1h and 30m/6h).
+func (cfg *SLOConfig) GetBurnRateWindowsMinutes() []int {
+	if len(cfg.BurnRateWindowsMinutes) != 0 {
+		return cfg.BurnRateWindowsMinutes
+	}
+	return []int{5, 30, 60, 360}
+}
+
+// Besides the latency types, alert rules can be defined on these ratios.
+const (
+	AlertMetricProduceFailureRatio = "produceFailureRatio"
+	AlertMetricLossRatio           = "lossRatio"
+)
+
+// AlertingConfig defines alert rules that are evaluated against the Monitor's sliding windows, for every partition,
+// and the notifiers that firing and resolved alerts are sent to.
+type AlertingConfig struct {
+	Rules                     []*AlertRuleConfig `json:"rules" validate:"required,dive"`
+	Notifiers                 []*NotifierConfig  `json:"notifiers" validate:"required,dive"`
+	EvaluationIntervalSeconds int                `json:"evaluationIntervalSeconds,omitempty"`
+	RepeatIntervalMinutes     int                `json:"repeatIntervalMinutes,omitempty"`
+}
+
+// AlertRuleConfig fires when Metric (a latency type or one of the alert ratios) exceeds Threshold on any partition
+// for at least ForSeconds. For latency types, the value compared is the Percentile of the window in milliseconds.
+type AlertRuleConfig struct {
+	Name       string  `json:"name" validate:"required,min=1"`
+	Metric     string  `json:"metric" validate:"required"`
+	Percentile float64 `json:"percentile,omitempty"`
+	Threshold  float64 `json:"threshold"`
+	ForSeconds int     `json:"forSeconds,omitempty"`
+	Severity   string  `json:"severity,omitempty"`
+}
+
+const (
+	NotifierTypeWebhook   = "webhook"
+	NotifierTypeSlack     = "slack"
+	NotifierTypePagerDuty = "pagerduty"
+)
+
+type NotifierConfig struct {
+	Type       string `json:"type" validate:"required"`
+	URL        string `json:"url,omitempty"`
+	RoutingKey string `json:"routingKey,omitempty"`
+}
+
+func (cfg *AlertingConfig) GetEvaluationIntervalSeconds() int {
+	if cfg.EvaluationIntervalSeconds != 0 {
+		return cfg.EvaluationIntervalSeconds
+	}
+	return 10
+}
+
+func (cfg *AlertRuleConfig) GetPercentile() float64 {
+	if cfg.Percentile != 0 {
+		return cfg.Percentile
+	}
+	return 99
+}
+
+func (cfg *AlertRuleConfig) GetSeverity() string {
+	if cfg.Severity != "" {
+		return cfg.Severity
+	}
+	return "warning"
+}
+
+func (cfg *NotifierConfig) GetURL() string {
+	if cfg.URL != "" {
+		return cfg.URL
+	}
+	if cfg.Type == NotifierTypePagerDuty {
+		return "https://events.pagerduty.com/v2/enqueue"
+	}
+	return ""
+}
+
+func (cfg *OTLPConfig) GetProtocol() string {
+	if cfg.Protocol != "" {
+		return cfg.Protocol
+	}
+	return OTLPProtocolGRPC
+}
+
+func (cfg *OTLPConfig) GetPushIntervalSeconds() int {
+	if cfg.PushIntervalSeconds != 0 {
+		return cfg.PushIntervalSeconds
+	}
+	return 15
 }
 
 func (cfg *KMonConfig) GetSampleFrequencyMs() int {
@@ -32,6 +450,13 @@ func (cfg *KMonConfig) GetStatsWindowSeconds() int {
 	return 60
 }
 
+func (cfg *KMonConfig) GetProbeTimeoutMs() int {
+	if cfg.ProbeTimeoutMs != 0 {
+		return cfg.ProbeTimeoutMs
+	}
+	return 10000
+}
+
 func (cfg *KMonConfig) String() string {
 	data, _ := json.Marshal(cfg)
 	return string(data)
@@ -44,6 +469,31 @@ func (cfg *KMonConfig) GetTopicReconciliationFrequencyMin() int {
 	return 60
 }
 
+func (cfg *KMonConfig) GetClusterIDCheckIntervalSeconds() int {
+	if cfg.ClusterIDCheckIntervalSeconds != 0 {
+		return cfg.ClusterIDCheckIntervalSeconds
+	}
+	return 60
+}
+
+func (cfg *KMonConfig) GetPreflightIntervalSeconds() int {
+	if cfg.PreflightIntervalSeconds != 0 {
+		return cfg.PreflightIntervalSeconds
+	}
+	return 300
+}
+
+func (cfg *KMonConfig) GetInstanceName() string {
+	if cfg.InstanceName != "" {
+		return cfg.InstanceName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "kmon"
+	}
+	return hostname
+}
+
 func GetKMonConfigFromBytes(data *[]byte) (*KMonConfig, error) {
 	var cfg KMonConfig
 	err := json.Unmarshal(*data, &cfg)
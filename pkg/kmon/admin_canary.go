@@ -0,0 +1,220 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	adminCanaryOpCreate      = "create"
+	adminCanaryOpMarkOwner   = "mark_owner"
+	adminCanaryOpDescribe    = "describe"
+	adminCanaryOpAlterConfig = "alter_config"
+	adminCanaryOpDelete      = "delete"
+)
+
+// AdminCanary periodically creates, describes, alters and deletes a scratch topic on the producer cluster, measuring
+// how long each admin operation takes and how long creations and deletions take to show up in every broker's
+// metadata. The scratch topic is named after the monitoring topic and marked as owned by kmon, and a scratch topic
+// that isn't marked as ours is never deleted.
+type AdminCanary struct {
+	metrics   *Metrics
+	client    *kgo.Client
+	admClient *kadm.Client
+	topic     string
+	owner     string
+	interval  time.Duration
+	timeout   time.Duration
+	// How long creations and deletions are given to show up in every live broker's metadata
+	propagationTimeout time.Duration
+	// The canary is skipped while paused returns true, if set
+	paused func() bool
+}
+
+func NewAdminCanaryFromConfig(cfg *config.KMonConfig, metrics *Metrics) (*AdminCanary, error) {
+	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleAdmin, metrics.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdminCanary{
+		metrics:            metrics,
+		client:             client,
+		admClient:          kadm.NewClient(client),
+		topic:              cfg.AdminCanary.GetTopicPrefix() + "-" + cfg.ProducerMonitoringTopic,
+		owner:              monitoringTopicOwner(cfg.ProducerMonitoringTopic),
+		interval:           time.Duration(cfg.AdminCanary.GetIntervalMs()) * time.Millisecond,
+		timeout:            time.Duration(cfg.AdminCanary.GetTimeoutMs()) * time.Millisecond,
+		propagationTimeout: time.Duration(cfg.AdminCanary.GetPropagationTimeoutMs()) * time.Millisecond,
+	}, nil
+}
+
+func (c *AdminCanary) close() {
+	c.client.Close()
+}
+
+func (c *AdminCanary) Start(ctx context.Context) {
+	defer c.close()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if c.paused != nil && c.paused() {
+				continue
+			}
+			if err := c.probe(ctx); err != nil {
+				log.Warn().Err(err).Msg("failed to run admin canary")
+			}
+		}
+	}
+}
+
+func (c *AdminCanary) probe(ctx context.Context) error {
+	// Every step gets its own timeout, so that a slow step doesn't leave the topic behind
+	var brokerIDs []int32
+	err := c.withTimeout(ctx, c.timeout, func(ctx context.Context) error {
+		var err error
+		if brokerIDs, err = liveBrokers(ctx, c.admClient); err != nil {
+			return err
+		}
+		// A previous run may have been interrupted before deleting the scratch topic
+		return c.deleteLeftoverTopic(ctx, brokerIDs)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.withTimeout(ctx, c.timeout, func(ctx context.Context) error {
+		return c.timed(adminCanaryOpCreate, func() error {
+			_, err := c.admClient.CreateTopic(ctx, 1, -1, map[string]*string{"retention.ms": kadm.StringPtr("60000")}, c.topic)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// The topic is deleted at the end of this run whatever happens, and marking it right away lets the next run clean
+	// it up if this one is interrupted
+	_ = c.withTimeout(ctx, c.timeout, func(ctx context.Context) error {
+		return c.timed(adminCanaryOpMarkOwner, func() error {
+			return markTopicOwner(ctx, c.admClient, c.topic, c.owner)
+		})
+	})
+	_ = c.withTimeout(ctx, c.propagationTimeout, func(ctx context.Context) error {
+		c.waitForPropagation(ctx, brokerIDs, adminCanaryOpCreate, true)
+		return nil
+	})
+
+	_ = c.withTimeout(ctx, c.timeout, func(ctx context.Context) error {
+		return c.timed(adminCanaryOpDescribe, func() error {
+			configs, err := c.admClient.DescribeTopicConfigs(ctx, c.topic)
+			if err != nil {
+				return err
+			}
+			_, err = configs.On(c.topic, nil)
+			return err
+		})
+	})
+
+	_ = c.withTimeout(ctx, c.timeout, func(ctx context.Context) error {
+		return c.timed(adminCanaryOpAlterConfig, func() error {
+			resp, err := c.admClient.AlterTopicConfigs(ctx, []kadm.AlterConfig{{Op: kadm.SetConfig, Name: "retention.ms", Value: kadm.StringPtr("120000")}}, c.topic)
+			if err != nil {
+				return err
+			}
+			r, err := resp.On(c.topic, nil)
+			if err != nil {
+				return err
+			}
+			return r.Err
+		})
+	})
+
+	// The delete is attempted even if ctx is done, as the topic would otherwise outlive the canary
+	err = c.withTimeout(context.WithoutCancel(ctx), c.timeout, func(ctx context.Context) error {
+		return c.timed(adminCanaryOpDelete, func() error {
+			_, err := c.admClient.DeleteTopic(ctx, c.topic)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return c.withTimeout(ctx, c.propagationTimeout, func(ctx context.Context) error {
+		c.waitForPropagation(ctx, brokerIDs, adminCanaryOpDelete, false)
+		return nil
+	})
+}
+
+func (c *AdminCanary) withTimeout(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return f(timeoutCtx)
+}
+
+func (c *AdminCanary) deleteLeftoverTopic(ctx context.Context, brokerIDs []int32) error {
+	topics, err := c.admClient.ListTopics(ctx, c.topic)
+	if err != nil {
+		return err
+	}
+	td, exists := topics[c.topic]
+	if !exists || errors.Is(td.Err, kerr.UnknownTopicOrPartition) {
+		return nil
+	}
+
+	owner, err := getTopicOwner(ctx, c.admClient, c.topic)
+	if err != nil {
+		return err
+	}
+	if owner != c.owner {
+		c.metrics.AdminCanaryFailureCount.WithLabelValues(adminCanaryOpMarkOwner).Inc()
+		return fmt.Errorf("scratch topic %s already exists and is owned by %q instead of %q, refusing to touch it", c.topic, owner, c.owner)
+	}
+
+	log.Info().Msgf("Deleting leftover scratch topic %s", c.topic)
+	if _, err := c.admClient.DeleteTopic(ctx, c.topic); err != nil && !errors.Is(err, kerr.UnknownTopicOrPartition) {
+		return err
+	}
+	_, err = waitForTopicPropagation(ctx, c.client, c.topic, brokerIDs, false)
+	return err
+}
+
+func (c *AdminCanary) timed(operation string, f func() error) error {
+	start := time.Now()
+	if err := f(); err != nil {
+		log.Warn().Err(err).Msgf("admin canary %s failed", operation)
+		c.metrics.AdminCanaryFailureCount.WithLabelValues(operation).Inc()
+		return err
+	}
+	c.metrics.AdminCanaryLatency.WithLabelValues(operation).Observe(float64(time.Since(start).Milliseconds()))
+	return nil
+}
+
+// waitForPropagation records how long every live broker's metadata took to agree on whether the scratch topic exists.
+// Brokers that don't catch up before ctx is done are counted as failures.
+func (c *AdminCanary) waitForPropagation(ctx context.Context, brokerIDs []int32, operation string, exists bool) {
+	durations, _ := waitForTopicPropagation(ctx, c.client, c.topic, brokerIDs, exists)
+	for _, brokerID := range brokerIDs {
+		brokerLabel := strconv.Itoa(int(brokerID))
+		if d, ok := durations[brokerID]; ok {
+			c.metrics.AdminCanaryPropagationLatency.WithLabelValues(brokerLabel, operation).Observe(float64(d.Milliseconds()))
+		} else {
+			c.metrics.AdminCanaryPropagationFailureCount.WithLabelValues(brokerLabel, operation).Inc()
+		}
+	}
+}
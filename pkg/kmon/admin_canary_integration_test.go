@@ -0,0 +1,66 @@
+//go:build integration
+
+package kmon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func setupAdminCanary(t *testing.T, topic string) (*AdminCanary, *prometheus.Registry, context.Context) {
+	ctx := context.Background()
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: topic,
+		ProducerKafkaConfig: &config.KafkaConfig{
+			SeedBrokers: []string{"localhost:10000"},
+		},
+		AdminCanary: &config.AdminCanaryConfig{},
+	}
+
+	metrics, registry := newTestMetricsWithRegistry()
+	tm, err := NewTopicManagerFromConfig(cfg, metrics)
+	require.NoError(t, err)
+	c, err := NewAdminCanaryFromConfig(cfg, metrics)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_, _ = c.admClient.DeleteTopics(ctx, c.topic)
+		c.client.Close()
+		tm.admClient.Close()
+	})
+
+	return c, registry, ctx
+}
+
+func TestAdminCanaryProbe(t *testing.T) {
+	c, registry, ctx := setupAdminCanary(t, "kmon-admin")
+
+	require.NoError(t, c.probe(ctx))
+
+	require.Empty(t, metricSamples(t, registry, "kmon_admin_canary_failure_count"))
+	require.Empty(t, metricSamples(t, registry, "kmon_admin_canary_propagation_failure_count"))
+	require.Equal(t, map[string]float64{"create": 1, "mark_owner": 1, "describe": 1, "alter_config": 1, "delete": 1}, metricSamples(t, registry, "kmon_admin_canary_latency_ms"))
+	require.Len(t, metricSamples(t, registry, "kmon_admin_canary_propagation_latency_ms"), 6)
+
+	exists, err := topicExistsOn(ctx, c.client, c.topic)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestAdminCanaryRefusesUnownedTopic(t *testing.T) {
+	c, registry, ctx := setupAdminCanary(t, "kmon-admin-unowned")
+
+	_, err := c.admClient.CreateTopic(ctx, 1, -1, nil, c.topic)
+	require.NoError(t, err)
+
+	require.Error(t, c.probe(ctx))
+	require.Equal(t, map[string]float64{"mark_owner": 1}, metricSamples(t, registry, "kmon_admin_canary_failure_count"))
+
+	exists, err := topicExistsOn(ctx, c.client, c.topic)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
@@ -0,0 +1,220 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/datastructs/pkg/stats"
+	"github.com/pliu/kmon/pkg/alerting"
+	"github.com/pliu/kmon/pkg/config"
+)
+
+// AlertEvaluator periodically evaluates the alert rules against the sliding windows of the current Monitor. Its state
+// outlives any single Monitor, so alerts keep firing (and are resolved only once) across topic reconciliations.
+type AlertEvaluator struct {
+	metrics            *Metrics
+	rules              []*config.AlertRuleConfig
+	notifiers          []alerting.Notifier
+	evaluationInterval time.Duration
+	repeatInterval     time.Duration
+	monitor            func() *Monitor
+	// Only accessed from the evaluation goroutine
+	states map[string]*alertState
+}
+
+type alertState struct {
+	alert        *alerting.Alert
+	pendingSince time.Time
+	firing       bool
+	lastNotified time.Time
+}
+
+func NewAlertEvaluatorFromConfig(cfg *config.AlertingConfig, metrics *Metrics, monitor func() *Monitor) (*AlertEvaluator, error) {
+	notifiers := make([]alerting.Notifier, 0, len(cfg.Notifiers))
+	for _, notifierCfg := range cfg.Notifiers {
+		notifier, err := alerting.NewNotifierFromConfig(notifierCfg)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	for _, rule := range cfg.Rules {
+		switch rule.Metric {
+		case config.LatencyTypeE2E, config.LatencyTypeP2B, config.LatencyTypeB2C, config.LatencyTypeAck,
+			config.AlertMetricProduceFailureRatio, config.AlertMetricLossRatio:
+		default:
+			return nil, fmt.Errorf("alert rule %s has unsupported metric %q", rule.Name, rule.Metric)
+		}
+	}
+
+	return &AlertEvaluator{
+		metrics:            metrics,
+		rules:              cfg.Rules,
+		notifiers:          notifiers,
+		evaluationInterval: time.Duration(cfg.GetEvaluationIntervalSeconds()) * time.Second,
+		repeatInterval:     time.Duration(cfg.RepeatIntervalMinutes) * time.Minute,
+		monitor:            monitor,
+		states:             make(map[string]*alertState),
+	}, nil
+}
+
+func (e *AlertEvaluator) Start(ctx context.Context) {
+	ticker := time.NewTicker(e.evaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.evaluate(ctx, time.Now())
+		}
+	}
+}
+
+func (e *AlertEvaluator) evaluate(ctx context.Context, now time.Time) {
+	seen := make(map[string]bool)
+
+	if m := e.monitor(); m != nil {
+		for _, rule := range e.rules {
+			for partition := range m.pending {
+				partitionLabel, brokerLabel := m.labels(partition)
+				labels := map[string]string{"partition": partitionLabel, "broker": brokerLabel}
+				fingerprint := alerting.Fingerprint(rule.Name, labels)
+				seen[fingerprint] = true
+
+				// Without data, e.g. while every probe is lost or right after the Monitor is recreated, the condition
+				// can't be evaluated, so the alert keeps its state rather than being resolved
+				value, ok := e.value(m, rule, partition)
+				if !ok {
+					continue
+				}
+				e.transition(ctx, now, rule, fingerprint, labels, value, value > rule.Threshold)
+			}
+		}
+	}
+
+	// Alerts for partitions that no longer exist can't be evaluated anymore, so they are resolved
+	for fingerprint, state := range e.states {
+		if !seen[fingerprint] {
+			if state.firing {
+				e.resolve(ctx, now, state)
+			}
+			delete(e.states, fingerprint)
+		}
+	}
+}
+
+// transition moves the alert through its states: pending once the condition holds, firing once it has held for the
+// rule's duration and resolved once it no longer holds. Notifications are only sent on transitions (and every repeat
+// interval while firing, if configured).
+func (e *AlertEvaluator) transition(ctx context.Context, now time.Time, rule *config.AlertRuleConfig, fingerprint string, labels map[string]string, value float64, violated bool) {
+	state, ok := e.states[fingerprint]
+	if !ok {
+		state = &alertState{alert: &alerting.Alert{
+			Rule:        rule.Name,
+			Severity:    rule.GetSeverity(),
+			Labels:      labels,
+			Threshold:   rule.Threshold,
+			Fingerprint: fingerprint,
+		}}
+		e.states[fingerprint] = state
+	}
+
+	if !violated {
+		state.pendingSince = time.Time{}
+		if state.firing {
+			e.resolve(ctx, now, state)
+		}
+		return
+	}
+
+	state.alert.Value = value
+	if state.pendingSince.IsZero() {
+		state.pendingSince = now
+	}
+	if !state.firing && now.Sub(state.pendingSince) >= time.Duration(rule.ForSeconds)*time.Second {
+		state.firing = true
+		state.alert.Status = alerting.StatusFiring
+		state.alert.StartsAt = now
+		state.alert.EndsAt = time.Time{}
+		state.alert.Summary = fmt.Sprintf("%s is %.3f (threshold %.3f) on partition %s (broker %s)",
+			e.describe(rule), value, rule.Threshold, labels["partition"], labels["broker"])
+		e.metrics.AlertFiring.WithLabelValues(rule.Name, labels["partition"], labels["broker"]).Set(1)
+		e.notify(ctx, now, state)
+	} else if state.firing && e.repeatInterval > 0 && now.Sub(state.lastNotified) >= e.repeatInterval {
+		e.notify(ctx, now, state)
+	}
+}
+
+func (e *AlertEvaluator) resolve(ctx context.Context, now time.Time, state *alertState) {
+	state.firing = false
+	state.alert.Status = alerting.StatusResolved
+	state.alert.EndsAt = now
+	e.metrics.AlertFiring.WithLabelValues(state.alert.Rule, state.alert.Labels["partition"], state.alert.Labels["broker"]).Set(0)
+	e.notify(ctx, now, state)
+}
+
+func (e *AlertEvaluator) notify(ctx context.Context, now time.Time, state *alertState) {
+	state.lastNotified = now
+	log.Info().Msgf("Alert %s is %s: %s", state.alert.Fingerprint, state.alert.Status, state.alert.Summary)
+	for _, notifier := range e.notifiers {
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := notifier.Notify(timeoutCtx, state.alert)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to send alert %s to %s notifier", state.alert.Fingerprint, notifier.Name())
+			e.metrics.AlertNotificationFailureCount.WithLabelValues(notifier.Name()).Inc()
+			continue
+		}
+		e.metrics.AlertNotificationCount.WithLabelValues(notifier.Name(), state.alert.Status).Inc()
+	}
+}
+
+// value returns the rule's metric over the Monitor's window for the partition, or false if the window is empty.
+func (e *AlertEvaluator) value(m *Monitor, rule *config.AlertRuleConfig, partition int) (float64, bool) {
+	switch rule.Metric {
+	case config.LatencyTypeE2E:
+		return percentile(m.e2eStats[partition], rule.GetPercentile())
+	case config.LatencyTypeP2B:
+		return percentile(m.p2bStats[partition], rule.GetPercentile())
+	case config.LatencyTypeB2C:
+		return percentile(m.b2cStats[partition], rule.GetPercentile())
+	case config.LatencyTypeAck:
+		return percentile(m.producerAckStats[partition], rule.GetPercentile())
+	case config.AlertMetricProduceFailureRatio:
+		return ratio(m.produceFailureStats[partition].Len(), m.producerAckStats[partition].Len())
+	case config.AlertMetricLossRatio:
+		return ratio(m.lostStats[partition].Len(), m.e2eStats[partition].Len())
+	}
+	return 0, false
+}
+
+func (e *AlertEvaluator) describe(rule *config.AlertRuleConfig) string {
+	switch rule.Metric {
+	case config.AlertMetricProduceFailureRatio:
+		return "produce failure ratio"
+	case config.AlertMetricLossRatio:
+		return "loss ratio"
+	default:
+		return fmt.Sprintf("%s p%g latency (ms)", rule.Metric, rule.GetPercentile())
+	}
+}
+
+func percentile(s *stats.Stats, p float64) (float64, bool) {
+	res, ok := s.Percentile([]float64{p})
+	if !ok {
+		return 0, false
+	}
+	return float64(res[0]), true
+}
+
+// ratio returns bad / (bad + good).
+func ratio(bad int, good int) (float64, bool) {
+	if bad+good == 0 {
+		return 0, false
+	}
+	return float64(bad) / float64(bad+good), true
+}
@@ -0,0 +1,86 @@
+package kmon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/alerting"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertEvaluator(t *testing.T) {
+	alerts := make(chan *alerting.Alert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := &alerting.Alert{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(alert))
+		alerts <- alert
+	}))
+	defer srv.Close()
+
+	partitions := 2
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "test-topic", &MockKgoClient{}, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m.partitionBrokers = []int32{1, 2}
+	cfg := &config.AlertingConfig{
+		Rules: []*config.AlertRuleConfig{
+			{Name: "e2e-p99", Metric: config.LatencyTypeE2E, Threshold: 500, ForSeconds: 60},
+			{Name: "produce-failures", Metric: config.AlertMetricProduceFailureRatio, Threshold: 0.1},
+		},
+		Notifiers: []*config.NotifierConfig{{Type: config.NotifierTypeWebhook, URL: srv.URL}},
+	}
+	var current *Monitor
+	e, err := NewAlertEvaluatorFromConfig(cfg, m.metrics, func() *Monitor { return current })
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now()
+	// No monitor yet
+	e.evaluate(ctx, now)
+	current = m
+
+	m.e2eStats[1].Add(1000)
+	m.producerAckStats[0].Add(10)
+	e.evaluate(ctx, now)
+	require.Empty(t, alerts)
+
+	// The latency rule only fires once the condition has held for the rule's duration, and only notifies once
+	e.evaluate(ctx, now.Add(time.Minute))
+	alert := <-alerts
+	require.Equal(t, "e2e-p99", alert.Rule)
+	require.Equal(t, alerting.StatusFiring, alert.Status)
+	require.Equal(t, map[string]string{"partition": "1", "broker": "2"}, alert.Labels)
+	require.Equal(t, 1000.0, alert.Value)
+	e.evaluate(ctx, now.Add(2*time.Minute))
+	require.Empty(t, alerts)
+
+	// The ratio rule has no duration, so it fires immediately
+	m.produceFailureStats[0].Add(1)
+	e.evaluate(ctx, now.Add(3*time.Minute))
+	alert = <-alerts
+	require.Equal(t, "produce-failures", alert.Rule)
+	require.Equal(t, map[string]string{"partition": "0", "broker": "1"}, alert.Labels)
+	require.InDelta(t, 0.5, alert.Value, 1e-9)
+
+	// Alerts keep firing while their windows are empty, e.g. right after the Monitor is recreated
+	recreated := NewMonitorWithClients(m.metrics, &MockKgoClient{}, "test-topic", &MockKgoClient{}, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
+	recreated.partitionBrokers = []int32{1, 2}
+	current = recreated
+	e.evaluate(ctx, now.Add(4*time.Minute))
+	require.Empty(t, alerts)
+	require.True(t, e.states[alerting.Fingerprint("e2e-p99", map[string]string{"partition": "1", "broker": "2"})].firing)
+
+	// Alerts for partitions that are gone are resolved
+	current = NewMonitorWithClients(m.metrics, &MockKgoClient{}, "test-topic", &MockKgoClient{}, "test-uuid", 0, time.Duration(1), time.Duration(5)*time.Minute, false)
+	e.evaluate(ctx, now.Add(5*time.Minute))
+	resolved := map[string]string{}
+	for range 2 {
+		alert = <-alerts
+		resolved[alert.Rule] = alert.Status
+	}
+	require.Equal(t, map[string]string{"e2e-p99": alerting.StatusResolved, "produce-failures": alerting.StatusResolved}, resolved)
+	require.Empty(t, e.states)
+}
@@ -0,0 +1,148 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/datastructs/pkg/set"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+const (
+	brokerPingRequestAPIVersions = "api_versions"
+	brokerPingRequestMetadata    = "metadata"
+)
+
+// BrokerPinger measures the round trip time of cheap requests sent directly to each broker of the producer cluster.
+// ApiVersions and topic-less Metadata requests never touch the log, so they tell a slow network or request handler
+// apart from slow appends. Brokers that host replicas but aren't registered are pinged too, and show up as failures.
+type BrokerPinger struct {
+	metrics  *Metrics
+	client   brokerClient
+	interval time.Duration
+	timeout  time.Duration
+	brokers  func(ctx context.Context) (*set.Set[int32], error)
+	// Pings are skipped while paused returns true, if set
+	paused func() bool
+}
+
+func NewBrokerPingerFromConfig(cfg *config.KMonConfig, metrics *Metrics, brokers func(ctx context.Context) (*set.Set[int32], error)) (*BrokerPinger, error) {
+	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleAdmin, metrics.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BrokerPinger{
+		metrics:  metrics,
+		client:   kgoBrokerClient{client},
+		interval: time.Duration(cfg.BrokerPings.GetIntervalMs()) * time.Millisecond,
+		timeout:  time.Duration(cfg.BrokerPings.GetTimeoutMs()) * time.Millisecond,
+		brokers:  brokers,
+	}, nil
+}
+
+func (p *BrokerPinger) close() {
+	p.client.Close()
+}
+
+func (p *BrokerPinger) Start(ctx context.Context) {
+	defer p.close()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.paused != nil && p.paused() {
+				continue
+			}
+			if err := p.pingAll(ctx); err != nil {
+				log.Warn().Err(err).Msg("failed to ping brokers")
+			}
+		}
+	}
+}
+
+func (p *BrokerPinger) pingAll(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+
+	brokerIDs, err := p.brokers(timeoutCtx)
+	if err != nil {
+		return err
+	}
+	registered, err := p.registeredBrokers(timeoutCtx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, brokerID := range brokerIDs.Items() {
+		brokerLabel := strconv.Itoa(int(brokerID))
+		if registered.Contains(brokerID) {
+			p.metrics.BrokerPingRegistered.WithLabelValues(brokerLabel).Set(1)
+		} else {
+			p.metrics.BrokerPingRegistered.WithLabelValues(brokerLabel).Set(0)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			broker := p.client.broker(brokerID)
+			p.ping(ctx, broker, brokerLabel, brokerPingRequestAPIVersions, kmsg.NewPtrApiVersionsRequest())
+			// A non-nil empty topic list asks for the brokers and cluster ID only
+			metadata := kmsg.NewPtrMetadataRequest()
+			metadata.Topics = []kmsg.MetadataRequestTopic{}
+			p.ping(ctx, broker, brokerLabel, brokerPingRequestMetadata, metadata)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// registeredBrokers returns the brokers currently registered in the cluster, refreshing the client's view of them
+// at the same time so that pings go to up to date addresses.
+func (p *BrokerPinger) registeredBrokers(ctx context.Context) (*set.Set[int32], error) {
+	req := kmsg.NewPtrMetadataRequest()
+	req.Topics = []kmsg.MetadataRequestTopic{}
+	resp, err := req.RequestWith(ctx, p.client)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := set.NewSet[int32]()
+	for _, broker := range resp.Brokers {
+		registered.Add(broker.NodeID)
+	}
+	return registered, nil
+}
+
+func (p *BrokerPinger) ping(ctx context.Context, broker kmsg.Requestor, brokerLabel string, request string, req kmsg.Request) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := broker.Request(timeoutCtx, req)
+	p.record(brokerLabel, request, time.Since(start), err)
+}
+
+func (p *BrokerPinger) record(brokerLabel string, request string, rtt time.Duration, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		p.metrics.BrokerPingTimeoutCount.WithLabelValues(brokerLabel, request).Inc()
+	case err != nil:
+		log.Debug().Err(err).Msgf("failed to ping broker %s with %s", brokerLabel, request)
+		p.metrics.BrokerPingFailureCount.WithLabelValues(brokerLabel, request).Inc()
+	default:
+		p.metrics.BrokerPingRTT.WithLabelValues(brokerLabel, request).Observe(float64(rtt.Microseconds()) / 1000)
+	}
+}
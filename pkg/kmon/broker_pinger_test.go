@@ -0,0 +1,84 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pliu/datastructs/pkg/set"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestBrokerPingerRecord(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	p := &BrokerPinger{metrics: metrics}
+
+	p.record("1", brokerPingRequestAPIVersions, 3*time.Millisecond, nil)
+	p.record("1", brokerPingRequestMetadata, 4*time.Millisecond, nil)
+	p.record("2", brokerPingRequestMetadata, 2*time.Second, fmt.Errorf("metadata: %w", context.DeadlineExceeded))
+	p.record("3", brokerPingRequestAPIVersions, 0, errors.New("unknown broker"))
+
+	require.Equal(t, map[string]float64{"1,api_versions": 1, "1,metadata": 1}, metricSamples(t, registry, "kmon_broker_ping_rtt_ms"))
+	require.Equal(t, map[string]float64{"2,metadata": 1}, metricSamples(t, registry, "kmon_broker_ping_timeout_count"))
+	require.Equal(t, map[string]float64{"3,api_versions": 1}, metricSamples(t, registry, "kmon_broker_ping_failure_count"))
+}
+
+func TestBrokerPingerPingAll(t *testing.T) {
+	var mu sync.Mutex
+	pings := map[int32][]string{}
+	client := &mockBrokerClient{
+		// Only brokers 1 and 2 are registered
+		RequestFunc: func(_ context.Context, req kmsg.Request) (kmsg.Response, error) {
+			resp := kmsg.NewPtrMetadataResponse()
+			for _, brokerID := range []int32{1, 2} {
+				broker := kmsg.NewMetadataResponseBroker()
+				broker.NodeID = brokerID
+				resp.Brokers = append(resp.Brokers, broker)
+			}
+			return resp, nil
+		},
+		BrokerFunc: func(brokerID int32) kmsg.Requestor {
+			return requestorFunc(func(_ context.Context, req kmsg.Request) (kmsg.Response, error) {
+				mu.Lock()
+				pings[brokerID] = append(pings[brokerID], kmsg.NameForKey(req.Key()))
+				mu.Unlock()
+				if brokerID == 3 {
+					return nil, errors.New("unknown broker")
+				}
+				return req.ResponseKind(), nil
+			})
+		},
+	}
+	metrics, registry := newTestMetricsWithRegistry()
+	p := &BrokerPinger{
+		metrics:  metrics,
+		client:   client,
+		interval: time.Second,
+		timeout:  time.Second,
+		brokers: func(context.Context) (*set.Set[int32], error) {
+			brokerIDs := set.NewSet[int32]()
+			for _, brokerID := range []int32{1, 2, 3} {
+				brokerIDs.Add(brokerID)
+			}
+			return brokerIDs, nil
+		},
+	}
+
+	require.NoError(t, p.pingAll(context.Background()))
+	// Every broker hosting replicas is pinged directly, whether or not it is registered
+	require.Equal(t, map[int32][]string{
+		1: {"ApiVersions", "Metadata"},
+		2: {"ApiVersions", "Metadata"},
+		3: {"ApiVersions", "Metadata"},
+	}, pings)
+	require.Equal(t, map[string]float64{"1": 1, "2": 1, "3": 0}, metricSamples(t, registry, "kmon_broker_ping_registered"))
+	require.Equal(t, map[string]float64{
+		"1,api_versions": 1, "1,metadata": 1,
+		"2,api_versions": 1, "2,metadata": 1,
+	}, metricSamples(t, registry, "kmon_broker_ping_rtt_ms"))
+	require.Equal(t, map[string]float64{"3,api_versions": 1, "3,metadata": 1}, metricSamples(t, registry, "kmon_broker_ping_failure_count"))
+}
@@ -0,0 +1,270 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/pliu/kmon/pkg/metrics"
+)
+
+// CheckOptions configures a one-shot health check.
+type CheckOptions struct {
+	ProbesPerPartition int
+	// A broker fails the check if the p99 e2e latency of its probes is above this
+	LatencyThresholdMs int64
+	// A broker fails the check if the ratio of its probes that weren't consumed is above this
+	LossThreshold float64
+}
+
+// CheckReport is the outcome of a one-shot health check.
+type CheckReport struct {
+	Topic   string               `json:"topic"`
+	Passed  bool                 `json:"passed"`
+	Brokers []*BrokerCheckResult `json:"brokers"`
+}
+
+// BrokerCheckResult aggregates the probes sent to the partitions led by a broker. Broker is -1 when mirroring, as
+// the partitions probes are consumed from are unrelated to their leaders on the producer cluster.
+type BrokerCheckResult struct {
+	Broker     int32    `json:"broker"`
+	Partitions []int    `json:"partitions"`
+	Sent       int      `json:"sent"`
+	Received   int      `json:"received"`
+	LossRatio  float64  `json:"lossRatio"`
+	P50Ms      int64    `json:"p50Ms"`
+	P99Ms      int64    `json:"p99Ms"`
+	MaxMs      int64    `json:"maxMs"`
+	Passed     bool     `json:"passed"`
+	Failures   []string `json:"failures,omitempty"`
+}
+
+// RunCheck validates the monitoring topic (reconciling it if its layout doesn't match the cluster's brokers, unless in
+// read-only or dry run mode), sends opts.ProbesPerPartition probes to every partition, waits up to the probe timeout
+// for them to be consumed and grades every broker against the thresholds in opts.
+func RunCheck(ctx context.Context, cfg *config.KMonConfig, opts CheckOptions) (*CheckReport, error) {
+	// Only the probes the check sends are needed
+	checkCfg := *cfg
+	checkCfg.TransactionalProbes = nil
+	cfg = &checkCfg
+
+	checkMetrics := NewMetrics(metrics.NewNopSink())
+	tm, err := NewTopicManagerFromConfig(cfg, checkMetrics)
+	if err != nil {
+		return nil, err
+	}
+	defer tm.admClient.Close()
+
+	partitionBrokers, err := tm.ensureTopic(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := NewMonitorFromConfig(cfg, checkMetrics, partitionBrokers)
+	if err != nil {
+		return nil, err
+	}
+	defer m.producerClient.Close()
+	if m.consumerClient != m.producerClient {
+		defer m.consumerClient.Close()
+	}
+
+	// Only probes sent after the warmup are part of the check
+	var mu sync.Mutex
+	var checkStart time.Time
+	latencies := make(map[int][]int64)
+	m.consumedCallback = func(partition int, sentAt time.Time, e2eLatency time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkStart.IsZero() && !sentAt.Before(checkStart) {
+			latencies[partition] = append(latencies[partition], e2eLatency.Milliseconds())
+		}
+	}
+
+	consumeCtx, cancelConsume := context.WithCancel(ctx)
+	defer cancelConsume()
+	go m.consumeLoop(consumeCtx)
+	m.warmup(ctx)
+
+	mu.Lock()
+	checkStart = time.Now()
+	mu.Unlock()
+	log.Info().Msgf("Sending %d probes to each of %d partitions", opts.ProbesPerPartition, m.partitions)
+	for range opts.ProbesPerPartition {
+		m.publishProbeBatch(ctx)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(m.sampleFrequency):
+		}
+	}
+
+	expected := opts.ProbesPerPartition * m.partitions
+	deadline := time.After(m.probeTimeout)
+	for received := 0; received < expected; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			received = expected
+		case <-time.After(100 * time.Millisecond):
+			mu.Lock()
+			received = 0
+			for _, l := range latencies {
+				received += len(l)
+			}
+			mu.Unlock()
+		}
+	}
+	cancelConsume()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return m.checkReport(opts, latencies), nil
+}
+
+// checkReport grades every broker on the latencies of the probes consumed from the partitions it leads.
+func (m *Monitor) checkReport(opts CheckOptions, latencies map[int][]int64) *CheckReport {
+	report := &CheckReport{Topic: m.producerTopic, Passed: true}
+	byBroker := make(map[int32]*BrokerCheckResult)
+	brokerLatencies := make(map[int32][]int64)
+	for partition := range m.partitions {
+		broker := anyBroker
+		if !m.isMirror {
+			broker = m.partitionBroker(partition)
+		}
+		result, exists := byBroker[broker]
+		if !exists {
+			result = &BrokerCheckResult{Broker: broker}
+			byBroker[broker] = result
+			report.Brokers = append(report.Brokers, result)
+		}
+		result.Partitions = append(result.Partitions, partition)
+		result.Sent += opts.ProbesPerPartition
+	}
+	for partition, l := range latencies {
+		broker := anyBroker
+		if !m.isMirror {
+			broker = m.partitionBroker(partition)
+		}
+		brokerLatencies[broker] = append(brokerLatencies[broker], l...)
+	}
+
+	slices.SortFunc(report.Brokers, func(a, b *BrokerCheckResult) int { return int(a.Broker - b.Broker) })
+	for _, result := range report.Brokers {
+		l := brokerLatencies[result.Broker]
+		slices.Sort(l)
+		// Probes can be consumed more than once, which mustn't hide lost ones
+		result.Received = min(len(l), result.Sent)
+		result.Passed = true
+		if result.Sent > 0 {
+			result.LossRatio = float64(result.Sent-result.Received) / float64(result.Sent)
+		}
+		if len(l) > 0 {
+			result.P50Ms = nearestRank(l, 0.5)
+			result.P99Ms = nearestRank(l, 0.99)
+			result.MaxMs = l[len(l)-1]
+		}
+
+		if result.LossRatio > opts.LossThreshold {
+			result.Failures = append(result.Failures, fmt.Sprintf("loss ratio %.4f above %.4f", result.LossRatio, opts.LossThreshold))
+		}
+		if result.Received == 0 {
+			result.Failures = append(result.Failures, "no probes received")
+		} else if result.P99Ms > opts.LatencyThresholdMs {
+			result.Failures = append(result.Failures, fmt.Sprintf("p99 latency %dms above %dms", result.P99Ms, opts.LatencyThresholdMs))
+		}
+		if len(result.Failures) > 0 {
+			result.Passed = false
+			report.Passed = false
+		}
+	}
+	return report
+}
+
+// ensureTopic reconciles the monitoring topic if it doesn't match the desired layout and returns the broker leading
+// each partition. In read-only and dry run modes, the topic is never modified: its layout is discovered instead, and
+// the check fails if the topic doesn't exist or, in dry run mode, doesn't match the desired layout.
+func (tm *TopicManager) ensureTopic(ctx context.Context) ([]int32, error) {
+	if tm.readOnly {
+		partitionLeaders, err := tm.getPartitionLeaders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if partitionLeaders == nil {
+			return nil, fmt.Errorf("monitoring topic %s does not exist", tm.topicName)
+		}
+		return partitionLeaders, nil
+	}
+
+	brokerIDs, err := tm.getAllBrokers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan, state, err := tm.plan(ctx, brokerIDs)
+	if err != nil {
+		return nil, err
+	}
+	if tm.dryRun {
+		if !state.exists {
+			return nil, fmt.Errorf("monitoring topic %s does not exist", tm.topicName)
+		}
+		if len(plan.Actions) > 0 {
+			reasons := make([]string, 0, len(plan.Actions))
+			for _, action := range plan.Actions {
+				reasons = append(reasons, fmt.Sprintf("%s (%s)", action.Type, action.Reason))
+			}
+			return nil, fmt.Errorf("monitoring topic %s doesn't match the desired layout, reconciling it requires %s", tm.topicName, strings.Join(reasons, ", "))
+		}
+		return state.partitionBrokers(), nil
+	}
+	if err := tm.executePlan(ctx, plan, state); err != nil {
+		return nil, err
+	}
+	return plan.PartitionBrokers, nil
+}
+
+func (r *BrokerCheckResult) brokerLabel() string {
+	if r.Broker == anyBroker {
+		return "unknown"
+	}
+	return strconv.Itoa(int(r.Broker))
+}
+
+// WriteTable writes the report as a human readable table.
+func (r *CheckReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BROKER\tPARTITIONS\tSENT\tRECEIVED\tLOSS\tP50\tP99\tMAX\tRESULT")
+	for _, b := range r.Brokers {
+		result := "PASS"
+		if !b.Passed {
+			result = "FAIL: " + strings.Join(b.Failures, "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.2f%%\t%dms\t%dms\t%dms\t%s\n", b.brokerLabel(), strings.Trim(fmt.Sprint(b.Partitions), "[]"), b.Sent, b.Received, b.LossRatio*100, b.P50Ms, b.P99Ms, b.MaxMs, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	result := "PASSED"
+	if !r.Passed {
+		result = "FAILED"
+	}
+	_, err := fmt.Fprintf(w, "\nCheck of topic %s %s\n", r.Topic, result)
+	return err
+}
+
+// nearestRank returns the q quantile of the sorted latencies by the nearest-rank method, so that with fewer than 100
+// probes the p99 is the slowest one rather than rounded down to a faster one.
+func nearestRank(sorted []int64, q float64) int64 {
+	return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+}
@@ -0,0 +1,62 @@
+//go:build integration
+
+package kmon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCheckIntegration(t *testing.T) {
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: "kmon-check",
+		ProducerKafkaConfig: &config.KafkaConfig{
+			SeedBrokers: []string{"localhost:10000"},
+		},
+		SampleFrequencyMs: 50,
+	}
+
+	report, err := RunCheck(context.Background(), cfg, CheckOptions{ProbesPerPartition: 5, LatencyThresholdMs: 5000})
+	require.NoError(t, err)
+
+	require.True(t, report.Passed, "%+v", report.Brokers)
+	require.Len(t, report.Brokers, 3)
+	for _, result := range report.Brokers {
+		require.Equal(t, 5, result.Sent)
+		require.Equal(t, 5, result.Received)
+	}
+}
+
+func TestRunCheckNeverModifiesTopicIntegration(t *testing.T) {
+	topic := "kmon-check-unmodified"
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: topic,
+		ProducerKafkaConfig: &config.KafkaConfig{
+			SeedBrokers: []string{"localhost:10000"},
+		},
+	}
+	tm, ctx := setupTopicManager(t, topic)
+	_, _ = tm.admClient.DeleteTopics(ctx, topic)
+	tm.waitUntilTopicNoLongerExists(ctx)
+
+	readOnlyCfg := *cfg
+	readOnlyCfg.ReadOnly = &config.ReadOnlyConfig{}
+	_, err := RunCheck(ctx, &readOnlyCfg, CheckOptions{ProbesPerPartition: 1})
+	require.ErrorContains(t, err, "does not exist")
+
+	// A topic with the wrong layout fails the check rather than being recreated
+	_, err = tm.admClient.CreateTopics(ctx, 1, 1, nil, topic)
+	require.NoError(t, err)
+	tm.waitUntilTopicExists(ctx)
+	dryRunCfg := *cfg
+	dryRunCfg.DryRun = true
+	_, err = RunCheck(ctx, &dryRunCfg, CheckOptions{ProbesPerPartition: 1})
+	require.ErrorContains(t, err, "doesn't match the desired layout")
+
+	numPartitions, err := tm.getTopicNumPartitions(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, numPartitions)
+}
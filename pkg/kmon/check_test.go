@@ -0,0 +1,37 @@
+package kmon
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReport(t *testing.T) {
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "kmon", &MockKgoClient{}, "test-uuid", 3, time.Duration(1), 5*time.Minute, false)
+	m.partitionBrokers = []int32{1, 2, 3}
+	opts := CheckOptions{ProbesPerPartition: 4, LatencyThresholdMs: 100, LossThreshold: 0.3}
+
+	report := m.checkReport(opts, map[int][]int64{
+		0: {10, 20, 30, 40},
+		1: {10, 500, 600},
+	})
+
+	require.False(t, report.Passed)
+	require.Len(t, report.Brokers, 3)
+
+	require.Equal(t, &BrokerCheckResult{Broker: 1, Partitions: []int{0}, Sent: 4, Received: 4, P50Ms: 20, P99Ms: 40, MaxMs: 40, Passed: true}, report.Brokers[0])
+
+	require.Equal(t, int32(2), report.Brokers[1].Broker)
+	require.Equal(t, 0.25, report.Brokers[1].LossRatio)
+	require.False(t, report.Brokers[1].Passed)
+	require.Equal(t, []string{"p99 latency 600ms above 100ms"}, report.Brokers[1].Failures)
+
+	require.Equal(t, int32(3), report.Brokers[2].Broker)
+	require.Equal(t, []string{"loss ratio 1.0000 above 0.3000", "no probes received"}, report.Brokers[2].Failures)
+
+	var table bytes.Buffer
+	require.NoError(t, report.WriteTable(&table))
+	require.Contains(t, table.String(), "Check of topic kmon FAILED")
+}
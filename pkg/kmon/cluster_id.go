@@ -0,0 +1,139 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// clusterIDClient is a client whose cluster ID is verified, against expected if set.
+type clusterIDClient struct {
+	cluster  string
+	role     clients.Role
+	expected string
+	client   kmsg.Requestor
+}
+
+// clusterIDGuard verifies that kmon's clients are connected to the clusters they are configured for, as seed broker
+// hostnames get reused across environments. The cluster ID of every client is exported, and once any client is
+// connected to a cluster other than the expected one, mismatched reports true so that probing and topic
+// reconciliation stop until it is connected to the expected cluster again.
+type clusterIDGuard struct {
+	metrics  *Metrics
+	interval time.Duration
+	clients  func() []clusterIDClient
+
+	mu sync.Mutex
+	// Keyed by cluster and role
+	discovered map[string]string
+	mismatches map[string]bool
+}
+
+func newClusterIDGuard(cfg *config.KMonConfig, metrics *Metrics, clients func() []clusterIDClient) *clusterIDGuard {
+	return &clusterIDGuard{
+		metrics:    metrics,
+		interval:   time.Duration(cfg.GetClusterIDCheckIntervalSeconds()) * time.Second,
+		clients:    clients,
+		discovered: make(map[string]string),
+		mismatches: make(map[string]bool),
+	}
+}
+
+func (g *clusterIDGuard) Start(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, c := range g.clients() {
+				if err := g.verify(ctx, c); err != nil {
+					log.Warn().Err(err).Msgf("failed to verify the cluster ID of the %s cluster's %s client", c.cluster, c.role)
+				}
+			}
+		}
+	}
+}
+
+// mismatched returns whether any client was connected to an unexpected cluster when last verified. A nil guard never
+// reports a mismatch.
+func (g *clusterIDGuard) mismatched() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, mismatch := range g.mismatches {
+		if mismatch {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterID returns the ID of the cluster the client of the given cluster and role was connected to when last
+// verified, or "" if it never was. A nil guard knows no cluster ID.
+func (g *clusterIDGuard) clusterID(cluster string, role clients.Role) string {
+	if g == nil {
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.discovered[cluster+"/"+string(role)]
+}
+
+// verify looks up the ID of the cluster c is connected to. Errors looking it up leave the previous result in place.
+func (g *clusterIDGuard) verify(ctx context.Context, c clusterIDClient) error {
+	if g == nil {
+		return nil
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req := kmsg.NewPtrMetadataRequest()
+	req.Topics = []kmsg.MetadataRequestTopic{}
+	resp, err := req.RequestWith(timeoutCtx, c.client)
+	if err != nil {
+		return err
+	}
+	if resp.ClusterID == nil {
+		return fmt.Errorf("brokers of the %s cluster don't report a cluster ID", c.cluster)
+	}
+	clusterID := *resp.ClusterID
+	mismatch := c.expected != "" && clusterID != c.expected
+
+	key := c.cluster + "/" + string(c.role)
+	g.mu.Lock()
+	previousID, discovered := g.discovered[key]
+	previousMismatch := g.mismatches[key]
+	g.discovered[key] = clusterID
+	g.mismatches[key] = mismatch
+	g.mu.Unlock()
+
+	if discovered && previousID != clusterID {
+		g.metrics.ClusterIDInfo.WithLabelValues(c.cluster, string(c.role), previousID).Set(0)
+		log.Warn().Msgf("The %s cluster's %s client moved from cluster %s to cluster %s", c.cluster, c.role, previousID, clusterID)
+	}
+	g.metrics.ClusterIDInfo.WithLabelValues(c.cluster, string(c.role), clusterID).Set(1)
+
+	mismatchValue := 0.0
+	if mismatch {
+		mismatchValue = 1
+	}
+	g.metrics.ClusterIDMismatch.WithLabelValues(c.cluster, string(c.role)).Set(mismatchValue)
+	switch {
+	case mismatch && !previousMismatch:
+		log.Error().Msgf("The %s cluster's %s client is connected to cluster %s instead of %s, stopping probes", c.cluster, c.role, clusterID, c.expected)
+	case !mismatch && previousMismatch:
+		log.Info().Msgf("The %s cluster's %s client is connected to cluster %s again", c.cluster, c.role, clusterID)
+	}
+	return nil
+}
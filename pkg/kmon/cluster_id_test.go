@@ -0,0 +1,70 @@
+package kmon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// clusterIDRequestor answers metadata requests with clusterID.
+type clusterIDRequestor struct {
+	clusterID *string
+}
+
+func (r *clusterIDRequestor) Request(_ context.Context, req kmsg.Request) (kmsg.Response, error) {
+	resp := req.ResponseKind().(*kmsg.MetadataResponse)
+	resp.ClusterID = r.clusterID
+	return resp, nil
+}
+
+func TestClusterIDGuard(t *testing.T) {
+	requestor := &clusterIDRequestor{clusterID: kmsg.StringPtr("prod")}
+	c := clusterIDClient{"producer", clients.RoleProducer, "prod", requestor}
+	g := newClusterIDGuard(&config.KMonConfig{}, newTestMetrics(), func() []clusterIDClient { return []clusterIDClient{c} })
+
+	require.NoError(t, g.verify(context.Background(), c))
+	require.False(t, g.mismatched())
+
+	requestor.clusterID = kmsg.StringPtr("staging")
+	require.NoError(t, g.verify(context.Background(), c))
+	require.True(t, g.mismatched())
+
+	// Failing to look the cluster ID up keeps the last result
+	requestor.clusterID = nil
+	require.Error(t, g.verify(context.Background(), c))
+	require.True(t, g.mismatched())
+
+	requestor.clusterID = kmsg.StringPtr("prod")
+	require.NoError(t, g.verify(context.Background(), c))
+	require.False(t, g.mismatched())
+
+	// Without an expected cluster ID, the cluster ID is only reported
+	c.expected = ""
+	requestor.clusterID = kmsg.StringPtr("staging")
+	require.NoError(t, g.verify(context.Background(), c))
+	require.False(t, g.mismatched())
+
+	var nilGuard *clusterIDGuard
+	require.False(t, nilGuard.mismatched())
+}
+
+func TestMonitorPaused(t *testing.T) {
+	produced := 0
+	producer := &MockKgoClient{ProduceFunc: func(context.Context, *kgo.Record, func(*kgo.Record, error)) { produced++ }}
+	m := NewMonitorWithClients(newTestMetrics(), producer, "kmon", &MockKgoClient{}, "test-uuid", 2, time.Second, time.Minute, false)
+	paused := true
+	m.paused = func() bool { return paused }
+
+	m.publishProbeBatch(context.Background())
+	require.Equal(t, 0, produced)
+
+	paused = false
+	m.publishProbeBatch(context.Background())
+	require.Equal(t, 2, produced)
+}
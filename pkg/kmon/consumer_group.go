@@ -0,0 +1,117 @@
+package kmon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// consumerGroupTracker measures the group coordinator's behavior when the Monitor consumes as part of a consumer
+// group: how long it takes to join the group, how long rebalances last and how offset commits perform.
+//
+// The eager range balancer is used so that every rebalance starts by revoking all partitions and ends by assigning
+// them again, which gives each rebalance a well-defined start and end.
+type consumerGroupTracker struct {
+	metrics        *Metrics
+	groupID        string
+	commitInterval time.Duration
+
+	mu             sync.Mutex
+	createdAt      time.Time
+	joined         bool
+	rebalanceStart time.Time
+	// Called whenever partitions are assigned, as consumption then resumes from the last committed offsets
+	assignedCallback func()
+}
+
+func newConsumerGroupTracker(metrics *Metrics, cfg *config.ConsumerGroupConfig) *consumerGroupTracker {
+	return &consumerGroupTracker{
+		metrics:        metrics,
+		groupID:        cfg.GroupID,
+		commitInterval: time.Duration(cfg.GetCommitIntervalMs()) * time.Millisecond,
+		createdAt:      time.Now(),
+	}
+}
+
+func (t *consumerGroupTracker) opts() []kgo.Opt {
+	return []kgo.Opt{
+		kgo.ConsumerGroup(t.groupID),
+		kgo.Balancers(kgo.RangeBalancer()),
+		kgo.DisableAutoCommit(),
+		kgo.OnPartitionsAssigned(t.onAssigned),
+		kgo.OnPartitionsRevoked(t.onRevoked),
+		kgo.OnPartitionsLost(t.onRevoked),
+	}
+}
+
+func (t *consumerGroupTracker) onAssigned(_ context.Context, _ *kgo.Client, _ map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.assignedCallback != nil {
+		t.assignedCallback()
+	}
+
+	now := time.Now()
+	if !t.joined {
+		t.joined = true
+		t.metrics.ConsumerGroupJoinLatency.WithLabelValues(t.groupID).Observe(float64(now.Sub(t.createdAt).Milliseconds()))
+		log.Info().Msgf("Joined consumer group %s in %s", t.groupID, now.Sub(t.createdAt))
+		return
+	}
+	if !t.rebalanceStart.IsZero() {
+		t.metrics.ConsumerGroupRebalanceDuration.WithLabelValues(t.groupID).Observe(float64(now.Sub(t.rebalanceStart).Milliseconds()))
+		t.rebalanceStart = time.Time{}
+	}
+}
+
+func (t *consumerGroupTracker) onRevoked(_ context.Context, _ *kgo.Client, _ map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.joined && t.rebalanceStart.IsZero() {
+		t.rebalanceStart = time.Now()
+		t.metrics.ConsumerGroupRebalanceCount.WithLabelValues(t.groupID).Inc()
+	}
+}
+
+// setAssignedCallback sets the function called whenever partitions are assigned. The client may join the group as
+// soon as it is created, so the callback is guarded like the rest of the tracker's state.
+func (t *consumerGroupTracker) setAssignedCallback(callback func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.assignedCallback = callback
+}
+
+// commitLoop periodically commits whatever has been consumed so far.
+func (t *consumerGroupTracker) commitLoop(ctx context.Context, client clients.KgoClient) {
+	ticker := time.NewTicker(t.commitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.commit(ctx, client)
+		}
+	}
+}
+
+func (t *consumerGroupTracker) commit(ctx context.Context, client clients.KgoClient) {
+	start := time.Now()
+	err := client.CommitUncommittedOffsets(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn().Err(err).Msgf("failed to commit offsets for consumer group %s", t.groupID)
+			t.metrics.ConsumerGroupCommitFailureCount.WithLabelValues(t.groupID).Inc()
+		}
+		return
+	}
+	t.metrics.ConsumerGroupCommitLatency.WithLabelValues(t.groupID).Observe(float64(time.Since(start).Milliseconds()))
+}
@@ -0,0 +1,45 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumerGroupTracker(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	tracker := newConsumerGroupTracker(metrics, &config.ConsumerGroupConfig{GroupID: "kmon-test"})
+	ctx := context.Background()
+
+	// Revocations before the group is first joined (e.g. while leaving) aren't rebalances
+	tracker.onRevoked(ctx, nil, nil)
+	tracker.onAssigned(ctx, nil, nil)
+	require.True(t, tracker.joined)
+	require.Equal(t, map[string]float64{"kmon-test": 1}, metricSamples(t, registry, "kmon_consumer_group_join_latency_ms"))
+	require.Empty(t, metricSamples(t, registry, "kmon_consumer_group_rebalance_count"))
+
+	// Revoked and lost partitions during the same rebalance only count once
+	tracker.onRevoked(ctx, nil, nil)
+	tracker.onRevoked(ctx, nil, nil)
+	tracker.onAssigned(ctx, nil, nil)
+	require.Equal(t, map[string]float64{"kmon-test": 1}, metricSamples(t, registry, "kmon_consumer_group_rebalance_count"))
+	require.Equal(t, map[string]float64{"kmon-test": 1}, metricSamples(t, registry, "kmon_consumer_group_rebalance_duration_ms"))
+	require.Equal(t, map[string]float64{"kmon-test": 1}, metricSamples(t, registry, "kmon_consumer_group_join_latency_ms"))
+
+	fail := false
+	client := &MockKgoClient{CommitFunc: func(context.Context) error {
+		if fail {
+			return errors.New("not coordinator")
+		}
+		return nil
+	}}
+	tracker.commit(ctx, client)
+	fail = true
+	tracker.commit(ctx, client)
+	tracker.commit(ctx, client)
+	require.Equal(t, map[string]float64{"kmon-test": 1}, metricSamples(t, registry, "kmon_consumer_group_commit_latency_ms"))
+	require.Equal(t, map[string]float64{"kmon-test": 2}, metricSamples(t, registry, "kmon_consumer_group_commit_failure_count"))
+}
@@ -0,0 +1,114 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Internal topics whose partition leaders act as coordinators. A group or transactional ID is coordinated by the
+// leader of the partition it hashes to.
+const (
+	consumerOffsetsTopic  = "__consumer_offsets"
+	transactionStateTopic = "__transaction_state"
+)
+
+// brokerClient sends requests either to the broker the client picks or straight to a given broker, which the canaries
+// need to exercise every broker individually.
+type brokerClient interface {
+	kmsg.Requestor
+	// broker returns a requestor sending requests to the broker only
+	broker(brokerID int32) kmsg.Requestor
+	Close()
+}
+
+// kgoBrokerClient is the brokerClient of a kgo.Client.
+type kgoBrokerClient struct {
+	*kgo.Client
+}
+
+func (c kgoBrokerClient) broker(brokerID int32) kmsg.Requestor {
+	return c.Broker(int(brokerID))
+}
+
+// javaStringHashCode reproduces Java's String.hashCode, which brokers use to map coordinator keys to partitions.
+func javaStringHashCode(s string) int32 {
+	var h int32
+	for _, c := range utf16.Encode([]rune(s)) {
+		h = 31*h + int32(c)
+	}
+	return h
+}
+
+// coordinatorPartition returns the partition of the coordinator topic that the key maps to, as computed by
+// Utils.abs(key.hashCode()) % numPartitions on the broker.
+func coordinatorPartition(key string, numPartitions int) int32 {
+	h := javaStringHashCode(key)
+	if h == -1<<31 {
+		h = 0
+	} else if h < 0 {
+		h = -h
+	}
+	return h % int32(numPartitions)
+}
+
+// coordinatorKeys returns, for every broker leading at least one of the coordinator topic's partitions, a key of the
+// form <prefix>-<n> that is coordinated by that broker. partitionLeaders maps each partition to its leader.
+func coordinatorKeys(prefix string, partitionLeaders map[int32]int32) map[int32]string {
+	keys := make(map[int32]string)
+	remaining := make(map[int32]bool)
+	for _, leader := range partitionLeaders {
+		if leader >= 0 {
+			remaining[leader] = true
+		}
+	}
+
+	// Every partition is hit well before this many attempts unless the coordinator topic is huge
+	for n := 0; len(remaining) > 0 && n < 100*len(partitionLeaders); n++ {
+		key := fmt.Sprintf("%s-%d", prefix, n)
+		leader := partitionLeaders[coordinatorPartition(key, len(partitionLeaders))]
+		if remaining[leader] {
+			keys[leader] = key
+			delete(remaining, leader)
+		}
+	}
+	return keys
+}
+
+// getCoordinatorPartitionLeaders returns the leader of every partition of the internal coordinator topic. The topic
+// only exists once the first group or transaction has been coordinated.
+func getCoordinatorPartitionLeaders(ctx context.Context, client kmsg.Requestor, topic string) (map[int32]int32, error) {
+	req := kmsg.NewPtrMetadataRequest()
+	req.AllowAutoTopicCreation = false
+	metadataTopic := kmsg.NewMetadataRequestTopic()
+	metadataTopic.Topic = kmsg.StringPtr(topic)
+	req.Topics = append(req.Topics, metadataTopic)
+	resp, err := req.RequestWith(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range resp.Topics {
+		if t.Topic == nil || *t.Topic != topic {
+			continue
+		}
+		err := kerr.ErrorForCode(t.ErrorCode)
+		if errors.Is(err, kerr.UnknownTopicOrPartition) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		leaders := make(map[int32]int32)
+		for _, p := range t.Partitions {
+			leaders[p.Partition] = p.Leader
+		}
+		return leaders, nil
+	}
+	return nil, fmt.Errorf("coordinator topic %s does not exist yet", topic)
+}
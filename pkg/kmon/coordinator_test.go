@@ -0,0 +1,95 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// mockBrokerClient is a MockKgoClient that also serves requests, sent to any broker through RequestFunc and to a
+// given broker through the requestor BrokerFunc returns.
+type mockBrokerClient struct {
+	MockKgoClient
+	RequestFunc func(context.Context, kmsg.Request) (kmsg.Response, error)
+	BrokerFunc  func(brokerID int32) kmsg.Requestor
+}
+
+func (m *mockBrokerClient) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	if m.RequestFunc != nil {
+		return m.RequestFunc(ctx, req)
+	}
+	return nil, fmt.Errorf("unexpected %s request", kmsg.NameForKey(req.Key()))
+}
+
+func (m *mockBrokerClient) broker(brokerID int32) kmsg.Requestor {
+	if m.BrokerFunc != nil {
+		return m.BrokerFunc(brokerID)
+	}
+	return m
+}
+
+// requestorFunc is a kmsg.Requestor serving requests with a function.
+type requestorFunc func(context.Context, kmsg.Request) (kmsg.Response, error)
+
+func (f requestorFunc) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	return f(ctx, req)
+}
+
+func TestJavaStringHashCode(t *testing.T) {
+	require.Equal(t, int32(0), javaStringHashCode(""))
+	require.Equal(t, int32(99162322), javaStringHashCode("hello"))
+	require.Equal(t, javaStringHashCode("Aa"), javaStringHashCode("BB"))
+	require.Equal(t, int32(-1<<31), javaStringHashCode("polygenelubricants"))
+}
+
+func TestCoordinatorPartition(t *testing.T) {
+	require.Equal(t, int32(99162322%50), coordinatorPartition("hello", 50))
+	// Utils.abs maps Integer.MIN_VALUE to 0
+	require.Equal(t, int32(0), coordinatorPartition("polygenelubricants", 50))
+	for _, key := range []string{"kmon-0", "kmon-1", "kmon-txn-group", "ünicode"} {
+		p := coordinatorPartition(key, 50)
+		require.GreaterOrEqual(t, p, int32(0))
+		require.Less(t, p, int32(50))
+	}
+}
+
+func TestCoordinatorKeys(t *testing.T) {
+	leaders := make(map[int32]int32)
+	for p := range int32(50) {
+		leaders[p] = p%3 + 1
+	}
+	// A partition without a leader doesn't get a key
+	leaders[49] = -1
+
+	keys := coordinatorKeys("kmon", leaders)
+	require.Len(t, keys, 3)
+	for broker, key := range keys {
+		require.Equal(t, broker, leaders[coordinatorPartition(key, len(leaders))])
+	}
+}
+
+func TestTxnProberCommitToVisible(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	prober := &txnProber{
+		metrics:   metrics,
+		keyPrefix: "kmon-txn/test-uuid/",
+		commits:   make(map[string]time.Time),
+	}
+	commitStart := time.Now()
+	prober.commits["2/1"] = commitStart
+
+	prober.handleConsumedRecord(&kgo.Record{Key: []byte("kmon-txn/test-uuid/2/1"), Partition: 0}, commitStart.Add(5*time.Millisecond))
+	prober.handleConsumedRecord(&kgo.Record{Key: []byte("kmon-txn/test-uuid/2/1"), Partition: 1}, commitStart.Add(5*time.Millisecond))
+	// Probes of other instances and unknown (e.g. aborted) transactions are ignored
+	prober.handleConsumedRecord(&kgo.Record{Key: []byte("kmon-txn/other-uuid/2/1"), Partition: 0}, commitStart)
+	prober.handleConsumedRecord(&kgo.Record{Key: []byte("kmon-txn/test-uuid/2/2"), Partition: 0}, commitStart)
+	require.Equal(t, map[string]float64{"2,0": 1, "2,1": 1}, metricSamples(t, registry, "kmon_txn_commit_to_visible_latency_ms"))
+
+	prober.expireCommits(commitStart.Add(time.Second))
+	require.Empty(t, prober.commits)
+}
@@ -0,0 +1,245 @@
+package kmon
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/datastructs/pkg/stats"
+	"github.com/pliu/kmon/pkg/config"
+)
+
+const (
+	dashboardResolution = 30 * time.Second
+	dashboardSpan       = time.Hour
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboard serves a page summarizing what kmon measures, for when Grafana isn't at hand. Everything it shows comes
+// from the current Monitor's windows, except for the latency series of every broker, which are sampled from them every
+// dashboardResolution and kept for dashboardSpan across Monitor swaps.
+type dashboard struct {
+	instance    string
+	topic       string
+	monitor     func() *Monitor
+	topicStatus func() topicStatus
+
+	mu sync.Mutex
+	// Keyed by broker, oldest point first
+	series map[int32][]dashboardPoint
+}
+
+type dashboardPoint struct {
+	Time time.Time `json:"t"`
+	P50  int64     `json:"p50"`
+	P99  int64     `json:"p99"`
+}
+
+type dashboardQuantiles struct {
+	P50     int64 `json:"p50"`
+	P99     int64 `json:"p99"`
+	Samples int   `json:"samples"`
+}
+
+type dashboardPartition struct {
+	Partition int   `json:"partition"`
+	Broker    int32 `json:"broker"`
+}
+
+type dashboardBroker struct {
+	// -1 for mirrored measurements, which aggregate all partitions
+	Broker     int32 `json:"broker"`
+	Partitions []int `json:"partitions"`
+	// Keyed by latency type, missing for types without samples
+	Latencies       map[string]*dashboardQuantiles `json:"latencies"`
+	ProduceFailures int                            `json:"produceFailures"`
+	LostProbes      int                            `json:"lostProbes"`
+	Series          []dashboardPoint               `json:"series"`
+}
+
+type dashboardData struct {
+	GeneratedAt    time.Time                      `json:"generatedAt"`
+	Instance       string                         `json:"instance"`
+	Topic          string                         `json:"topic"`
+	Reconciliation topicStatus                    `json:"reconciliation"`
+	Partitions     []dashboardPartition           `json:"partitions"`
+	Latencies      map[string]*dashboardQuantiles `json:"latencies"`
+	Brokers        []*dashboardBroker             `json:"brokers"`
+}
+
+func newDashboard(cfg *config.KMonConfig, monitor func() *Monitor, topicStatus func() topicStatus) *dashboard {
+	return &dashboard{
+		instance:    cfg.GetInstanceName(),
+		topic:       cfg.ProducerMonitoringTopic,
+		monitor:     monitor,
+		topicStatus: topicStatus,
+		series:      make(map[int32][]dashboardPoint),
+	}
+}
+
+func (d *dashboard) Start(ctx context.Context) {
+	ticker := time.NewTicker(dashboardResolution)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sample(time.Now())
+		}
+	}
+}
+
+// sample adds the current e2e latency quantiles of every broker to its series.
+func (d *dashboard) sample(now time.Time) {
+	m := d.monitor()
+	if m == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for broker, partitions := range m.brokerPartitions() {
+		if q := quantiles(m.e2eStats, partitions); q != nil {
+			d.series[broker] = append(d.series[broker], dashboardPoint{Time: now, P50: q.P50, P99: q.P99})
+		}
+	}
+	for broker, points := range d.series {
+		expired := 0
+		for expired < len(points) && now.Sub(points[expired].Time) > dashboardSpan {
+			expired++
+		}
+		if expired == len(points) {
+			delete(d.series, broker)
+		} else {
+			d.series[broker] = slices.Delete(points, 0, expired)
+		}
+	}
+}
+
+func (d *dashboard) data(now time.Time) *dashboardData {
+	data := &dashboardData{
+		GeneratedAt:    now,
+		Instance:       d.instance,
+		Topic:          d.topic,
+		Reconciliation: d.topicStatus(),
+		Partitions:     []dashboardPartition{},
+		Latencies:      make(map[string]*dashboardQuantiles),
+		Brokers:        []*dashboardBroker{},
+	}
+	brokers := make(map[int32]*dashboardBroker)
+	getBroker := func(broker int32) *dashboardBroker {
+		if _, ok := brokers[broker]; !ok {
+			brokers[broker] = &dashboardBroker{
+				Broker:     broker,
+				Partitions: []int{},
+				Latencies:  make(map[string]*dashboardQuantiles),
+				Series:     []dashboardPoint{},
+			}
+		}
+		return brokers[broker]
+	}
+
+	if m := d.monitor(); m != nil {
+		for partition, broker := range m.getPartitionBrokers() {
+			data.Partitions = append(data.Partitions, dashboardPartition{Partition: partition, Broker: broker})
+		}
+		var all []int
+		for broker, partitions := range m.brokerPartitions() {
+			b := getBroker(broker)
+			b.Partitions = partitions
+			for latencyType, windows := range m.latencyWindows() {
+				if q := quantiles(windows, partitions); q != nil {
+					b.Latencies[latencyType] = q
+				}
+			}
+			for _, partition := range partitions {
+				b.ProduceFailures += m.produceFailureStats[partition].Len()
+				b.LostProbes += m.lostStats[partition].Len()
+			}
+			all = append(all, partitions...)
+		}
+		for latencyType, windows := range m.latencyWindows() {
+			if q := quantiles(windows, all); q != nil {
+				data.Latencies[latencyType] = q
+			}
+		}
+	}
+
+	d.mu.Lock()
+	for broker, points := range d.series {
+		getBroker(broker).Series = slices.Clone(points)
+	}
+	d.mu.Unlock()
+
+	for _, b := range brokers {
+		data.Brokers = append(data.Brokers, b)
+	}
+	slices.SortFunc(data.Brokers, func(a, b *dashboardBroker) int {
+		return int(a.Broker) - int(b.Broker)
+	})
+	return data
+}
+
+// ServeHTTP serves the page on / and the data it shows as JSON on /api.
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/", "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(dashboardHTML); err != nil {
+			log.Error().Err(err).Msg("failed to write dashboard")
+		}
+	case "/api":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d.data(time.Now())); err != nil {
+			log.Error().Err(err).Msg("failed to write dashboard data")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// brokerPartitions returns the partitions of the Monitor's measurements led by every broker, in order.
+func (m *Monitor) brokerPartitions() map[int32][]int {
+	partitions := make(map[int32][]int)
+	for partition := range m.pending {
+		broker := m.partitionBroker(partition)
+		partitions[broker] = append(partitions[broker], partition)
+	}
+	for _, p := range partitions {
+		slices.Sort(p)
+	}
+	return partitions
+}
+
+// latencyWindows returns the latency windows of the Monitor, by latency type.
+func (m *Monitor) latencyWindows() map[string]map[int]*stats.Stats {
+	return map[string]map[int]*stats.Stats{
+		config.LatencyTypeE2E: m.e2eStats,
+		config.LatencyTypeP2B: m.p2bStats,
+		config.LatencyTypeB2C: m.b2cStats,
+		config.LatencyTypeAck: m.producerAckStats,
+	}
+}
+
+// quantiles returns the p50 and p99 of the samples of the given partitions' windows, or nil if there are none.
+func quantiles(windows map[int]*stats.Stats, partitions []int) *dashboardQuantiles {
+	// The samples already are within their windows
+	merged := stats.NewStats(time.Duration(math.MaxInt64))
+	for _, partition := range partitions {
+		merged.Merge(windows[partition])
+	}
+	res, ok := merged.Percentile([]float64{50, 99})
+	if !ok {
+		return nil
+	}
+	return &dashboardQuantiles{P50: res[0], P99: res[1], Samples: merged.Len()}
+}
@@ -0,0 +1,96 @@
+package kmon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", 3, time.Duration(1), time.Minute, false)
+	m.partitionBrokers = []int32{1, 2, 1}
+	for _, latencyMs := range []int64{10, 20, 30} {
+		m.addLatency(m.e2eStats[0], config.LatencyTypeE2E, 0, latencyMs, false)
+	}
+	m.addLatency(m.e2eStats[2], config.LatencyTypeE2E, 2, 100, false)
+	m.addLatency(m.producerAckStats[1], config.LatencyTypeAck, 1, 5, false)
+	m.addSample(m.lostStats[2], 1)
+
+	var monitor *Monitor
+	status := topicStatus{LastError: "boom"}
+	d := newDashboard(&config.KMonConfig{ProducerMonitoringTopic: "kmon", InstanceName: "kmon-a"},
+		func() *Monitor { return monitor }, func() topicStatus { return status })
+
+	// Nothing is sampled before the first Monitor starts
+	now := time.Now()
+	d.sample(now.Add(-2 * time.Hour))
+	require.Empty(t, d.data(now).Brokers)
+
+	monitor = m
+	d.sample(now.Add(-2 * time.Hour))
+	d.sample(now)
+	data := d.data(now)
+	require.Equal(t, "kmon-a", data.Instance)
+	require.Equal(t, "boom", data.Reconciliation.LastError)
+	require.Equal(t, []dashboardPartition{{0, 1}, {1, 2}, {2, 1}}, data.Partitions)
+	require.Equal(t, &dashboardQuantiles{P50: 20, P99: 30, Samples: 4}, data.Latencies[config.LatencyTypeE2E])
+
+	require.Len(t, data.Brokers, 2)
+	broker1 := data.Brokers[0]
+	require.Equal(t, int32(1), broker1.Broker)
+	require.Equal(t, []int{0, 2}, broker1.Partitions)
+	require.Equal(t, &dashboardQuantiles{P50: 20, P99: 30, Samples: 4}, broker1.Latencies[config.LatencyTypeE2E])
+	require.Equal(t, 1, broker1.LostProbes)
+	// Points older than an hour are dropped
+	require.Len(t, broker1.Series, 1)
+	require.Equal(t, int64(30), broker1.Series[0].P99)
+
+	// Brokers without e2e samples have no series yet
+	broker2 := data.Brokers[1]
+	require.Equal(t, &dashboardQuantiles{P50: 5, P99: 5, Samples: 1}, broker2.Latencies[config.LatencyTypeAck])
+	require.Nil(t, broker2.Latencies[config.LatencyTypeE2E])
+	require.Empty(t, broker2.Series)
+}
+
+func TestDashboardHandler(t *testing.T) {
+	d := newDashboard(&config.KMonConfig{ProducerMonitoringTopic: "kmon"}, func() *Monitor { return nil }, func() topicStatus { return topicStatus{} })
+	handler := http.StripPrefix("/dashboard", d)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	// The page works without network access, the SVG namespace being only an identifier
+	page := strings.ReplaceAll(w.Body.String(), "http://www.w3.org/2000/svg", "")
+	require.NotContains(t, page, "http")
+	require.NotContains(t, page, "//")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/api", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var data dashboardData
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(t, "kmon", data.Topic)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/missing", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTopicManagerStatus(t *testing.T) {
+	tm := &TopicManager{dryRun: true}
+	tm.updateStatus(func(status *topicStatus) { status.Reconciling = true })
+	status := tm.getStatus()
+	require.Equal(t, "dry_run", status.Mode)
+	require.True(t, status.Reconciling)
+
+	tm.leader = func() bool { return false }
+	require.Equal(t, "follower", tm.getStatus().Mode)
+	tm.readOnly = true
+	require.Equal(t, "read_only", tm.getStatus().Mode)
+}
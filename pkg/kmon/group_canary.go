@@ -0,0 +1,253 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/datastructs/pkg/set"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+const (
+	groupCanaryOpFindCoordinator = "find_coordinator"
+	groupCanaryOpOffsetCommit    = "offset_commit"
+	groupCanaryOpOffsetFetch     = "offset_fetch"
+)
+
+// GroupCanary exercises the group coordinator on every broker. For each broker, it picks a group ID that hashes to a
+// __consumer_offsets partition led by that broker and periodically looks the coordinator up, commits an offset for
+// the group and fetches it back. Commits and fetches are sent straight to the broker expected to coordinate the group,
+// so a single bad __consumer_offsets partition leader shows up under its own broker label.
+type GroupCanary struct {
+	metrics       *Metrics
+	client        brokerClient
+	topic         string
+	groupIDPrefix string
+	interval      time.Duration
+	brokers       func(ctx context.Context) (*set.Set[int32], error)
+	// The canary is skipped while paused returns true, if set
+	paused func() bool
+}
+
+func NewGroupCanaryFromConfig(cfg *config.KMonConfig, metrics *Metrics, brokers func(ctx context.Context) (*set.Set[int32], error)) (*GroupCanary, error) {
+	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleAdmin, metrics.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupCanary{
+		metrics:       metrics,
+		client:        kgoBrokerClient{client},
+		topic:         cfg.ProducerMonitoringTopic,
+		groupIDPrefix: cfg.GroupCanary.GetGroupIDPrefix() + "-" + cfg.ProducerMonitoringTopic,
+		interval:      time.Duration(cfg.GroupCanary.GetIntervalMs()) * time.Millisecond,
+		brokers:       brokers,
+	}, nil
+}
+
+func (c *GroupCanary) close() {
+	c.client.Close()
+}
+
+func (c *GroupCanary) Start(ctx context.Context) {
+	defer c.close()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if c.paused != nil && c.paused() {
+				continue
+			}
+			if err := c.probe(ctx); err != nil {
+				log.Warn().Err(err).Msg("failed to run group coordinator canary")
+			}
+		}
+	}
+}
+
+func (c *GroupCanary) probe(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+
+	brokerIDs, err := c.brokers(timeoutCtx)
+	if err != nil {
+		return err
+	}
+	leaders, err := getCoordinatorPartitionLeaders(timeoutCtx, c.client, consumerOffsetsTopic)
+	if err != nil {
+		return err
+	}
+
+	// Brokers that don't lead any __consumer_offsets partition can't be exercised, which is worth knowing about too
+	coordinatedPartitions := make(map[int32]int)
+	for _, leader := range leaders {
+		coordinatedPartitions[leader]++
+	}
+	for _, brokerID := range brokerIDs.Items() {
+		c.metrics.GroupCanaryCoordinatedPartitions.WithLabelValues(strconv.Itoa(int(brokerID))).Set(float64(coordinatedPartitions[brokerID]))
+	}
+
+	groupIDs := coordinatorKeys(c.groupIDPrefix, leaders)
+	var wg sync.WaitGroup
+	for _, brokerID := range brokerIDs.Items() {
+		groupID, ok := groupIDs[brokerID]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.probeCoordinator(timeoutCtx, brokerID, groupID)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *GroupCanary) probeCoordinator(ctx context.Context, brokerID int32, groupID string) {
+	coordinatorLabel := strconv.Itoa(int(brokerID))
+
+	err := c.timed(coordinatorLabel, groupCanaryOpFindCoordinator, func() error {
+		return c.findCoordinator(ctx, brokerID, groupID)
+	})
+	if err != nil {
+		return
+	}
+
+	offset := time.Now().UnixMilli()
+	err = c.timed(coordinatorLabel, groupCanaryOpOffsetCommit, func() error {
+		return c.commitOffset(ctx, brokerID, groupID, offset)
+	})
+	if err != nil {
+		return
+	}
+
+	_ = c.timed(coordinatorLabel, groupCanaryOpOffsetFetch, func() error {
+		return c.fetchOffset(ctx, brokerID, groupID, offset)
+	})
+}
+
+func (c *GroupCanary) timed(coordinatorLabel string, operation string, f func() error) error {
+	start := time.Now()
+	if err := f(); err != nil {
+		log.Warn().Err(err).Msgf("group coordinator canary %s failed on broker %s", operation, coordinatorLabel)
+		c.metrics.GroupCanaryFailureCount.WithLabelValues(coordinatorLabel, operation).Inc()
+		return err
+	}
+	c.metrics.GroupCanaryLatency.WithLabelValues(coordinatorLabel, operation).Observe(float64(time.Since(start).Milliseconds()))
+	return nil
+}
+
+func (c *GroupCanary) findCoordinator(ctx context.Context, brokerID int32, groupID string) error {
+	req := kmsg.NewFindCoordinatorRequest()
+	req.CoordinatorKey = groupID
+	req.CoordinatorKeys = []string{groupID}
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return err
+	}
+
+	nodeID, errCode := resp.NodeID, resp.ErrorCode
+	if len(resp.Coordinators) > 0 {
+		nodeID, errCode = resp.Coordinators[0].NodeID, resp.Coordinators[0].ErrorCode
+	}
+	if err := kerr.ErrorForCode(errCode); err != nil {
+		return err
+	}
+	if nodeID != brokerID {
+		return fmt.Errorf("group %s is coordinated by broker %d instead of %d", groupID, nodeID, brokerID)
+	}
+	return nil
+}
+
+// commitOffset commits as a simple consumer (no generation or member), which the coordinator accepts for empty groups.
+func (c *GroupCanary) commitOffset(ctx context.Context, brokerID int32, groupID string, offset int64) error {
+	req := kmsg.NewOffsetCommitRequest()
+	req.Group = groupID
+	req.Generation = -1
+	topic := kmsg.NewOffsetCommitRequestTopic()
+	topic.Topic = c.topic
+	partition := kmsg.NewOffsetCommitRequestTopicPartition()
+	partition.Partition = 0
+	partition.Offset = offset
+	topic.Partitions = append(topic.Partitions, partition)
+	req.Topics = append(req.Topics, topic)
+
+	resp, err := req.RequestWith(ctx, c.client.broker(brokerID))
+	if err != nil {
+		return err
+	}
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *GroupCanary) fetchOffset(ctx context.Context, brokerID int32, groupID string, expectedOffset int64) error {
+	req := kmsg.NewOffsetFetchRequest()
+	// Versions 8+ batch groups, older versions take a single group
+	req.Group = groupID
+	topic := kmsg.NewOffsetFetchRequestTopic()
+	topic.Topic = c.topic
+	topic.Partitions = []int32{0}
+	req.Topics = append(req.Topics, topic)
+	group := kmsg.NewOffsetFetchRequestGroup()
+	group.Group = groupID
+	groupTopic := kmsg.NewOffsetFetchRequestGroupTopic()
+	groupTopic.Topic = c.topic
+	groupTopic.Partitions = []int32{0}
+	group.Topics = append(group.Topics, groupTopic)
+	req.Groups = append(req.Groups, group)
+
+	resp, err := req.RequestWith(ctx, c.client.broker(brokerID))
+	if err != nil {
+		return err
+	}
+
+	// The first error wins, as Kafka error codes can be negative (e.g. UNKNOWN_SERVER_ERROR)
+	offset := int64(-1)
+	errCode := resp.ErrorCode
+	keepError := func(code int16) {
+		if errCode == 0 {
+			errCode = code
+		}
+	}
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			offset = p.Offset
+			keepError(p.ErrorCode)
+		}
+	}
+	for _, g := range resp.Groups {
+		keepError(g.ErrorCode)
+		for _, t := range g.Topics {
+			for _, p := range t.Partitions {
+				offset = p.Offset
+				keepError(p.ErrorCode)
+			}
+		}
+	}
+	if err := kerr.ErrorForCode(errCode); err != nil {
+		return err
+	}
+	if offset != expectedOffset {
+		return fmt.Errorf("fetched offset %d for group %s instead of the committed %d", offset, groupID, expectedOffset)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pliu/datastructs/pkg/set"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestGroupCanaryTimed(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	c := &GroupCanary{metrics: metrics}
+
+	require.NoError(t, c.timed("1", groupCanaryOpOffsetCommit, func() error { return nil }))
+	require.Error(t, c.timed("2", groupCanaryOpOffsetFetch, func() error { return errors.New("stale offset") }))
+
+	require.Equal(t, map[string]float64{"1,offset_commit": 1}, metricSamples(t, registry, "kmon_group_canary_latency_ms"))
+	require.Equal(t, map[string]float64{"2,offset_fetch": 1}, metricSamples(t, registry, "kmon_group_canary_failure_count"))
+}
+
+// mockGroupCoordinators is a cluster whose __consumer_offsets partitions are led by leaders, indexed by partition,
+// and whose coordinators keep the offsets committed to them.
+type mockGroupCoordinators struct {
+	leaders []int32
+
+	mu        sync.Mutex
+	committed map[string]int64
+	// Groups whose commits and fetches were sent to a broker other than their coordinator
+	misrouted []string
+}
+
+func (m *mockGroupCoordinators) coordinator(group string) int32 {
+	return m.leaders[coordinatorPartition(group, len(m.leaders))]
+}
+
+func (m *mockGroupCoordinators) request(_ context.Context, req kmsg.Request) (kmsg.Response, error) {
+	switch req := req.(type) {
+	case *kmsg.MetadataRequest:
+		resp := kmsg.NewPtrMetadataResponse()
+		topic := kmsg.NewMetadataResponseTopic()
+		topic.Topic = req.Topics[0].Topic
+		for partition, leader := range m.leaders {
+			p := kmsg.NewMetadataResponseTopicPartition()
+			p.Partition, p.Leader = int32(partition), leader
+			topic.Partitions = append(topic.Partitions, p)
+		}
+		resp.Topics = append(resp.Topics, topic)
+		return resp, nil
+	case *kmsg.FindCoordinatorRequest:
+		resp := kmsg.NewPtrFindCoordinatorResponse()
+		coordinator := kmsg.NewFindCoordinatorResponseCoordinator()
+		coordinator.Key, coordinator.NodeID = req.CoordinatorKey, m.coordinator(req.CoordinatorKey)
+		resp.Coordinators = append(resp.Coordinators, coordinator)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("unexpected %s request", kmsg.NameForKey(req.Key()))
+}
+
+func (m *mockGroupCoordinators) broker(brokerID int32) kmsg.Requestor {
+	return requestorFunc(func(_ context.Context, req kmsg.Request) (kmsg.Response, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		switch req := req.(type) {
+		case *kmsg.OffsetCommitRequest:
+			if m.coordinator(req.Group) != brokerID {
+				m.misrouted = append(m.misrouted, req.Group)
+			}
+			m.committed[req.Group] = req.Topics[0].Partitions[0].Offset
+			resp := kmsg.NewPtrOffsetCommitResponse()
+			topic := kmsg.NewOffsetCommitResponseTopic()
+			topic.Partitions = append(topic.Partitions, kmsg.NewOffsetCommitResponseTopicPartition())
+			resp.Topics = append(resp.Topics, topic)
+			return resp, nil
+		case *kmsg.OffsetFetchRequest:
+			if m.coordinator(req.Group) != brokerID {
+				m.misrouted = append(m.misrouted, req.Group)
+			}
+			resp := kmsg.NewPtrOffsetFetchResponse()
+			group := kmsg.NewOffsetFetchResponseGroup()
+			topic := kmsg.NewOffsetFetchResponseGroupTopic()
+			partition := kmsg.NewOffsetFetchResponseGroupTopicPartition()
+			partition.Offset = m.committed[req.Group]
+			topic.Partitions = append(topic.Partitions, partition)
+			group.Topics = append(group.Topics, topic)
+			resp.Groups = append(resp.Groups, group)
+			return resp, nil
+		}
+		return nil, fmt.Errorf("unexpected %s request to broker %d", kmsg.NameForKey(req.Key()), brokerID)
+	})
+}
+
+func TestGroupCanaryProbe(t *testing.T) {
+	cluster := &mockGroupCoordinators{committed: make(map[string]int64)}
+	for partition := range 50 {
+		cluster.leaders = append(cluster.leaders, int32(partition%2+1))
+	}
+	metrics, registry := newTestMetricsWithRegistry()
+	c := &GroupCanary{
+		metrics:       metrics,
+		client:        &mockBrokerClient{RequestFunc: cluster.request, BrokerFunc: cluster.broker},
+		topic:         "kmon",
+		groupIDPrefix: "kmon-canary-kmon",
+		interval:      time.Second,
+		// Broker 3 doesn't lead any __consumer_offsets partition
+		brokers: func(context.Context) (*set.Set[int32], error) {
+			brokerIDs := set.NewSet[int32]()
+			for _, brokerID := range []int32{1, 2, 3} {
+				brokerIDs.Add(brokerID)
+			}
+			return brokerIDs, nil
+		},
+	}
+
+	require.NoError(t, c.probe(context.Background()))
+	// Every broker coordinates its own group, which its offset is committed to and fetched back from
+	coordinators := []int32{}
+	for group := range cluster.committed {
+		coordinators = append(coordinators, cluster.coordinator(group))
+	}
+	require.ElementsMatch(t, []int32{1, 2}, coordinators)
+	require.Empty(t, cluster.misrouted)
+	require.Equal(t, map[string]float64{"1": 25, "2": 25, "3": 0}, metricSamples(t, registry, "kmon_group_canary_coordinated_partitions"))
+	require.Equal(t, map[string]float64{
+		"1,find_coordinator": 1, "1,offset_commit": 1, "1,offset_fetch": 1,
+		"2,find_coordinator": 1, "2,offset_commit": 1, "2,offset_fetch": 1,
+	}, metricSamples(t, registry, "kmon_group_canary_latency_ms"))
+	require.Empty(t, metricSamples(t, registry, "kmon_group_canary_failure_count"))
+}
+
+func TestGroupCanaryProbeCoordinatorFailures(t *testing.T) {
+	cluster := &mockGroupCoordinators{leaders: []int32{1, 2}, committed: make(map[string]int64)}
+	metrics, registry := newTestMetricsWithRegistry()
+	c := &GroupCanary{
+		metrics: metrics,
+		client:  &mockBrokerClient{RequestFunc: cluster.request, BrokerFunc: cluster.broker},
+		topic:   "kmon",
+	}
+	groups := coordinatorKeys("kmon-canary-kmon", map[int32]int32{0: 1, 1: 2})
+
+	// A group that isn't coordinated by the expected broker is neither committed nor fetched
+	c.probeCoordinator(context.Background(), 1, groups[2])
+	require.Empty(t, cluster.committed)
+
+	// A fetched offset other than the committed one fails the fetch
+	c.client = &mockBrokerClient{RequestFunc: cluster.request, BrokerFunc: func(brokerID int32) kmsg.Requestor {
+		return requestorFunc(func(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+			if req, ok := req.(*kmsg.OffsetFetchRequest); ok {
+				cluster.committed[req.Group]--
+			}
+			return cluster.broker(brokerID).Request(ctx, req)
+		})
+	}}
+	c.probeCoordinator(context.Background(), 1, groups[1])
+
+	require.Equal(t, map[string]float64{"1,find_coordinator": 1, "1,offset_commit": 1}, metricSamples(t, registry, "kmon_group_canary_latency_ms"))
+	require.Equal(t, map[string]float64{"1,find_coordinator": 1, "1,offset_fetch": 1}, metricSamples(t, registry, "kmon_group_canary_failure_count"))
+}
+
+func TestGroupCanaryFetchOffsetNegativeErrorCode(t *testing.T) {
+	c := &GroupCanary{topic: "kmon"}
+	c.client = &mockBrokerClient{BrokerFunc: func(int32) kmsg.Requestor {
+		return requestorFunc(func(context.Context, kmsg.Request) (kmsg.Response, error) {
+			resp := kmsg.NewPtrOffsetFetchResponse()
+			group := kmsg.NewOffsetFetchResponseGroup()
+			topic := kmsg.NewOffsetFetchResponseGroupTopic()
+			partition := kmsg.NewOffsetFetchResponseGroupTopicPartition()
+			partition.Offset, partition.ErrorCode = 42, kerr.UnknownServerError.Code
+			topic.Partitions = append(topic.Partitions, partition)
+			group.Topics = append(group.Topics, topic)
+			resp.Groups = append(resp.Groups, group)
+			return resp, nil
+		})
+	}}
+
+	// UNKNOWN_SERVER_ERROR is -1, which must not be masked by the group's 0
+	require.ErrorIs(t, c.fetchOffset(context.Background(), 1, "kmon-canary-kmon-0", 42), kerr.UnknownServerError)
+}
@@ -0,0 +1,25 @@
+package kmon
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// instanceEpoch identifies this run of kmon. It is taken once per process, so that the probes of an instance can be
+// told apart from those of its previous runs, while they survive Monitor restarts within the run.
+var instanceEpoch = time.Now().UnixMilli()
+
+// monitorGeneration counts the Monitors created during this run.
+var monitorGeneration atomic.Int64
+
+// instanceRunPrefix returns the prefix of the key of every probe produced by the named instance during this run.
+func instanceRunPrefix(name string) string {
+	return fmt.Sprintf("%s/%d/", name, instanceEpoch)
+}
+
+// nextInstanceID returns the key of the probes of a new Monitor of the named instance, formatted as
+// "<name>/<epoch>/<generation>".
+func nextInstanceID(name string) string {
+	return fmt.Sprintf("%s%d", instanceRunPrefix(name), monitorGeneration.Add(1))
+}
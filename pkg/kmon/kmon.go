@@ -2,52 +2,332 @@ package kmon
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
 	"github.com/pliu/kmon/pkg/config"
+	"github.com/pliu/kmon/pkg/metrics"
+	"github.com/twmb/franz-go/pkg/kmsg"
 )
 
+// Collector is a background probe that runs for the lifetime of KMon, independently of Monitor swaps.
+type Collector interface {
+	Start(ctx context.Context)
+}
+
+// closer is implemented by collectors that create their clients up front. The clients are closed when Start returns,
+// or by close if KMon fails to be created and the collector is never started.
+type closer interface {
+	close()
+}
+
+// KMon ties the TopicManager to the Monitor: every time the TopicManager detects a change, the current Monitor is
+// stopped, and once the topic has been reconciled a new Monitor is started against it. The callbacks run on the
+// TopicManager's goroutine while the current Monitor may be read from anywhere, so mu guards the swap.
 type KMon struct {
+	topicManager   *TopicManager
+	alertEvaluator *AlertEvaluator
+	collectors     []Collector
+	cfg            *config.KMonConfig
+	rootCtx        context.Context
+	newMonitor     func(partitionBrokers []int32) (*Monitor, error)
+	preflighter    *preflighter
+	clusterIDGuard *clusterIDGuard
+	leaderElector  *leaderElector
+	// Restores the windows of every new Monitor, if stats snapshots are enabled
+	statsSnapshotter *statsSnapshotter
+	// Handed to every new Monitor, so that the SLO windows span Monitor swaps
+	slos             *sloTracker
+	probeHistory     *probeHistory
+	resultsPublisher *resultsPublisher
+	dashboard        *dashboard
+
+	mu                sync.Mutex
 	monitor           *Monitor
-	topicManager      *TopicManager
-	cfg               *config.KMonConfig
-	rootCtx           context.Context
 	monitorCancelFunc context.CancelFunc
 }
 
-func NewKMonFromConfig(cfg *config.KMonConfig, ctx context.Context) (*KMon, error) {
-	topicManager, err := NewTopicManagerFromConfig(cfg)
+func NewKMonFromConfig(cfg *config.KMonConfig, sink metrics.Sink, ctx context.Context) (*KMon, error) {
+	if cfg.ReadOnly != nil && (cfg.AdminCanary != nil || cfg.DryRun || cfg.HighAvailability != nil) {
+		return nil, errors.New("adminCanary, dryRun and highAvailability can't be used in read-only mode")
+	}
+	for _, slo := range cfg.SLOs {
+		if target := slo.GetTarget(); target <= 0 || target >= 1 {
+			return nil, fmt.Errorf("SLO %s has target %g, which must be strictly between 0 and 1", slo.Name, target)
+		}
+	}
+
+	kmonMetrics := NewMetrics(sink)
+	kmonMetrics.InstanceInfo.WithLabelValues(cfg.GetInstanceName(), strconv.FormatInt(instanceEpoch, 10)).Set(1)
+	topicManager, err := NewTopicManagerFromConfig(cfg, kmonMetrics)
 	if err != nil {
 		return nil, err
 	}
 
-	return &KMon{
+	if cfg.ReadOnly != nil {
+		partitionLeaders, err := topicManager.getPartitionLeaders(ctx)
+		if err != nil {
+			topicManager.admClient.Close()
+			return nil, err
+		}
+		if partitionLeaders == nil {
+			topicManager.admClient.Close()
+			return nil, fmt.Errorf("monitoring topic %s does not exist, and read-only mode never creates it", cfg.ProducerMonitoringTopic)
+		}
+	}
+
+	k := &KMon{
 		topicManager: topicManager,
 		cfg:          cfg,
 		rootCtx:      ctx,
-	}, nil
+		slos:         newSLOTracker(kmonMetrics, cfg.SLOs),
+		newMonitor: func(partitionBrokers []int32) (*Monitor, error) {
+			return NewMonitorFromConfig(cfg, kmonMetrics, partitionBrokers)
+		},
+	}
+
+	k.clusterIDGuard = newClusterIDGuard(cfg, kmonMetrics, k.clusterIDClients)
+	topicManager.paused = k.clusterIDGuard.mismatched
+	k.collectors = append(k.collectors, k.clusterIDGuard)
+	adminClient := clusterIDClient{"producer", clients.RoleAdmin, cfg.ProducerKafkaConfig.ClusterID, topicManager.client}
+	if err := k.clusterIDGuard.verify(ctx, adminClient); err != nil {
+		log.Warn().Err(err).Msg("failed to verify the producer cluster's ID")
+	}
+	// Nothing is safe to do against an unexpected cluster, so kmon doesn't start at all
+	if k.clusterIDGuard.mismatched() {
+		k.close()
+		return nil, fmt.Errorf("producer cluster ID doesn't match the expected %s", cfg.ProducerKafkaConfig.ClusterID)
+	}
+
+	k.dashboard = newDashboard(cfg, k.getMonitor, topicManager.getStatus)
+	k.collectors = append(k.collectors, k.dashboard)
+
+	if cfg.StatsSnapshot != nil {
+		k.statsSnapshotter = newStatsSnapshotterFromConfig(cfg.StatsSnapshot, k.getMonitor)
+		k.collectors = append(k.collectors, k.statsSnapshotter)
+	}
+
+	if cfg.ProbeHistory != nil {
+		k.probeHistory, err = newProbeHistoryFromConfig(cfg.ProbeHistory, kmonMetrics)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		k.collectors = append(k.collectors, k.probeHistory)
+	}
+
+	if cfg.ResultsTopic != nil {
+		clusterID := func() string {
+			return k.clusterIDGuard.clusterID("producer", clients.RoleAdmin)
+		}
+		k.resultsPublisher, err = newResultsPublisherFromConfig(cfg, kmonMetrics, clusterID)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		k.collectors = append(k.collectors, k.resultsPublisher)
+	}
+
+	if cfg.HighAvailability != nil {
+		k.leaderElector, err = newLeaderElectorFromConfig(cfg, kmonMetrics)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		topicManager.leader = k.leaderElector.isLeader
+		k.collectors = append(k.collectors, k.leaderElector)
+	}
+
+	k.preflighter = newPreflighter(cfg, kmonMetrics)
+	k.preflighter.run(ctx)
+	k.collectors = append(k.collectors, k.preflighter)
+
+	if cfg.Alerting != nil {
+		k.alertEvaluator, err = NewAlertEvaluatorFromConfig(cfg.Alerting, kmonMetrics, k.getMonitor)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+	}
+
+	if cfg.GroupCanary != nil {
+		groupCanary, err := NewGroupCanaryFromConfig(cfg, kmonMetrics, topicManager.getAllBrokers)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		groupCanary.paused = k.adminPaused
+		k.collectors = append(k.collectors, groupCanary)
+	}
+	if cfg.BrokerPings != nil {
+		brokerPinger, err := NewBrokerPingerFromConfig(cfg, kmonMetrics, topicManager.getAllBrokers)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		// Every replica pings brokers, but not while connected to the wrong cluster
+		brokerPinger.paused = k.clusterIDGuard.mismatched
+		k.collectors = append(k.collectors, brokerPinger)
+	}
+	if cfg.AdminCanary != nil {
+		adminCanary, err := NewAdminCanaryFromConfig(cfg, kmonMetrics)
+		if err != nil {
+			k.close()
+			return nil, err
+		}
+		adminCanary.paused = k.adminPaused
+		k.collectors = append(k.collectors, adminCanary)
+	}
+
+	return k, nil
+}
+
+// Preflight returns the report of the last run of the preflight checks, which first run when KMon is created.
+func (k *KMon) Preflight() *PreflightReport {
+	return k.preflighter.getReport()
+}
+
+// close closes the clients created along with KMon, for when it fails to be created and is never started.
+func (k *KMon) close() {
+	k.topicManager.admClient.Close()
+	for _, collector := range k.collectors {
+		if c, ok := collector.(closer); ok {
+			c.close()
+		}
+	}
 }
 
 func (k *KMon) Start() {
 	k.topicManager.changeDetectedCallback = k.changeDetectedCallback
 	k.topicManager.doneReconcilingCallback = k.doneReconcilingCallback
+	k.topicManager.leadersChangedCallback = k.leadersChangedCallback
 
+	if k.alertEvaluator != nil {
+		go k.alertEvaluator.Start(k.rootCtx)
+	}
+	for _, collector := range k.collectors {
+		go collector.Start(k.rootCtx)
+	}
 	k.topicManager.Start(k.rootCtx)
 }
 
+// adminPaused returns whether the canaries that act on the cluster's coordinators and topics should be skipped: when
+// connected to an unexpected cluster, or when another replica leads.
+func (k *KMon) adminPaused() bool {
+	return k.clusterIDGuard.mismatched() || !k.leaderElector.isLeader()
+}
+
+// getMonitor returns the currently running Monitor, or nil if the topic has not been reconciled yet.
+func (k *KMon) getMonitor() *Monitor {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.monitor
+}
+
+// DashboardHandler returns the handler serving the dashboard on / and its data on /api.
+func (k *KMon) DashboardHandler() http.Handler {
+	return k.dashboard
+}
+
+// ProbeHistoryHandler returns the handler serving the probe history, or nil if it isn't recorded.
+func (k *KMon) ProbeHistoryHandler() http.Handler {
+	if k.probeHistory == nil {
+		return nil
+	}
+	return k.probeHistory
+}
+
+// recordProbeResult passes the result of every probe to the features consuming them.
+func (k *KMon) recordProbeResult(result ProbeResult) {
+	if k.probeHistory != nil {
+		k.probeHistory.record(result)
+	}
+	if k.resultsPublisher != nil {
+		k.resultsPublisher.publish(result)
+	}
+}
+
+// Shutdown saves a last stats snapshot of the current Monitor, if enabled. It is called once the root context is done.
+func (k *KMon) Shutdown() {
+	if err := k.statsSnapshotter.save(k.getMonitor()); err != nil {
+		log.Error().Err(err).Msg("failed to save stats snapshot")
+	}
+}
+
 func (k *KMon) changeDetectedCallback() {
+	k.mu.Lock()
+	monitor := k.monitor
 	if k.monitorCancelFunc != nil {
 		k.monitorCancelFunc()
+		k.monitorCancelFunc = nil
+	}
+	k.mu.Unlock()
+
+	// The next Monitor picks up where this one left off
+	if err := k.statsSnapshotter.save(monitor); err != nil {
+		log.Error().Err(err).Msg("failed to save stats snapshot")
 	}
 }
 
-func (k *KMon) doneReconcilingCallback(numPartitions int) {
-	monitor, err := NewMonitorFromConfig(k.cfg, numPartitions)
+func (k *KMon) doneReconcilingCallback(partitionBrokers []int32) {
+	monitor, err := k.newMonitor(partitionBrokers)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create monitor instance")
 	}
-	k.monitor = monitor
+	monitor.paused = k.clusterIDGuard.mismatched
+	k.slos.attach(len(partitionBrokers), monitor.labels)
+	monitor.slos = k.slos
+	if k.probeHistory != nil || k.resultsPublisher != nil {
+		monitor.resultCallback = k.recordProbeResult
+	}
+	if err := k.statsSnapshotter.restore(monitor); err != nil {
+		log.Error().Err(err).Msg("failed to restore stats snapshot")
+	}
+	for _, c := range k.monitorClusterIDClients(monitor) {
+		if err := k.clusterIDGuard.verify(k.rootCtx, c); err != nil {
+			log.Warn().Err(err).Msgf("failed to verify the %s cluster's ID", c.cluster)
+		}
+	}
 	monitorCtx, monitorCancel := context.WithCancel(k.rootCtx)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.monitorCancelFunc != nil {
+		k.monitorCancelFunc()
+	}
+	k.monitor = monitor
 	k.monitorCancelFunc = monitorCancel
-	go k.monitor.Start(monitorCtx)
+	go monitor.Start(monitorCtx)
+}
+
+// leadersChangedCallback relabels the current Monitor's measurements with the new leaders of its partitions.
+func (k *KMon) leadersChangedCallback(partitionBrokers []int32) {
+	if monitor := k.getMonitor(); monitor != nil {
+		monitor.setPartitionBrokers(partitionBrokers)
+	}
+}
+
+// clusterIDClients returns the clients the cluster ID guard verifies: the TopicManager's and the current Monitor's.
+func (k *KMon) clusterIDClients() []clusterIDClient {
+	clients := []clusterIDClient{{"producer", clients.RoleAdmin, k.cfg.ProducerKafkaConfig.ClusterID, k.topicManager.client}}
+	if monitor := k.getMonitor(); monitor != nil {
+		clients = append(clients, k.monitorClusterIDClients(monitor)...)
+	}
+	return clients
+}
+
+func (k *KMon) monitorClusterIDClients(monitor *Monitor) []clusterIDClient {
+	var monitorClients []clusterIDClient
+	if producerClient, ok := monitor.producerClient.(kmsg.Requestor); ok {
+		monitorClients = append(monitorClients, clusterIDClient{"producer", clients.RoleProducer, k.cfg.ProducerKafkaConfig.ClusterID, producerClient})
+	}
+	if consumerClient, ok := monitor.consumerClient.(kmsg.Requestor); ok && k.cfg.ConsumerKafkaConfig != nil {
+		monitorClients = append(monitorClients, clusterIDClient{"consumer", clients.RoleConsumer, k.cfg.ConsumerKafkaConfig.ClusterID, consumerClient})
+	}
+	return monitorClients
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/pliu/kmon/pkg/config"
+	"github.com/pliu/kmon/pkg/metrics"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,12 +24,13 @@ func TestKMonIntegration(t *testing.T) {
 		},
 		"producerMonitoringTopic": "` + topic + `",
 		"sampleFrequencyMs": 200,
-		"topicReconciliationFrequencyMin": 1
+		"topicReconciliationFrequencyMin": 1,
+		"adoptTopic": true
 	}`)
 	cfg, err := config.GetKMonConfigFromBytes(&data)
 	require.NoError(t, err)
 
-	kmon, err := NewKMonFromConfig(cfg, ctx)
+	kmon, err := NewKMonFromConfig(cfg, metrics.NewNopSink(), ctx)
 	require.NoError(t, err)
 	kmon.topicManager.reconciliationInterval = 20 * time.Second
 
@@ -40,7 +42,7 @@ func TestKMonIntegration(t *testing.T) {
 	kmon.topicManager.waitUntilTopicExists(ctx)
 	time.Sleep(1 * time.Second)
 
-	first_uuid := kmon.monitor.instanceUUID
+	first_uuid := kmon.getMonitor().instanceID
 	numPartitions, err := kmon.topicManager.getTopicNumPartitions(ctx)
 	require.NoError(t, err)
 	require.Equal(t, 3, numPartitions)
@@ -48,17 +50,17 @@ func TestKMonIntegration(t *testing.T) {
 	time.Sleep(15 * time.Second)
 
 	for partition := range numPartitions {
-		require.Greater(t, kmon.monitor.e2eStats[partition].Len(), 0)
-		require.Greater(t, kmon.monitor.b2cStats[partition].Len(), 0)
-		require.Greater(t, kmon.monitor.p2bStats[partition].Len(), 0)
-		require.Greater(t, kmon.monitor.producerAckStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().e2eStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().b2cStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().p2bStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().producerAckStats[partition].Len(), 0)
 	}
 
 	_, _ = kmon.topicManager.admClient.DeleteTopics(ctx, topic)
 	kmon.topicManager.waitUntilTopicNoLongerExists(ctx)
 	kmon.topicManager.waitUntilTopicExists(ctx)
 	time.Sleep(1 * time.Second)
-	second_uuid := kmon.monitor.instanceUUID
+	second_uuid := kmon.getMonitor().instanceID
 	require.NotEqual(t, first_uuid, second_uuid)
 	numPartitions, err = kmon.topicManager.getTopicNumPartitions(ctx)
 	require.NoError(t, err)
@@ -80,15 +82,15 @@ func TestKMonIntegration(t *testing.T) {
 
 	time.Sleep(25 * time.Second)
 
-	third_uuid := kmon.monitor.instanceUUID
+	third_uuid := kmon.getMonitor().instanceID
 	require.NotEqual(t, second_uuid, third_uuid)
 	numPartitions, err = kmon.topicManager.getTopicNumPartitions(ctx)
 	require.NoError(t, err)
 	require.Equal(t, 3, numPartitions)
 	for partition := range numPartitions {
-		require.Greater(t, kmon.monitor.e2eStats[partition].Len(), 0)
-		require.Greater(t, kmon.monitor.b2cStats[partition].Len(), 0)
-		require.Greater(t, kmon.monitor.p2bStats[partition].Len(), 0)
-		require.Greater(t, kmon.monitor.producerAckStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().e2eStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().b2cStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().p2bStats[partition].Len(), 0)
+		require.Greater(t, kmon.getMonitor().producerAckStats[partition].Len(), 0)
 	}
 }
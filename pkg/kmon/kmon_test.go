@@ -0,0 +1,86 @@
+package kmon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/pliu/kmon/pkg/metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestNewKMonFromConfigSLOTarget(t *testing.T) {
+	for _, target := range []float64{-0.5, 1, 1.5} {
+		cfg := &config.KMonConfig{
+			ProducerMonitoringTopic: "test-topic",
+			ProducerKafkaConfig:     &config.KafkaConfig{SeedBrokers: []string{"localhost:10000"}},
+			SLOs:                    []*config.SLOConfig{{Name: "e2e", LatencyThresholdMs: 500, Target: target}},
+		}
+		_, err := NewKMonFromConfig(cfg, metrics.NewNopSink(), context.Background())
+		require.ErrorContains(t, err, "must be strictly between 0 and 1", "target %g", target)
+	}
+}
+
+// TestKMonMonitorSwap is meant to be run with -race: the TopicManager callbacks replace the Monitor while it is
+// being read from other goroutines.
+func TestKMonMonitorSwap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k := &KMon{
+		rootCtx: ctx,
+		slos:    newSLOTracker(newTestMetrics(), nil),
+		newMonitor: func(partitionBrokers []int32) (*Monitor, error) {
+			return NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "test-topic", &MockKgoClient{}, "test-uuid", len(partitionBrokers), time.Hour, time.Minute, false), nil
+		},
+	}
+	require.Nil(t, k.getMonitor())
+
+	numSwaps := 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range numSwaps {
+			k.changeDetectedCallback()
+			k.doneReconcilingCallback(make([]int32, i+1))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			require.Equal(t, numSwaps, k.getMonitor().partitions)
+			return
+		default:
+			if m := k.getMonitor(); m != nil {
+				require.Positive(t, m.partitions)
+			}
+		}
+	}
+}
+
+type closingCollector struct {
+	closed bool
+}
+
+func (c *closingCollector) Start(context.Context) {}
+
+func (c *closingCollector) close() {
+	c.closed = true
+}
+
+func TestKMonClose(t *testing.T) {
+	client, err := kgo.NewClient(kgo.SeedBrokers("localhost:10000"))
+	require.NoError(t, err)
+	collector := &closingCollector{}
+	k := &KMon{
+		topicManager: &TopicManager{admClient: kadm.NewClient(client)},
+		collectors:   []Collector{collector, &clusterIDGuard{}},
+	}
+
+	k.close()
+	require.True(t, collector.closed)
+}
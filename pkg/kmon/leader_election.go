@@ -0,0 +1,122 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	leadershipAcquired = "acquired"
+	leadershipLost     = "lost"
+)
+
+// leaderElector elects a leader among the kmon replicas monitoring the same topic. Every replica joins a consumer
+// group subscribed to a single-partition lease topic, and the replica the group assigns partition 0 to is the
+// leader. When the leader stops or misses heartbeats for the session timeout, the group reassigns the partition to
+// another replica. As with any lease, a replica that stalls can keep acting as the leader for up to a session timeout
+// after the group has moved on.
+type leaderElector struct {
+	metrics    *Metrics
+	client     *kgo.Client
+	leaseTopic string
+	leader     atomic.Bool
+}
+
+func newLeaderElectorFromConfig(cfg *config.KMonConfig, metrics *Metrics) (*leaderElector, error) {
+	e := &leaderElector{
+		metrics:    metrics,
+		leaseTopic: cfg.HighAvailability.GetLeaseTopic(cfg.ProducerMonitoringTopic),
+	}
+	e.metrics.Leader.WithLabelValues(e.leaseTopic).Set(0)
+
+	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleConsumer, nil,
+		kgo.ConsumerGroup(e.leaseTopic),
+		kgo.ConsumeTopics(e.leaseTopic),
+		kgo.DisableAutoCommit(),
+		kgo.SessionTimeout(time.Duration(cfg.HighAvailability.GetSessionTimeoutMs())*time.Millisecond),
+		kgo.OnPartitionsAssigned(e.onAssigned),
+		kgo.OnPartitionsRevoked(e.onRevoked),
+		kgo.OnPartitionsLost(e.onRevoked),
+	)
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+	return e, nil
+}
+
+func (e *leaderElector) close() {
+	e.client.Close()
+}
+
+func (e *leaderElector) Start(ctx context.Context) {
+	defer func() {
+		// Leaving the group hands leadership over to another replica right away
+		e.close()
+		e.setLeader(false)
+	}()
+
+	if err := e.createLeaseTopic(ctx); err != nil {
+		log.Error().Err(err).Msgf("failed to create lease topic %s", e.leaseTopic)
+	}
+
+	// Nothing is ever produced to the lease topic, but polling keeps the client's group membership going
+	for ctx.Err() == nil {
+		e.client.PollFetches(ctx)
+	}
+}
+
+// isLeader returns whether this replica is the leader. Without an elector, kmon runs alone and always leads.
+func (e *leaderElector) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	return e.leader.Load()
+}
+
+func (e *leaderElector) createLeaseTopic(ctx context.Context) error {
+	resp, err := kadm.NewClient(e.client).CreateTopic(ctx, 1, -1, nil, e.leaseTopic)
+	if err == nil {
+		err = resp.Err
+	}
+	if errors.Is(err, kerr.TopicAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+func (e *leaderElector) onAssigned(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+	if slices.Contains(assigned[e.leaseTopic], 0) {
+		e.setLeader(true)
+	}
+}
+
+func (e *leaderElector) onRevoked(_ context.Context, _ *kgo.Client, revoked map[string][]int32) {
+	if slices.Contains(revoked[e.leaseTopic], 0) {
+		e.setLeader(false)
+	}
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+	if e.leader.Swap(leader) == leader {
+		return
+	}
+
+	transition, value := leadershipLost, 0.0
+	if leader {
+		transition, value = leadershipAcquired, 1
+	}
+	e.metrics.Leader.WithLabelValues(e.leaseTopic).Set(value)
+	e.metrics.LeadershipTransitionCount.WithLabelValues(e.leaseTopic, transition).Inc()
+	log.Info().Msgf("Leadership of %s %s", e.leaseTopic, transition)
+}
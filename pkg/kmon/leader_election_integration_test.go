@@ -0,0 +1,51 @@
+//go:build integration
+
+package kmon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderElectorFailover(t *testing.T) {
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: "kmon-ha",
+		ProducerKafkaConfig: &config.KafkaConfig{
+			SeedBrokers: []string{"localhost:10000"},
+		},
+		HighAvailability: &config.HighAvailabilityConfig{SessionTimeoutMs: 6000},
+	}
+
+	var electors []*leaderElector
+	var cancels []context.CancelFunc
+	for range 2 {
+		e, err := newLeaderElectorFromConfig(cfg, newTestMetrics())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go e.Start(ctx)
+		electors = append(electors, e)
+		cancels = append(cancels, cancel)
+	}
+
+	leaders := func() []int {
+		var leaders []int
+		for i, e := range electors {
+			if e.isLeader() {
+				leaders = append(leaders, i)
+			}
+		}
+		return leaders
+	}
+	require.Eventually(t, func() bool { return len(leaders()) == 1 }, 30*time.Second, 100*time.Millisecond)
+
+	// Stopping the leader hands leadership over to the other replica
+	leader := leaders()[0]
+	cancels[leader]()
+	require.Eventually(t, func() bool { return electors[1-leader].isLeader() }, 30*time.Second, 100*time.Millisecond)
+	require.False(t, electors[leader].isLeader())
+}
@@ -0,0 +1,32 @@
+package kmon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderElector(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	e := &leaderElector{metrics: metrics, leaseTopic: "kmon-leader-kmon"}
+
+	// Only partition 0 of the lease topic grants leadership
+	e.onAssigned(context.Background(), nil, map[string][]int32{"other": {0}})
+	require.False(t, e.isLeader())
+	e.onAssigned(context.Background(), nil, map[string][]int32{"kmon-leader-kmon": {0}})
+	require.True(t, e.isLeader())
+	e.onAssigned(context.Background(), nil, map[string][]int32{"kmon-leader-kmon": {0}})
+	require.Equal(t, 1.0, metricSamples(t, registry, "kmon_leader")["kmon-leader-kmon"])
+
+	e.onRevoked(context.Background(), nil, map[string][]int32{"kmon-leader-kmon": {0}})
+	require.False(t, e.isLeader())
+	require.Equal(t, 0.0, metricSamples(t, registry, "kmon_leader")["kmon-leader-kmon"])
+	require.Equal(t, map[string]float64{
+		"kmon-leader-kmon,acquired": 1,
+		"kmon-leader-kmon,lost":     1,
+	}, metricSamples(t, registry, "kmon_leadership_transitions_total"))
+
+	var noElector *leaderElector
+	require.True(t, noElector.isLeader())
+}
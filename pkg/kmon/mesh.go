@@ -0,0 +1,108 @@
+package kmon
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pliu/datastructs/pkg/stats"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Probes carry the name of the instance that produced them in this header, so that instances in mesh mode can tell
+// whose probes they consume.
+const sourceHeader = "kmon-source"
+
+// meshTracker measures, from this instance, the probes of every instance sharing the monitoring topic including its
+// own. Instances come and go, so unlike the per-partition state of the Monitor, sources are added as their first
+// probe is consumed and mu guards the map holding them.
+//
+// Lost probes are detected from gaps in the sequence numbers of each source's partitions. A probe consumed after a
+// later one from the same partition has already been counted as lost.
+type meshTracker struct {
+	metrics     *Metrics
+	instance    string
+	statsWindow time.Duration
+
+	mu      sync.Mutex
+	sources map[string]*meshSource
+}
+
+type meshSource struct {
+	e2eStats *stats.Stats
+	// Key of the source's last probe, which changes whenever the source restarts its Monitor and sequence numbers
+	// start over
+	key     string
+	lastSeq map[int]int64
+}
+
+func newMeshTracker(metrics *Metrics, instance string, statsWindow time.Duration) *meshTracker {
+	return &meshTracker{
+		metrics:     metrics,
+		instance:    instance,
+		statsWindow: statsWindow,
+		sources:     make(map[string]*meshSource),
+	}
+}
+
+// observe records a consumed probe against the instance that produced it. Records without a source are ignored.
+func (t *meshTracker) observe(record *kgo.Record, consumeTime time.Time) {
+	source := recordHeader(record, sourceHeader)
+	if source == "" {
+		return
+	}
+	timestamp, err := strconv.ParseInt(string(record.Value), 10, 64)
+	if err != nil {
+		return
+	}
+	e2eLatency := consumeTime.Sub(time.Unix(0, timestamp))
+
+	t.mu.Lock()
+	s, exists := t.sources[source]
+	if !exists {
+		s = &meshSource{e2eStats: stats.NewStats(t.statsWindow)}
+		t.sources[source] = s
+	}
+	if s.key != string(record.Key) {
+		s.key = string(record.Key)
+		s.lastSeq = make(map[int]int64)
+	}
+	var lost int64
+	if partition, sequence, ok := parseSequenceHeader(record); ok {
+		last, seen := s.lastSeq[partition]
+		if seen && sequence > last+1 {
+			lost = sequence - last - 1
+		}
+		if !seen || sequence > last {
+			s.lastSeq[partition] = sequence
+		}
+	}
+	t.mu.Unlock()
+
+	s.e2eStats.Add(e2eLatency.Milliseconds())
+	t.metrics.MeshProbeCount.WithLabelValues(source, t.instance).Inc()
+	if lost > 0 {
+		t.metrics.MeshLostProbeCount.WithLabelValues(source, t.instance).Add(float64(lost))
+	}
+}
+
+// e2eStats returns the e2e latency window of every source seen so far.
+func (t *meshTracker) e2eStats() map[string]*stats.Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	windows := make(map[string]*stats.Stats, len(t.sources))
+	for source, s := range t.sources {
+		windows[source] = s.e2eStats
+	}
+	return windows
+}
+
+// recordHeader returns the value of the record's header with the given key, or "" if it has none.
+func recordHeader(record *kgo.Record, key string) string {
+	for _, header := range record.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package kmon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func meshRecord(source string, key string, partition int, sequence int64, sentAt time.Time) *kgo.Record {
+	return &kgo.Record{
+		Key:   []byte(key),
+		Value: fmt.Appendf(nil, "%d", sentAt.UnixNano()),
+		Headers: []kgo.RecordHeader{
+			{Key: sequenceHeader, Value: sequenceHeaderValue(partition, sequence)},
+			{Key: sourceHeader, Value: []byte(source)},
+		},
+	}
+}
+
+func TestMeshTracker(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	tracker := newMeshTracker(metrics, "zone-a", time.Minute)
+	now := time.Now()
+
+	tracker.observe(meshRecord("zone-a", "uuid-a", 0, 1, now.Add(-5*time.Millisecond)), now)
+	tracker.observe(meshRecord("zone-b", "uuid-b", 0, 1, now.Add(-20*time.Millisecond)), now)
+	// Probes 2 and 3 of zone-b's partition 0 are lost, and a late probe 2 isn't counted twice
+	tracker.observe(meshRecord("zone-b", "uuid-b", 0, 4, now.Add(-30*time.Millisecond)), now)
+	tracker.observe(meshRecord("zone-b", "uuid-b", 0, 2, now.Add(-40*time.Millisecond)), now)
+	// Partitions are tracked separately
+	tracker.observe(meshRecord("zone-b", "uuid-b", 1, 7, now.Add(-20*time.Millisecond)), now)
+	// Sequence numbers start over when the source restarts
+	tracker.observe(meshRecord("zone-b", "uuid-b2", 0, 1, now.Add(-20*time.Millisecond)), now)
+	// Records without a source are ignored
+	tracker.observe(&kgo.Record{Key: []byte("uuid-c"), Value: []byte("1")}, now)
+
+	// Labels are sorted by name, so destinations come first
+	require.Equal(t, map[string]float64{
+		"zone-a,zone-a": 1,
+		"zone-a,zone-b": 5,
+	}, metricSamples(t, registry, "kmon_mesh_probe_count"))
+	require.Equal(t, map[string]float64{
+		"zone-a,zone-b": 2,
+	}, metricSamples(t, registry, "kmon_mesh_lost_probe_count"))
+
+	windows := tracker.e2eStats()
+	require.Len(t, windows, 2)
+	require.Equal(t, []int64{20, 20, 20, 30, 40}, windows["zone-b"].Values())
+}
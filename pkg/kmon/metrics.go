@@ -1,65 +1,422 @@
 package kmon
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/metrics"
 )
 
-var (
-	E2EMessageLatencyQuantile = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmon_e2e_message_latency_quantile",
-			Help: "Quantile of e2e message delivery latency in milliseconds",
-		},
-		[]string{"partition", "quantile"},
-	)
-	P2BMessageLatencyQuantile = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmon_p2b_message_latency_quantile",
-			Help: "Quantile of producer-to-broker message delivery latency in milliseconds",
-		},
-		[]string{"partition", "quantile"},
-	)
-	B2CMessageLatencyQuantile = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmon_b2c_message_latency_quantile",
-			Help: "Quantile of broker-to-consumer message delivery latency in milliseconds",
-		},
-		[]string{"partition", "quantile"},
-	)
-	ProducerAckLatencyQuantile = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmon_producer_ack_quantile",
-			Help: "Quantile of producer ack latency in milliseconds",
-		},
-		[]string{"partition", "quantile"},
-	)
-	ProduceMessageCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "kmon_produce_message_count",
-			Help: "Total number of produced messages",
-		},
-		[]string{"partition"},
-	)
-	ConsumeMessageCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "kmon_consume_message_count",
-			Help: "Total number of consumed messages",
-		},
-		[]string{"partition"},
-	)
-	ProduceMessageFailureCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "kmon_produce_message_failure_count",
-			Help: "Total number of produce message failures",
-		},
-		[]string{"partition"},
-	)
-	ConsumeMessageFailureCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "kmon_consume_message_failure_count",
-			Help: "Total number of consume message failures",
-		},
-		[]string{"partition"},
-	)
-)
+// Buckets for latency histograms, in milliseconds
+var latencyBucketsMs = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// Metrics holds every instrument kmon reports. It is created once per sink and shared by the TopicManager and all
+// the Monitors that it spawns over time.
+type Metrics struct {
+	E2EMessageLatencyQuantile       metrics.GaugeVec
+	P2BMessageLatencyQuantile       metrics.GaugeVec
+	B2CMessageLatencyQuantile       metrics.GaugeVec
+	ProducerAckLatencyQuantile      metrics.GaugeVec
+	ProduceMessageCount             metrics.CounterVec
+	ConsumeMessageCount             metrics.CounterVec
+	ProduceMessageFailureCount      metrics.CounterVec
+	ConsumeMessageFailureCount      metrics.CounterVec
+	TopicReconciliationCount        metrics.CounterVec
+	TopicReconciliationFailureCount metrics.CounterVec
+	TopicPlannedActions             metrics.GaugeVec
+	TopicOwnershipRefusalCount      metrics.CounterVec
+	ProbeLostCount                  metrics.CounterVec
+	SLOEventCount                   metrics.CounterVec
+	SLOGoodEventCount               metrics.CounterVec
+	SLOErrorBudgetRemaining         metrics.GaugeVec
+	SLOBurnRate                     metrics.GaugeVec
+	SLOClusterEventCount            metrics.CounterVec
+	SLOClusterGoodEventCount        metrics.CounterVec
+	SLOClusterErrorBudgetRemaining  metrics.GaugeVec
+	SLOClusterBurnRate              metrics.GaugeVec
+	AlertFiring                     metrics.GaugeVec
+	AlertNotificationCount          metrics.CounterVec
+	AlertNotificationFailureCount   metrics.CounterVec
+	ConsumerGroupJoinLatency        metrics.HistogramVec
+	ConsumerGroupRebalanceDuration  metrics.HistogramVec
+	ConsumerGroupRebalanceCount     metrics.CounterVec
+	ConsumerGroupCommitLatency      metrics.HistogramVec
+	ConsumerGroupCommitFailureCount metrics.CounterVec
+	TxnInitProducerIDLatency        metrics.HistogramVec
+	TxnInitProducerIDFailureCount   metrics.CounterVec
+	TxnCommitLatency                metrics.HistogramVec
+	TxnCommitToVisibleLatency       metrics.HistogramVec
+	TxnAbortCount                   metrics.CounterVec
+	TxnFencedCount                  metrics.CounterVec
+	TxnFailureCount                 metrics.CounterVec
+
+	GroupCanaryLatency               metrics.HistogramVec
+	GroupCanaryFailureCount          metrics.CounterVec
+	GroupCanaryCoordinatedPartitions metrics.GaugeVec
+
+	BrokerPingRTT          metrics.HistogramVec
+	BrokerPingTimeoutCount metrics.CounterVec
+	BrokerPingFailureCount metrics.CounterVec
+	BrokerPingRegistered   metrics.GaugeVec
+
+	AdminCanaryLatency                 metrics.HistogramVec
+	AdminCanaryFailureCount            metrics.CounterVec
+	AdminCanaryPropagationLatency      metrics.HistogramVec
+	AdminCanaryPropagationFailureCount metrics.CounterVec
+
+	ProbeThrottleTime               metrics.HistogramVec
+	ThrottledProbeCount             metrics.CounterVec
+	ThrottledMessageLatencyQuantile metrics.GaugeVec
+
+	OrderingViolationCount metrics.CounterVec
+
+	PreflightFailure metrics.GaugeVec
+
+	ClusterIDInfo     metrics.GaugeVec
+	ClusterIDMismatch metrics.GaugeVec
+
+	Leader                    metrics.GaugeVec
+	LeadershipTransitionCount metrics.CounterVec
+
+	InstanceInfo metrics.GaugeVec
+
+	MeshE2ELatencyQuantile metrics.GaugeVec
+	MeshProbeCount         metrics.CounterVec
+	MeshLostProbeCount     metrics.CounterVec
+
+	ProbeHistoryDroppedCount   metrics.CounterVec
+	ResultsPublishedCount      metrics.CounterVec
+	ResultsPublishFailureCount metrics.CounterVec
+
+	Clients *clients.ClientMetrics
+}
+
+func NewMetrics(sink metrics.Sink) *Metrics {
+	return &Metrics{
+		E2EMessageLatencyQuantile: sink.NewGaugeVec(
+			"kmon_e2e_message_latency_quantile",
+			"Quantile of e2e message delivery latency in milliseconds",
+			[]string{"partition", "quantile"},
+		),
+		P2BMessageLatencyQuantile: sink.NewGaugeVec(
+			"kmon_p2b_message_latency_quantile",
+			"Quantile of producer-to-broker message delivery latency in milliseconds",
+			[]string{"partition", "quantile"},
+		),
+		B2CMessageLatencyQuantile: sink.NewGaugeVec(
+			"kmon_b2c_message_latency_quantile",
+			"Quantile of broker-to-consumer message delivery latency in milliseconds",
+			[]string{"partition", "quantile"},
+		),
+		ProducerAckLatencyQuantile: sink.NewGaugeVec(
+			"kmon_producer_ack_quantile",
+			"Quantile of producer ack latency in milliseconds",
+			[]string{"partition", "quantile"},
+		),
+		ProduceMessageCount: sink.NewCounterVec(
+			"kmon_produce_message_count",
+			"Total number of produced messages",
+			[]string{"partition"},
+		),
+		ConsumeMessageCount: sink.NewCounterVec(
+			"kmon_consume_message_count",
+			"Total number of consumed messages",
+			[]string{"partition"},
+		),
+		ProduceMessageFailureCount: sink.NewCounterVec(
+			"kmon_produce_message_failure_count",
+			"Total number of produce message failures",
+			[]string{"partition"},
+		),
+		ConsumeMessageFailureCount: sink.NewCounterVec(
+			"kmon_consume_message_failure_count",
+			"Total number of consume message failures",
+			[]string{"partition"},
+		),
+		TopicReconciliationCount: sink.NewCounterVec(
+			"kmon_topic_reconciliation_count",
+			"Total number of times the monitoring topic was reconciled",
+			[]string{"topic"},
+		),
+		TopicReconciliationFailureCount: sink.NewCounterVec(
+			"kmon_topic_reconciliation_failure_count",
+			"Total number of failed attempts to check or reconcile the monitoring topic",
+			[]string{"topic"},
+		),
+		TopicPlannedActions: sink.NewGaugeVec(
+			"kmon_topic_planned_actions",
+			"Number of actions of each type that reconciling the monitoring topic currently requires",
+			[]string{"topic", "action"},
+		),
+		TopicOwnershipRefusalCount: sink.NewCounterVec(
+			"kmon_topic_ownership_refusal_count",
+			"Total number of times kmon refused to modify the monitoring topic as it isn't marked as kmon's",
+			[]string{"topic"},
+		),
+		ProbeLostCount: sink.NewCounterVec(
+			"kmon_probe_lost_count",
+			"Total number of acked probes that were not consumed within the probe timeout",
+			[]string{"partition"},
+		),
+		SLOEventCount: sink.NewCounterVec(
+			"kmon_slo_events_total",
+			"Total number of probes evaluated against the SLO",
+			[]string{"slo", "partition", "broker"},
+		),
+		SLOGoodEventCount: sink.NewCounterVec(
+			"kmon_slo_good_events_total",
+			"Total number of probes that met the SLO",
+			[]string{"slo", "partition", "broker"},
+		),
+		SLOErrorBudgetRemaining: sink.NewGaugeVec(
+			"kmon_slo_error_budget_remaining",
+			"Fraction of the SLO's error budget left over the compliance window (negative once breached)",
+			[]string{"slo", "partition", "broker"},
+		),
+		SLOBurnRate: sink.NewGaugeVec(
+			"kmon_slo_burn_rate",
+			"Rate at which the SLO's error budget is being spent over the window (1 spends exactly the whole budget)",
+			[]string{"slo", "partition", "broker", "window"},
+		),
+		SLOClusterEventCount: sink.NewCounterVec(
+			"kmon_slo_cluster_events_total",
+			"Total number of probes evaluated against the SLO across all partitions",
+			[]string{"slo"},
+		),
+		SLOClusterGoodEventCount: sink.NewCounterVec(
+			"kmon_slo_cluster_good_events_total",
+			"Total number of probes that met the SLO across all partitions",
+			[]string{"slo"},
+		),
+		SLOClusterErrorBudgetRemaining: sink.NewGaugeVec(
+			"kmon_slo_cluster_error_budget_remaining",
+			"Fraction of the SLO's error budget left over the compliance window across all partitions",
+			[]string{"slo"},
+		),
+		SLOClusterBurnRate: sink.NewGaugeVec(
+			"kmon_slo_cluster_burn_rate",
+			"Rate at which the SLO's error budget is being spent over the window across all partitions",
+			[]string{"slo", "window"},
+		),
+		AlertFiring: sink.NewGaugeVec(
+			"kmon_alert_firing",
+			"Whether the alert rule is currently firing for the partition (1) or not (0)",
+			[]string{"rule", "partition", "broker"},
+		),
+		AlertNotificationCount: sink.NewCounterVec(
+			"kmon_alert_notification_count",
+			"Total number of alert notifications sent",
+			[]string{"notifier", "status"},
+		),
+		AlertNotificationFailureCount: sink.NewCounterVec(
+			"kmon_alert_notification_failure_count",
+			"Total number of alert notifications that could not be sent",
+			[]string{"notifier"},
+		),
+		ConsumerGroupJoinLatency: sink.NewHistogramVec(
+			"kmon_consumer_group_join_latency_ms",
+			"Time from creating the consumer to first being assigned partitions in milliseconds",
+			latencyBucketsMs,
+			[]string{"group"},
+		),
+		ConsumerGroupRebalanceDuration: sink.NewHistogramVec(
+			"kmon_consumer_group_rebalance_duration_ms",
+			"Time from partitions being revoked to being assigned again in milliseconds",
+			latencyBucketsMs,
+			[]string{"group"},
+		),
+		ConsumerGroupRebalanceCount: sink.NewCounterVec(
+			"kmon_consumer_group_rebalance_count",
+			"Total number of consumer group rebalances",
+			[]string{"group"},
+		),
+		ConsumerGroupCommitLatency: sink.NewHistogramVec(
+			"kmon_consumer_group_commit_latency_ms",
+			"Latency of offset commits in milliseconds",
+			latencyBucketsMs,
+			[]string{"group"},
+		),
+		ConsumerGroupCommitFailureCount: sink.NewCounterVec(
+			"kmon_consumer_group_commit_failure_count",
+			"Total number of failed offset commits",
+			[]string{"group"},
+		),
+		TxnInitProducerIDLatency: sink.NewHistogramVec(
+			"kmon_txn_init_producer_id_latency_ms",
+			"Latency of InitProducerID requests to the transaction coordinator in milliseconds",
+			latencyBucketsMs,
+			[]string{"coordinator"},
+		),
+		TxnInitProducerIDFailureCount: sink.NewCounterVec(
+			"kmon_txn_init_producer_id_failure_count",
+			"Total number of failed InitProducerID requests",
+			[]string{"coordinator"},
+		),
+		TxnCommitLatency: sink.NewHistogramVec(
+			"kmon_txn_commit_latency_ms",
+			"Time from beginning a transactional probe to its commit completing in milliseconds",
+			latencyBucketsMs,
+			[]string{"coordinator"},
+		),
+		TxnCommitToVisibleLatency: sink.NewHistogramVec(
+			"kmon_txn_commit_to_visible_latency_ms",
+			"Time from requesting a commit to the probe being consumed by a read_committed consumer in milliseconds",
+			latencyBucketsMs,
+			[]string{"coordinator", "partition"},
+		),
+		TxnAbortCount: sink.NewCounterVec(
+			"kmon_txn_abort_count",
+			"Total number of aborted transactional probes",
+			[]string{"coordinator"},
+		),
+		TxnFencedCount: sink.NewCounterVec(
+			"kmon_txn_fenced_count",
+			"Total number of times a transactional producer was fenced",
+			[]string{"coordinator"},
+		),
+		TxnFailureCount: sink.NewCounterVec(
+			"kmon_txn_failure_count",
+			"Total number of failed transactional probe operations",
+			[]string{"coordinator", "operation"},
+		),
+		GroupCanaryLatency: sink.NewHistogramVec(
+			"kmon_group_canary_latency_ms",
+			"Latency of group coordinator canary requests in milliseconds",
+			latencyBucketsMs,
+			[]string{"coordinator", "operation"},
+		),
+		GroupCanaryFailureCount: sink.NewCounterVec(
+			"kmon_group_canary_failure_count",
+			"Total number of failed group coordinator canary requests",
+			[]string{"coordinator", "operation"},
+		),
+		GroupCanaryCoordinatedPartitions: sink.NewGaugeVec(
+			"kmon_group_canary_coordinated_partitions",
+			"Number of __consumer_offsets partitions led by each broker",
+			[]string{"broker"},
+		),
+		BrokerPingRTT: sink.NewHistogramVec(
+			"kmon_broker_ping_rtt_ms",
+			"Round trip time of requests sent directly to each broker in milliseconds",
+			latencyBucketsMs,
+			[]string{"broker", "request"},
+		),
+		BrokerPingTimeoutCount: sink.NewCounterVec(
+			"kmon_broker_ping_timeout_count",
+			"Total number of broker pings that timed out",
+			[]string{"broker", "request"},
+		),
+		BrokerPingFailureCount: sink.NewCounterVec(
+			"kmon_broker_ping_failure_count",
+			"Total number of broker pings that failed for reasons other than a timeout",
+			[]string{"broker", "request"},
+		),
+		BrokerPingRegistered: sink.NewGaugeVec(
+			"kmon_broker_ping_registered",
+			"Whether a broker hosting replicas is currently registered in the cluster (1) or not (0)",
+			[]string{"broker"},
+		),
+		AdminCanaryLatency: sink.NewHistogramVec(
+			"kmon_admin_canary_latency_ms",
+			"Latency of admin operations on the scratch topic in milliseconds",
+			latencyBucketsMs,
+			[]string{"operation"},
+		),
+		AdminCanaryFailureCount: sink.NewCounterVec(
+			"kmon_admin_canary_failure_count",
+			"Total number of failed admin operations on the scratch topic",
+			[]string{"operation"},
+		),
+		AdminCanaryPropagationLatency: sink.NewHistogramVec(
+			"kmon_admin_canary_propagation_latency_ms",
+			"Time for the scratch topic's creation or deletion to show up in each broker's metadata in milliseconds",
+			latencyBucketsMs,
+			[]string{"broker", "operation"},
+		),
+		AdminCanaryPropagationFailureCount: sink.NewCounterVec(
+			"kmon_admin_canary_propagation_failure_count",
+			"Total number of times a broker's metadata didn't reflect the scratch topic's creation or deletion in time",
+			[]string{"broker", "operation"},
+		),
+		ProbeThrottleTime: sink.NewHistogramVec(
+			"kmon_probe_throttle_time_ms",
+			"Throttle time imposed by each broker on the monitoring clients in milliseconds",
+			latencyBucketsMs,
+			[]string{"cluster", "broker"},
+		),
+		ThrottledProbeCount: sink.NewCounterVec(
+			"kmon_throttled_probe_count",
+			"Total number of probes consumed while a broker throttled the monitoring clients",
+			[]string{"partition"},
+		),
+		ThrottledMessageLatencyQuantile: sink.NewGaugeVec(
+			"kmon_throttled_message_latency_quantile",
+			"Quantile of latencies in milliseconds of probes in flight while a broker throttled the monitoring clients",
+			[]string{"partition", "type", "quantile"},
+		),
+		OrderingViolationCount: sink.NewCounterVec(
+			"kmon_ordering_violations_total",
+			"Total number of probes consumed out of order, by the partition they were produced to",
+			[]string{"partition"},
+		),
+		PreflightFailure: sink.NewGaugeVec(
+			"kmon_preflight_failure",
+			"Whether a preflight check failed (1) or not (0) when last run, naming the missing permission for permission checks",
+			[]string{"cluster", "check", "resource", "operation"},
+		),
+		ClusterIDInfo: sink.NewGaugeVec(
+			"kmon_cluster_id_info",
+			"ID of the cluster each of kmon's clients is connected to, as a label of a gauge that is always 1",
+			[]string{"cluster", "role", "cluster_id"},
+		),
+		ClusterIDMismatch: sink.NewGaugeVec(
+			"kmon_cluster_id_mismatch",
+			"Whether a client is connected to a cluster other than the configured clusterId (1) or not (0)",
+			[]string{"cluster", "role"},
+		),
+		Leader: sink.NewGaugeVec(
+			"kmon_leader",
+			"Whether this replica is the leader of the replicas sharing the lease topic (1) or not (0)",
+			[]string{"lease_topic"},
+		),
+		LeadershipTransitionCount: sink.NewCounterVec(
+			"kmon_leadership_transitions_total",
+			"Total number of times this replica acquired or lost leadership",
+			[]string{"lease_topic", "transition"},
+		),
+		InstanceInfo: sink.NewGaugeVec(
+			"kmon_instance_info",
+			"Name and run epoch of this instance, which identify its probes, as labels of a gauge that is always 1",
+			[]string{"instance_name", "epoch"},
+		),
+		MeshE2ELatencyQuantile: sink.NewGaugeVec(
+			"kmon_mesh_e2e_latency_quantile",
+			"Quantile of the e2e latency in milliseconds of the probes produced by source_instance and consumed by dest_instance",
+			[]string{"source_instance", "dest_instance", "quantile"},
+		),
+		MeshProbeCount: sink.NewCounterVec(
+			"kmon_mesh_probe_count",
+			"Total number of probes produced by source_instance and consumed by dest_instance",
+			[]string{"source_instance", "dest_instance"},
+		),
+		MeshLostProbeCount: sink.NewCounterVec(
+			"kmon_mesh_lost_probe_count",
+			"Total number of probes produced by source_instance that dest_instance never consumed, from gaps in their sequence numbers",
+			[]string{"source_instance", "dest_instance"},
+		),
+		ProbeHistoryDroppedCount: sink.NewCounterVec(
+			"kmon_probe_history_dropped_total",
+			"Total number of probe results that weren't recorded to the probe history, by reason",
+			[]string{"reason"},
+		),
+		ResultsPublishedCount: sink.NewCounterVec(
+			"kmon_results_published_total",
+			"Total number of probe results published to the results topic",
+			[]string{"topic"},
+		),
+		ResultsPublishFailureCount: sink.NewCounterVec(
+			"kmon_results_publish_failures_total",
+			"Total number of probe results that couldn't be published to the results topic, by reason",
+			[]string{"topic", "reason"},
+		),
+		Clients: clients.NewClientMetrics(sink),
+	}
+}
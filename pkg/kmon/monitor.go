@@ -4,22 +4,31 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/phuslu/log"
 	"github.com/pliu/datastructs/pkg/stats"
 	"github.com/pliu/kmon/pkg/clients"
 	"github.com/pliu/kmon/pkg/config"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pliu/kmon/pkg/metrics"
 	"github.com/twmb/franz-go/pkg/kgo"
 )
 
+// Monitor publishes probes to every partition of the monitoring topic and records their latencies.
+//
+// Concurrency model: the stats maps are populated once in NewMonitorWithClients and never mutated afterwards, so
+// they can be read from any goroutine without locking. Each stats.Stats guards its own window with an internal
+// mutex, which makes it safe for produce callbacks (run on franz-go's goroutines), the consume loop and the quantile
+// loop to add to and read from the same window concurrently. Any per-partition state added to the Monitor must
+// follow the same rule: allocate it up front and protect its contents, never the map holding it.
 type Monitor struct {
 	producerClient   clients.KgoClient
 	producerTopic    string
 	consumerClient   clients.KgoClient
-	instanceUUID     string
+	instanceID       string
 	partitions       int
 	p2bStats         map[int]*stats.Stats
 	b2cStats         map[int]*stats.Stats
@@ -27,15 +36,56 @@ type Monitor struct {
 	producerAckStats map[int]*stats.Stats
 	sampleFrequency  time.Duration
 	isMirror         bool
+	metrics          *Metrics
+	partitionBrokers []int32
+	pending          map[int]*pendingProbes
+	probeTimeout     time.Duration
+	trackingLoss     atomic.Bool
+	slos             *sloTracker
+	// Failed and lost probes are added to these windows only to count them
+	produceFailureStats map[int]*stats.Stats
+	lostStats           map[int]*stats.Stats
+	group               *consumerGroupTracker
+	txnProber           *txnProber
+	// Samples of probes in flight while throttled, by latency type
+	throttledStats   map[string]map[int]*stats.Stats
+	producerThrottle *throttleTracker
+	consumerThrottle *throttleTracker
+	excludeThrottled bool
+	// Keyed by the partition probes are produced to, even when mirroring
+	sequencers map[int]*sequencer
+	ordering   map[int]*orderingTracker
+	// Called with every probe consumed, if set before the Monitor is started
+	consumedCallback func(partition int, sentAt time.Time, e2eLatency time.Duration)
+	// No probes are sent while paused returns true, if set before the Monitor is started
+	paused func() bool
+	// Advertised on every probe if set
+	instanceName string
+	mesh         *meshTracker
+	// Probes whose key starts with runPrefix were produced by previous Monitors of this run, if set
+	runPrefix string
+	// Journals of the snapshotted windows, keyed by window, if set by journalWindows before the Monitor is started
+	journals map[*stats.Stats]*sampleJournal
+	// Called with the result of every probe once it is consumed, lost or fails to be produced, if set before the
+	// Monitor is started
+	resultCallback func(result ProbeResult)
+	// Guards partitionBrokers once the Monitor is started, as leaders are refreshed in place
+	partitionBrokersMu sync.RWMutex
 }
 
-func NewMonitorWithClients(producerClient clients.KgoClient, producerTopic string, consumerClient clients.KgoClient, instanceUUID string, partitions int, sampleFrequency time.Duration, statsWindow time.Duration, isMirror bool) *Monitor {
+const defaultProbeTimeout = 10 * time.Second
+
+var throttledLatencyTypes = []string{config.LatencyTypeE2E, config.LatencyTypeP2B, config.LatencyTypeB2C, config.LatencyTypeAck}
+
+func NewMonitorWithClients(metrics *Metrics, producerClient clients.KgoClient, producerTopic string, consumerClient clients.KgoClient, instanceID string, partitions int, sampleFrequency time.Duration, statsWindow time.Duration, isMirror bool) *Monitor {
 	m := &Monitor{
+		metrics:         metrics,
 		producerClient:  producerClient,
 		producerTopic:   producerTopic,
 		consumerClient:  consumerClient,
-		instanceUUID:    instanceUUID,
+		instanceID:      instanceID,
 		partitions:      partitions,
+		probeTimeout:    defaultProbeTimeout,
 		sampleFrequency: sampleFrequency,
 		isMirror:        isMirror,
 	}
@@ -43,41 +93,79 @@ func NewMonitorWithClients(producerClient clients.KgoClient, producerTopic strin
 	m.b2cStats = make(map[int]*stats.Stats)
 	m.e2eStats = make(map[int]*stats.Stats)
 	m.producerAckStats = make(map[int]*stats.Stats)
+	m.produceFailureStats = make(map[int]*stats.Stats)
+	m.lostStats = make(map[int]*stats.Stats)
+	m.pending = make(map[int]*pendingProbes)
+	m.sequencers = make(map[int]*sequencer)
+	m.ordering = make(map[int]*orderingTracker)
+	for p := range m.partitions {
+		m.sequencers[p] = &sequencer{}
+		m.ordering[p] = &orderingTracker{}
+	}
+	m.throttledStats = make(map[string]map[int]*stats.Stats)
+	for _, latencyType := range throttledLatencyTypes {
+		m.throttledStats[latencyType] = make(map[int]*stats.Stats)
+	}
 	if m.isMirror {
 		m.p2bStats[0] = stats.NewStats(statsWindow)
 		m.b2cStats[0] = stats.NewStats(statsWindow)
 		m.e2eStats[0] = stats.NewStats(statsWindow)
 		m.producerAckStats[0] = stats.NewStats(statsWindow)
+		m.produceFailureStats[0] = stats.NewStats(statsWindow)
+		m.lostStats[0] = stats.NewStats(statsWindow)
+		m.pending[0] = newPendingProbes()
+		for _, latencyType := range throttledLatencyTypes {
+			m.throttledStats[latencyType][0] = stats.NewStats(statsWindow)
+		}
 	} else {
 		for p := range m.partitions {
 			m.p2bStats[p] = stats.NewStats(statsWindow)
 			m.b2cStats[p] = stats.NewStats(statsWindow)
 			m.e2eStats[p] = stats.NewStats(statsWindow)
 			m.producerAckStats[p] = stats.NewStats(statsWindow)
+			m.produceFailureStats[p] = stats.NewStats(statsWindow)
+			m.lostStats[p] = stats.NewStats(statsWindow)
+			m.pending[p] = newPendingProbes()
+			for _, latencyType := range throttledLatencyTypes {
+				m.throttledStats[latencyType][p] = stats.NewStats(statsWindow)
+			}
 		}
 	}
+	m.slos = newSLOTracker(metrics, nil)
+	m.slos.attach(len(m.pending), m.labels)
 	return m
 }
 
 // TODO: Cross-cluster measurements should ignore partitions on e2e and not measure b2c
-func NewMonitorFromConfig(cfg *config.KMonConfig, partitions int) (*Monitor, error) {
+// partitionBrokers maps each partition of the monitoring topic to the broker leading it.
+func NewMonitorFromConfig(cfg *config.KMonConfig, metrics *Metrics, partitionBrokers []int32) (*Monitor, error) {
 	var producerClient *kgo.Client
 	var consumerClient *kgo.Client
 	var err error
 	isMirror := false
 
+	var group *consumerGroupTracker
+	var consumerOpts []kgo.Opt
+	if cfg.ConsumerGroup != nil {
+		group = newConsumerGroupTracker(metrics, cfg.ConsumerGroup)
+		consumerOpts = group.opts()
+	}
+
+	producerThrottle := newThrottleTracker(metrics, "producer")
+	consumerThrottle := producerThrottle
 	if cfg.ConsumerKafkaConfig == nil {
-		producerClient, err = clients.GetFranzGoClient(cfg.ProducerKafkaConfig, cfg.ProducerMonitoringTopic)
+		producerClient, err = clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleProducer, metrics.Clients, append(consumerOpts, kgo.ConsumeTopics(cfg.ProducerMonitoringTopic), kgo.WithHooks(producerThrottle))...)
 		if err != nil {
 			return nil, err
 		}
 		consumerClient = producerClient
 	} else {
-		producerClient, err = clients.GetFranzGoClient(cfg.ProducerKafkaConfig)
+		producerClient, err = clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleProducer, metrics.Clients, kgo.WithHooks(producerThrottle))
 		if err != nil {
 			return nil, err
 		}
-		consumerClient, err = clients.GetFranzGoClient(cfg.ConsumerKafkaConfig, cfg.ConsumerMonitoringTopic)
+		consumerThrottle = newThrottleTracker(metrics, "consumer")
+		consumerClient, err = clients.GetFranzGoClient(cfg.ConsumerKafkaConfig, clients.RoleConsumer, metrics.Clients, append(consumerOpts, kgo.ConsumeTopics(cfg.ConsumerMonitoringTopic), kgo.WithHooks(consumerThrottle))...)
 		if err != nil {
 			producerClient.Close()
 			return nil, err
@@ -85,11 +173,43 @@ func NewMonitorFromConfig(cfg *config.KMonConfig, partitions int) (*Monitor, err
 		isMirror = true
 	}
 
-	instanceUUID := uuid.NewString()
+	instanceName := cfg.GetInstanceName()
+	instanceID := nextInstanceID(instanceName)
 	sampleFrequency := time.Duration(cfg.GetSampleFrequencyMs()) * time.Millisecond
 	statsWindow := time.Duration(cfg.GetStatsWindowSeconds()) * time.Second
 
-	return NewMonitorWithClients(producerClient, cfg.ProducerMonitoringTopic, consumerClient, instanceUUID, partitions, sampleFrequency, statsWindow, isMirror), nil
+	m := NewMonitorWithClients(metrics, producerClient, cfg.ProducerMonitoringTopic, consumerClient, instanceID, len(partitionBrokers), sampleFrequency, statsWindow, isMirror)
+	m.partitionBrokers = partitionBrokers
+	m.probeTimeout = time.Duration(cfg.GetProbeTimeoutMs()) * time.Millisecond
+	m.slos = newSLOTracker(metrics, cfg.SLOs)
+	m.slos.attach(len(m.pending), m.labels)
+	m.group = group
+	if group != nil {
+		group.setAssignedCallback(m.resetOrdering)
+	}
+	m.producerThrottle = producerThrottle
+	m.consumerThrottle = consumerThrottle
+	m.excludeThrottled = cfg.ExcludeThrottledSamples
+	m.instanceName = instanceName
+	m.runPrefix = instanceRunPrefix(instanceName)
+	if cfg.Mesh {
+		m.mesh = newMeshTracker(metrics, m.instanceName, statsWindow)
+	}
+	if cfg.StatsSnapshot != nil {
+		m.journalWindows(statsWindow)
+	}
+
+	if cfg.TransactionalProbes != nil {
+		m.txnProber, err = newTxnProberFromConfig(cfg, metrics, len(partitionBrokers), instanceID)
+		if err != nil {
+			producerClient.Close()
+			if consumerClient != producerClient {
+				consumerClient.Close()
+			}
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
 func (m *Monitor) Start(ctx context.Context) {
@@ -97,12 +217,19 @@ func (m *Monitor) Start(ctx context.Context) {
 	if m.consumerClient != m.producerClient {
 		defer m.consumerClient.Close()
 	}
-	log.Info().Msgf("Starting monitor instance %s", m.instanceUUID)
+	log.Info().Msgf("Starting monitor instance %s", m.instanceID)
 
 	m.warmup(ctx)
 
 	go m.consumeLoop(ctx)
 	go m.updateQuantilesLoop(ctx)
+	if m.group != nil {
+		go m.group.commitLoop(ctx, m.consumerClient)
+	}
+	if m.txnProber != nil {
+		m.txnProber.paused = m.paused
+		go m.txnProber.Start(ctx)
+	}
 
 	ticker := time.NewTicker(m.sampleFrequency)
 	defer ticker.Stop()
@@ -110,7 +237,7 @@ func (m *Monitor) Start(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Info().Msgf("Stopping monitor instance %s", m.instanceUUID)
+			log.Info().Msgf("Stopping monitor instance %s", m.instanceID)
 			return
 		case <-ticker.C:
 			m.publishProbeBatch(ctx)
@@ -120,10 +247,16 @@ func (m *Monitor) Start(ctx context.Context) {
 
 func (m *Monitor) warmup(ctx context.Context) {
 	m.publishProbeBatch(ctx)
-	time.Sleep(3 * time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+	}
 }
 
 func (m *Monitor) publishProbeBatch(ctx context.Context) {
+	if m.paused != nil && m.paused() {
+		return
+	}
 	for partition := range m.partitions {
 		m.publishProbe(ctx, partition)
 	}
@@ -134,24 +267,46 @@ func (m *Monitor) publishProbe(ctx context.Context, partition int) {
 	record := &kgo.Record{
 		Topic:     m.producerTopic,
 		Partition: int32(partition),
-		Key:       []byte(m.instanceUUID),
+		Key:       []byte(m.instanceID),
 		Value:     fmt.Appendf(nil, "%d", sentAt.UnixNano()),
+		Headers:   []kgo.RecordHeader{{Key: sequenceHeader, Value: sequenceHeaderValue(partition, m.sequencers[partition].nextSequence())}},
+	}
+	if m.instanceName != "" {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: sourceHeader, Value: []byte(m.instanceName)})
+	}
+
+	p := 0
+	if !m.isMirror {
+		p = partition
+	}
+	if m.trackingLoss.Load() {
+		m.pending[p].add(sentAt)
 	}
 
 	m.producerClient.Produce(ctx, record, func(r *kgo.Record, err error) {
-		p := 0
-		if !m.isMirror {
-			p = int(r.Partition)
-		}
 		partitionLabel := m.partitionLabel(p)
+		now := time.Now()
 
 		if err != nil {
-			ProduceMessageFailureCount.WithLabelValues(partitionLabel).Inc()
+			m.metrics.ProduceMessageFailureCount.WithLabelValues(partitionLabel).Inc()
+			m.addSample(m.produceFailureStats[p], 1)
+			m.pending[p].remove(sentAt.UnixNano())
+			m.slos.recordProduceFailure(now, p)
+			result := m.newProbeResult(p, sentAt, probeProduceFailed, pendingProbe{})
+			result.Error = err.Error()
+			m.reportResult(result)
 			return
 		}
 
-		m.producerAckStats[p].Add(time.Since(sentAt).Milliseconds())
-		ProduceMessageCount.WithLabelValues(partitionLabel).Inc()
+		// Probes are tracked for loss from the first acked produce, so that a consumer that never receives anything
+		// counts every probe sent afterwards as lost
+		m.trackingLoss.Store(true)
+		ackLatency := now.Sub(sentAt).Milliseconds()
+		m.pending[p].ack(sentAt.UnixNano(), now.Sub(sentAt), r.Offset)
+		throttled := m.producerThrottle.throttledDuring(m.partitionBroker(p), sentAt, now)
+		m.addLatency(m.producerAckStats[p], config.LatencyTypeAck, p, ackLatency, throttled)
+		m.slos.recordLatency(now, p, config.LatencyTypeAck, ackLatency)
+		m.metrics.ProduceMessageCount.WithLabelValues(partitionLabel).Inc()
 	})
 }
 
@@ -168,7 +323,7 @@ func (m *Monitor) consumeLoop(ctx context.Context) {
 			}
 
 			fetches.EachError(func(topic string, partition int32, err error) {
-				ConsumeMessageCount.WithLabelValues(m.partitionLabel(int(partition))).Inc()
+				m.metrics.ConsumeMessageCount.WithLabelValues(m.partitionLabel(int(partition))).Inc()
 			})
 
 			now := time.Now()
@@ -180,8 +335,15 @@ func (m *Monitor) consumeLoop(ctx context.Context) {
 }
 
 func (m *Monitor) handleConsumedRecord(record *kgo.Record, consumeTime time.Time) {
-	// Only process messages that were generated by this instance
-	if string(record.Key) != m.instanceUUID {
+	if m.mesh != nil {
+		m.mesh.observe(record, consumeTime)
+	}
+
+	// Only process messages that were generated by this instance, including those produced by its previous Monitors
+	// during this run that were still in flight when it restarted
+	key := string(record.Key)
+	current := key == m.instanceID
+	if !current && (m.runPrefix == "" || !strings.HasPrefix(key, m.runPrefix)) {
 		return
 	}
 
@@ -190,6 +352,10 @@ func (m *Monitor) handleConsumedRecord(record *kgo.Record, consumeTime time.Time
 		// TODO: Log, metric?
 		return
 	}
+	// Sequence numbers start over with every Monitor
+	if current {
+		m.checkOrdering(record)
+	}
 	sentAt := time.Unix(0, timestamp)
 
 	partition := 0
@@ -198,17 +364,128 @@ func (m *Monitor) handleConsumedRecord(record *kgo.Record, consumeTime time.Time
 	}
 	partitionLabel := m.partitionLabel(partition)
 
-	m.b2cStats[partition].Add(consumeTime.Sub(record.Timestamp).Milliseconds())
-	m.e2eStats[partition].Add(consumeTime.Sub(sentAt).Milliseconds())
-	m.p2bStats[partition].Add(record.Timestamp.Sub(sentAt).Milliseconds())
+	b2cLatency := consumeTime.Sub(record.Timestamp)
+	e2eLatency := consumeTime.Sub(sentAt)
+	p2bLatency := record.Timestamp.Sub(sentAt)
+	throttled := m.throttledDuring(partition, sentAt, consumeTime)
+	if throttled {
+		m.metrics.ThrottledProbeCount.WithLabelValues(partitionLabel).Inc()
+	}
+	m.addLatency(m.b2cStats[partition], config.LatencyTypeB2C, partition, b2cLatency.Milliseconds(), throttled)
+	m.addLatency(m.e2eStats[partition], config.LatencyTypeE2E, partition, e2eLatency.Milliseconds(), throttled)
+	m.addLatency(m.p2bStats[partition], config.LatencyTypeP2B, partition, p2bLatency.Milliseconds(), throttled)
+
+	// A consumed probe also starts loss tracking, e.g. one produced by a previous Monitor. A probe that is no longer
+	// pending and took longer than the timeout has already been counted as lost.
+	wasTracking := m.trackingLoss.Swap(true)
+	probe, wasPending := m.pending[partition].remove(timestamp)
+	if wasPending || e2eLatency <= m.probeTimeout {
+		m.slos.recordLatency(consumeTime, partition, config.LatencyTypeB2C, b2cLatency.Milliseconds())
+		m.slos.recordLatency(consumeTime, partition, config.LatencyTypeE2E, e2eLatency.Milliseconds())
+		m.slos.recordLatency(consumeTime, partition, config.LatencyTypeP2B, p2bLatency.Milliseconds())
+	}
+
+	m.metrics.ConsumeMessageCount.WithLabelValues(partitionLabel).Inc()
+	// Every probe has a single result: one that isn't pending anymore was either never tracked, already reported as
+	// lost or consumed before. Probes of previous Monitors are never tracked by this one, and can't have been
+	// reported as lost by them before the timeout.
+	if m.resultCallback != nil && (wasPending || !wasTracking || (!current && e2eLatency <= m.probeTimeout)) {
+		result := m.newProbeResult(partition, sentAt, probeConsumed, probe)
+		offset := record.Offset
+		result.ConsumedOffset = &offset
+		// Without mirroring, probes are consumed from the partition they were produced to
+		if result.ProducedOffset == nil && !m.isMirror {
+			result.ProducedOffset = &offset
+		}
+		p2bLatencyMs, b2cLatencyMs, e2eLatencyMs := p2bLatency.Milliseconds(), b2cLatency.Milliseconds(), e2eLatency.Milliseconds()
+		result.P2BLatencyMs, result.B2CLatencyMs, result.E2ELatencyMs = &p2bLatencyMs, &b2cLatencyMs, &e2eLatencyMs
+		result.Throttled = throttled
+		m.resultCallback(result)
+	}
+	if m.consumedCallback != nil {
+		m.consumedCallback(partition, sentAt, e2eLatency)
+	}
+}
+
+// throttledDuring returns whether either monitoring client was throttled by the broker the partition's probes go
+// through at some point between from and to.
+func (m *Monitor) throttledDuring(partition int, from time.Time, to time.Time) bool {
+	broker := m.partitionBroker(partition)
+	consumerBroker := broker
+	if m.consumerThrottle != m.producerThrottle {
+		// The consumer cluster's brokers are unrelated to the producer cluster's
+		consumerBroker = anyBroker
+	}
+	return m.producerThrottle.throttledDuring(broker, from, to) || m.consumerThrottle.throttledDuring(consumerBroker, from, to)
+}
 
-	ConsumeMessageCount.WithLabelValues(partitionLabel).Inc()
+// addLatency adds a latency sample to its window. Samples taken while throttled are also added to the throttled window
+// for their latency type, and only there if throttled samples are excluded.
+func (m *Monitor) addLatency(window *stats.Stats, latencyType string, partition int, latencyMs int64, throttled bool) {
+	if throttled {
+		m.addSample(m.throttledStats[latencyType][partition], latencyMs)
+		if m.excludeThrottled {
+			return
+		}
+	}
+	m.addSample(window, latencyMs)
 }
 
 func (m *Monitor) partitionLabel(partition int) string {
 	return fmt.Sprintf("%d", partition)
 }
 
+// brokerLabel returns the broker leading the partition, which is unknown for mirrored measurements as all partitions
+// are aggregated.
+func (m *Monitor) brokerLabel(partition int) string {
+	broker := m.partitionBroker(partition)
+	if broker == anyBroker {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d", broker)
+}
+
+// partitionBroker returns the broker leading the partition, or anyBroker if it is unknown.
+func (m *Monitor) partitionBroker(partition int) int32 {
+	partitionBrokers := m.getPartitionBrokers()
+	if m.isMirror || partition >= len(partitionBrokers) {
+		return anyBroker
+	}
+	return partitionBrokers[partition]
+}
+
+// getPartitionBrokers returns the broker leading each partition, indexed by partition, which must not be modified.
+func (m *Monitor) getPartitionBrokers() []int32 {
+	m.partitionBrokersMu.RLock()
+	defer m.partitionBrokersMu.RUnlock()
+	return m.partitionBrokers
+}
+
+// setPartitionBrokers updates the broker leading each partition while the Monitor runs, so that leader changes that
+// don't change the number of partitions only relabel its measurements.
+func (m *Monitor) setPartitionBrokers(partitionBrokers []int32) {
+	m.partitionBrokersMu.Lock()
+	defer m.partitionBrokersMu.Unlock()
+	m.partitionBrokers = partitionBrokers
+}
+
+func (m *Monitor) labels(partition int) (string, string) {
+	return m.partitionLabel(partition), m.brokerLabel(partition)
+}
+
+// expireLostProbes counts every probe that has been pending for longer than the probe timeout as lost.
+func (m *Monitor) expireLostProbes(now time.Time) {
+	deadline := now.Add(-m.probeTimeout)
+	for partition, pending := range m.pending {
+		for _, probe := range pending.expire(deadline) {
+			m.metrics.ProbeLostCount.WithLabelValues(m.partitionLabel(partition)).Inc()
+			m.addSample(m.lostStats[partition], 1)
+			m.slos.recordLoss(now, partition)
+			m.reportResult(m.newProbeResult(partition, probe.sentAt, probeLost, probe))
+		}
+	}
+}
+
 func (m *Monitor) updateQuantilesLoop(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
@@ -224,22 +501,34 @@ func (m *Monitor) updateQuantilesLoop(ctx context.Context) {
 			}
 			for partition := range loopOver {
 				partitionLabel := m.partitionLabel(partition)
-				m.updateQuantiles(m.e2eStats[partition], E2EMessageLatencyQuantile, partitionLabel)
-				m.updateQuantiles(m.p2bStats[partition], P2BMessageLatencyQuantile, partitionLabel)
-				m.updateQuantiles(m.b2cStats[partition], B2CMessageLatencyQuantile, partitionLabel)
-				m.updateQuantiles(m.producerAckStats[partition], ProducerAckLatencyQuantile, partitionLabel)
+				m.updateQuantiles(m.e2eStats[partition], m.metrics.E2EMessageLatencyQuantile, partitionLabel)
+				m.updateQuantiles(m.p2bStats[partition], m.metrics.P2BMessageLatencyQuantile, partitionLabel)
+				m.updateQuantiles(m.b2cStats[partition], m.metrics.B2CMessageLatencyQuantile, partitionLabel)
+				m.updateQuantiles(m.producerAckStats[partition], m.metrics.ProducerAckLatencyQuantile, partitionLabel)
+				for _, latencyType := range throttledLatencyTypes {
+					m.updateQuantiles(m.throttledStats[latencyType][partition], m.metrics.ThrottledMessageLatencyQuantile, partitionLabel, latencyType)
+				}
+			}
+			if m.mesh != nil {
+				for source, e2eStats := range m.mesh.e2eStats() {
+					m.updateQuantiles(e2eStats, m.metrics.MeshE2ELatencyQuantile, source, m.instanceName)
+				}
 			}
+			now := time.Now()
+			m.expireLostProbes(now)
+			m.slos.update(now)
 		}
 	}
 }
 
-func (m *Monitor) updateQuantiles(stats *stats.Stats, gauge *prometheus.GaugeVec, partitionLabel string) {
+// updateQuantiles sets the gauge for every reported quantile, labeled with the given labels followed by the quantile.
+func (m *Monitor) updateQuantiles(stats *stats.Stats, gauge metrics.GaugeVec, labels ...string) {
 	percentiles := []float64{50, 99}
 	res, ok := stats.Percentile(percentiles)
 	if !ok {
 		return
 	}
 	for i, val := range percentiles {
-		gauge.WithLabelValues(partitionLabel, fmt.Sprintf("p%d", int(val))).Set(float64(res[i]))
+		gauge.WithLabelValues(append(labels, fmt.Sprintf("p%d", int(val)))...).Set(float64(res[i]))
 	}
 }
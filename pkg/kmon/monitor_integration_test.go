@@ -37,7 +37,7 @@ func TestMonitorIntegration(t *testing.T) {
 		SampleFrequencyMs:  50,
 		StatsWindowSeconds: 10,
 	}
-	m, err := NewMonitorFromConfig(cfg, partitions)
+	m, err := NewMonitorFromConfig(cfg, newTestMetrics(), make([]int32, partitions))
 	require.NoError(t, err)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
@@ -92,7 +92,7 @@ func TestMonitorIntegrationMirrored(t *testing.T) {
 		SampleFrequencyMs:  50,
 		StatsWindowSeconds: 10,
 	}
-	m, err := NewMonitorFromConfig(cfg, partitions)
+	m, err := NewMonitorFromConfig(cfg, newTestMetrics(), make([]int32, partitions))
 	require.NoError(t, err)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
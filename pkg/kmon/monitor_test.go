@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/pliu/datastructs/pkg/stats"
 	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"github.com/twmb/franz-go/pkg/kgo"
 )
@@ -18,7 +22,16 @@ import (
 // MockKgoClient is a mock implementation of the KgoClient interface
 type MockKgoClient struct {
 	clients.KgoClient
-	ProduceFunc func(context.Context, *kgo.Record, func(*kgo.Record, error))
+	ProduceFunc     func(context.Context, *kgo.Record, func(*kgo.Record, error))
+	PollFetchesFunc func(context.Context) kgo.Fetches
+	CommitFunc      func(context.Context) error
+}
+
+func (m *MockKgoClient) CommitUncommittedOffsets(ctx context.Context) error {
+	if m.CommitFunc != nil {
+		return m.CommitFunc(ctx)
+	}
+	return nil
 }
 
 func (m *MockKgoClient) Produce(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
@@ -28,16 +41,59 @@ func (m *MockKgoClient) Produce(ctx context.Context, r *kgo.Record, f func(*kgo.
 }
 
 func (m *MockKgoClient) PollFetches(ctx context.Context) kgo.Fetches {
+	if m.PollFetchesFunc != nil {
+		return m.PollFetchesFunc(ctx)
+	}
 	return kgo.Fetches{}
 }
 
 func (m *MockKgoClient) Close() {}
 
+func newTestMetrics() *Metrics {
+	m, _ := newTestMetricsWithRegistry()
+	return m
+}
+
+func newTestMetricsWithRegistry() (*Metrics, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	return NewMetrics(metrics.NewPrometheusSink(registry)), registry
+}
+
+// metricSamples returns the value of every series of the metric (the sample count for histograms), keyed by its
+// label values joined with commas.
+func metricSamples(t *testing.T, registry *prometheus.Registry, name string) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	samples := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := []string{}
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetValue())
+			}
+			key := strings.Join(labels, ",")
+			switch {
+			case metric.Counter != nil:
+				samples[key] = metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				samples[key] = metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				samples[key] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return samples
+}
+
 func TestHandleConsumedRecord(t *testing.T) {
 	// Create a Monitor instance with mock clients
 	partitions := 3
 	numMsgs := 400
-	m := NewMonitorWithClients(&MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
 
 	// Create a stats object to record the latency of the handleConsumedRecord function
 	handleConsumedRecordStats := stats.NewStatsWithClock(1*time.Second, clock.NewMock())
@@ -95,11 +151,41 @@ func TestHandleConsumedRecord(t *testing.T) {
 	}
 }
 
+func TestHandleConsumedRecordPreviousMonitor(t *testing.T) {
+	previousID := nextInstanceID("kmon-a")
+	instanceID := nextInstanceID("kmon-a")
+	require.True(t, strings.HasPrefix(instanceID, instanceRunPrefix("kmon-a")))
+	require.NotEqual(t, previousID, instanceID)
+
+	metrics, registry := newTestMetricsWithRegistry()
+	m := NewMonitorWithClients(metrics, &MockKgoClient{}, "", &MockKgoClient{}, instanceID, 1, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m.runPrefix = instanceRunPrefix("kmon-a")
+
+	consume := func(key string, sequence int64) {
+		m.handleConsumedRecord(&kgo.Record{
+			Key:     []byte(key),
+			Offset:  sequence,
+			Value:   []byte(fmt.Sprintf("%d", time.Now().UnixNano())),
+			Headers: []kgo.RecordHeader{{Key: sequenceHeader, Value: sequenceHeaderValue(0, sequence)}},
+		}, time.Now())
+	}
+	consume(instanceID, 1)
+	// Probes still in flight from the previous Monitor of this run are measured, without checking their ordering
+	consume(previousID, 50)
+	consume(instanceID, 2)
+	// Probes of other instances and of previous runs are ignored
+	consume("kmon-b"+previousID[len("kmon-a"):], 3)
+	consume("kmon-a/1/1", 4)
+
+	require.Equal(t, 3, m.e2eStats[0].Len())
+	require.Empty(t, metricSamples(t, registry, "kmon_ordering_violations_total"))
+}
+
 func TestHandleConsumedRecordMirrored(t *testing.T) {
 	// Create a Monitor instance with mock clients
 	partitions := 3
 	numMsgs := 400
-	m := NewMonitorWithClients(&MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, true)
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, true)
 
 	// Create a stats object to record the latency of the handleConsumedRecord function
 	handleConsumedRecordStats := stats.NewStatsWithClock(1*time.Second, clock.NewMock())
@@ -170,7 +256,7 @@ func TestPublishProbeBatch(t *testing.T) {
 
 	// Create monitor with multiple partitions
 	partitions := 3
-	m := NewMonitorWithClients(mockProducerClient, "test-topic", nil, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m := NewMonitorWithClients(newTestMetrics(), mockProducerClient, "test-topic", nil, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
 
 	// Call publishProbeBatch which should call publishProbe for each partition
 	ctx := context.Background()
@@ -214,7 +300,7 @@ func TestPublishProbeBatchMirrored(t *testing.T) {
 
 	// Create monitor with multiple partitions
 	partitions := 3
-	m := NewMonitorWithClients(mockProducerClient, "test-topic", nil, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, true)
+	m := NewMonitorWithClients(newTestMetrics(), mockProducerClient, "test-topic", nil, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, true)
 
 	// Call publishProbeBatch which should call publishProbe for each partition
 	ctx := context.Background()
@@ -242,3 +328,88 @@ func TestPublishProbeBatchMirrored(t *testing.T) {
 	require.Equal(t, 1, len(m.producerAckStats))
 	require.Equal(t, 3, m.producerAckStats[0].Len())
 }
+
+// TestMonitorConcurrentAccess is meant to be run with -race: it acks probes from many goroutines, as franz-go does,
+// while the consume loop and the quantile loop work on the same stats windows.
+func TestMonitorConcurrentAccess(t *testing.T) {
+	partitions := 3
+	numBatches := 200
+	consumed := make(chan *kgo.Record, partitions*numBatches)
+
+	var callbacks sync.WaitGroup
+	mockClient := &MockKgoClient{
+		ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+			callbacks.Add(1)
+			go func() {
+				defer callbacks.Done()
+				r.Timestamp = time.Now()
+				f(r, nil)
+				consumed <- r
+			}()
+		},
+		PollFetchesFunc: func(ctx context.Context) kgo.Fetches {
+			select {
+			case <-ctx.Done():
+				return kgo.Fetches{}
+			case r := <-consumed:
+				return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+					Topic:      r.Topic,
+					Partitions: []kgo.FetchPartition{{Partition: r.Partition, Records: []*kgo.Record{r}}},
+				}}}}
+			}
+		},
+	}
+	m := NewMonitorWithClients(newTestMetrics(), mockClient, "test-topic", mockClient, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var loops sync.WaitGroup
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		m.consumeLoop(ctx)
+	}()
+	go func() {
+		defer loops.Done()
+		m.updateQuantilesLoop(ctx)
+	}()
+
+	var producers sync.WaitGroup
+	// Leaders are refreshed in place while probing
+	producers.Add(1)
+	go func() {
+		defer producers.Done()
+		for i := range numBatches {
+			m.setPartitionBrokers([]int32{int32(i % 2), 1, 2})
+		}
+	}()
+	for range 4 {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			for range numBatches / 4 {
+				m.publishProbeBatch(ctx)
+			}
+		}()
+	}
+	producers.Wait()
+	callbacks.Wait()
+
+	require.Eventually(t, func() bool {
+		for p := range partitions {
+			if m.e2eStats[p].Len() != numBatches {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for p := range partitions {
+		require.Equal(t, numBatches, m.producerAckStats[p].Len())
+		require.Equal(t, numBatches, m.b2cStats[p].Len())
+		require.Equal(t, numBatches, m.p2bStats[p].Len())
+	}
+	require.Equal(t, "1", m.brokerLabel(0))
+
+	cancel()
+	loops.Wait()
+}
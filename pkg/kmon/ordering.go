@@ -0,0 +1,120 @@
+package kmon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/phuslu/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Probes carry a per-partition sequence number in this header, formatted as "<partition>/<sequence>" with the
+// partition the probe was produced to, which may differ from the one it is consumed from when mirroring.
+const sequenceHeader = "kmon-seq"
+
+func sequenceHeaderValue(partition int, sequence int64) []byte {
+	return fmt.Appendf(nil, "%d/%d", partition, sequence)
+}
+
+// parseSequenceHeader returns the partition the record was produced to and its sequence number, or false if the
+// record doesn't have a valid sequence header.
+func parseSequenceHeader(record *kgo.Record) (int, int64, bool) {
+	for _, header := range record.Headers {
+		if header.Key != sequenceHeader {
+			continue
+		}
+		partitionStr, sequenceStr, found := strings.Cut(string(header.Value), "/")
+		if !found {
+			return 0, 0, false
+		}
+		partition, err := strconv.Atoi(partitionStr)
+		if err != nil {
+			return 0, 0, false
+		}
+		sequence, err := strconv.ParseInt(sequenceStr, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		return partition, sequence, true
+	}
+	return 0, 0, false
+}
+
+// sequencer hands out increasing sequence numbers for the probes produced to a partition.
+type sequencer struct {
+	next atomic.Int64
+}
+
+func (s *sequencer) nextSequence() int64 {
+	return s.next.Add(1)
+}
+
+// orderingTracker remembers the last probe consumed from a partition to detect probes arriving out of order.
+type orderingTracker struct {
+	mu         sync.Mutex
+	seen       bool
+	lastSeq    int64
+	lastOffset int64
+}
+
+// observe records the consumed probe and returns a description of the ordering violation it causes, if any. Offsets
+// are only compared if checkOffsets is set, as mirrored probes from one partition may be consumed from several.
+// Duplicate sequence numbers aren't ordering violations, so they are ignored.
+func (t *orderingTracker) observe(sequence int64, offset int64, checkOffsets bool) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.seen {
+		t.seen = true
+		t.lastSeq, t.lastOffset = sequence, offset
+		return "", false
+	}
+
+	var violation string
+	if sequence < t.lastSeq {
+		violation = fmt.Sprintf("sequence %d (offset %d) consumed after sequence %d (offset %d)", sequence, offset, t.lastSeq, t.lastOffset)
+	} else if checkOffsets && offset <= t.lastOffset {
+		violation = fmt.Sprintf("offset %d (sequence %d) consumed after offset %d (sequence %d)", offset, sequence, t.lastOffset, t.lastSeq)
+	}
+	if violation != "" {
+		return violation, true
+	}
+	t.lastSeq, t.lastOffset = sequence, offset
+	return "", false
+}
+
+// reset forgets the last probe consumed, so that the next one is compared with nothing.
+func (t *orderingTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen = false
+}
+
+// resetOrdering forgets the last probe consumed from every partition. A consumer group resumes from its last
+// committed offsets after a rebalance, re-consuming probes that were already seen, which aren't ordering violations.
+func (m *Monitor) resetOrdering() {
+	for _, tracker := range m.ordering {
+		tracker.reset()
+	}
+}
+
+// checkOrdering records the consumed probe against the partition it was produced to and reports it if it arrived out
+// of order.
+func (m *Monitor) checkOrdering(record *kgo.Record) {
+	partition, sequence, ok := parseSequenceHeader(record)
+	if !ok {
+		return
+	}
+	tracker, exists := m.ordering[partition]
+	if !exists {
+		return
+	}
+
+	if violation, found := tracker.observe(sequence, record.Offset, !m.isMirror); found {
+		m.metrics.OrderingViolationCount.WithLabelValues(m.partitionLabel(partition)).Inc()
+		log.Warn().Msgf("Ordering violation on partition %d: %s", partition, violation)
+	}
+}
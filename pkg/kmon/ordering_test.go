@@ -0,0 +1,94 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestOrderingTracker(t *testing.T) {
+	tracker := &orderingTracker{}
+
+	_, found := tracker.observe(1, 10, true)
+	require.False(t, found)
+	_, found = tracker.observe(2, 11, true)
+	require.False(t, found)
+	// Duplicates aren't ordering violations
+	_, found = tracker.observe(2, 12, true)
+	require.False(t, found)
+
+	violation, found := tracker.observe(1, 13, true)
+	require.True(t, found)
+	require.Equal(t, "sequence 1 (offset 13) consumed after sequence 2 (offset 12)", violation)
+
+	violation, found = tracker.observe(3, 12, true)
+	require.True(t, found)
+	require.Equal(t, "offset 12 (sequence 3) consumed after offset 12 (sequence 2)", violation)
+	_, found = tracker.observe(3, 12, false)
+	require.False(t, found)
+}
+
+func TestHandleConsumedRecordOrdering(t *testing.T) {
+	for _, isMirror := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mirror=%t", isMirror), func(t *testing.T) {
+			metrics, registry := newTestMetricsWithRegistry()
+			produced := []*kgo.Record{}
+			producer := &MockKgoClient{
+				ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+					produced = append(produced, r)
+				},
+			}
+			m := NewMonitorWithClients(metrics, producer, "", &MockKgoClient{}, "test-uuid", 2, time.Duration(1), 5*time.Minute, isMirror)
+			for range 3 {
+				m.publishProbeBatch(context.Background())
+			}
+
+			// Partition 0's second and third probes are swapped, partition 1's are in order
+			order := []int{0, 1, 4, 2, 3, 5}
+			for offset, i := range order {
+				record := produced[i]
+				record.Offset = int64(offset)
+				m.handleConsumedRecord(record, time.Now())
+			}
+
+			require.Equal(t, map[string]float64{"0": 1}, metricSamples(t, registry, "kmon_ordering_violations_total"))
+		})
+	}
+}
+
+func TestHandleConsumedRecordOrderingAfterRebalance(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	produced := []*kgo.Record{}
+	producer := &MockKgoClient{
+		ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+			produced = append(produced, r)
+		},
+	}
+	m := NewMonitorWithClients(metrics, producer, "", &MockKgoClient{}, "test-uuid", 1, time.Duration(1), 5*time.Minute, false)
+	m.group = newConsumerGroupTracker(metrics, &config.ConsumerGroupConfig{GroupID: "kmon-test"})
+	m.group.setAssignedCallback(m.resetOrdering)
+	for range 3 {
+		m.publishProbeBatch(context.Background())
+	}
+	for offset, record := range produced {
+		record.Offset = int64(offset)
+		m.handleConsumedRecord(record, time.Now())
+	}
+
+	// After a rebalance, the group resumes from its last committed offset and re-delivers the probes after it
+	m.group.onRevoked(context.Background(), nil, nil)
+	m.group.onAssigned(context.Background(), nil, nil)
+	for _, record := range produced[1:] {
+		m.handleConsumedRecord(record, time.Now())
+	}
+	require.Empty(t, metricSamples(t, registry, "kmon_ordering_violations_total"))
+
+	// Without a rebalance, a re-delivered probe is still a violation
+	m.handleConsumedRecord(produced[1], time.Now())
+	require.Equal(t, map[string]float64{"0": 1}, metricSamples(t, registry, "kmon_ordering_violations_total"))
+}
@@ -0,0 +1,107 @@
+package kmon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/phuslu/log"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+)
+
+// Kafka doesn't accept arbitrary topic configs, so topics created by kmon are marked by committing partition 0's
+// offset to a dedicated group, with the owner in the commit's metadata. The coordinator drops the commit along with
+// the topic when it's deleted, so a marker never outlives its topic.
+const ownershipGroupPrefix = "kmon-owner-"
+
+func ownershipGroup(topic string) string {
+	return ownershipGroupPrefix + topic
+}
+
+// monitoringTopicOwner is the owner recorded on the topics kmon creates for a monitoring topic.
+func monitoringTopicOwner(monitoringTopic string) string {
+	return "kmon/" + monitoringTopic
+}
+
+func markTopicOwner(ctx context.Context, admClient *kadm.Client, topic string, owner string) error {
+	offsets := kadm.Offsets{}
+	offsets.Add(kadm.Offset{Topic: topic, Partition: 0, At: 0, LeaderEpoch: -1, Metadata: owner})
+	resp, err := admClient.CommitOffsets(ctx, ownershipGroup(topic), offsets)
+	if err != nil {
+		return err
+	}
+	return resp.Error()
+}
+
+// getTopicOwner returns the owner recorded for the topic, or an empty string if the topic isn't marked.
+func getTopicOwner(ctx context.Context, admClient *kadm.Client, topic string) (string, error) {
+	resp, err := admClient.FetchOffsets(ctx, ownershipGroup(topic))
+	if err != nil {
+		return "", err
+	}
+	offset, exists := resp.Lookup(topic, 0)
+	if !exists {
+		return "", nil
+	}
+	if offset.Err != nil {
+		return "", offset.Err
+	}
+	return offset.Metadata, nil
+}
+
+// ownsTopic returns whether the monitoring topic is kmon's given its recorded owner. A topic this process created is
+// kmon's even if it isn't marked yet.
+func (tm *TopicManager) ownsTopic(owner string) bool {
+	return owner == tm.owner || (owner == "" && tm.createdTopic)
+}
+
+// markCreatedTopic marks the topic this process just created, retrying until it succeeds or ctx is done. Until then,
+// the topic is only known to be kmon's by this process.
+func (tm *TopicManager) markCreatedTopic(ctx context.Context) error {
+	for {
+		err := markTopicOwner(ctx, tm.admClient, tm.topicName, tm.owner)
+		if err == nil {
+			return nil
+		}
+		log.Warn().Err(err).Msgf("failed to mark topic %s as kmon's - retrying in 1s", tm.topicName)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// verifyOwnership returns an error unless the monitoring topic is kmon's, marking it if it was created by this process
+// but not marked yet. With adoptTopic set, a topic that isn't kmon's is marked instead, taking it over.
+func (tm *TopicManager) verifyOwnership(ctx context.Context) error {
+	owner, err := getTopicOwner(ctx, tm.admClient, tm.topicName)
+	if err != nil {
+		return err
+	}
+	if owner == tm.owner {
+		return nil
+	}
+	if tm.ownsTopic(owner) {
+		return tm.markCreatedTopic(ctx)
+	}
+	if tm.adoptTopic {
+		log.Warn().Msgf("Adopting topic %s, which was owned by %q", tm.topicName, owner)
+		return markTopicOwner(ctx, tm.admClient, tm.topicName, tm.owner)
+	}
+
+	tm.metrics.TopicOwnershipRefusalCount.WithLabelValues(tm.topicName).Inc()
+	log.Error().Msgf("Refusing to modify topic %s as it is owned by %q instead of %q", tm.topicName, owner, tm.owner)
+	return fmt.Errorf("topic %s is owned by %q instead of %q, set adoptTopic to take it over", tm.topicName, owner, tm.owner)
+}
+
+// refreshOwnership re-commits the marker of a topic owned by kmon. The coordinator expires the offsets of groups
+// without members after offsets.retention.minutes, so the marker must be refreshed more often than that.
+func (tm *TopicManager) refreshOwnership(ctx context.Context) error {
+	owner, err := getTopicOwner(ctx, tm.admClient, tm.topicName)
+	if err != nil || !tm.ownsTopic(owner) {
+		return err
+	}
+	return markTopicOwner(ctx, tm.admClient, tm.topicName, tm.owner)
+}
@@ -0,0 +1,68 @@
+package kmon
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingProbes tracks the probes of a single partition that have been sent but not consumed yet, keyed by the send
+// timestamp carried in the probe, so that probes that never arrive can be counted as lost.
+type pendingProbes struct {
+	mu     sync.Mutex
+	probes map[int64]*pendingProbe
+}
+
+type pendingProbe struct {
+	sentAt time.Time
+	// Set once the probe is acked
+	acked      bool
+	ackLatency time.Duration
+	offset     int64
+}
+
+func newPendingProbes() *pendingProbes {
+	return &pendingProbes{probes: make(map[int64]*pendingProbe)}
+}
+
+func (p *pendingProbes) add(sentAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probes[sentAt.UnixNano()] = &pendingProbe{sentAt: sentAt}
+}
+
+// ack records the ack of the probe, if it is still pending.
+func (p *pendingProbes) ack(sentAtNanos int64, ackLatency time.Duration, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if probe, ok := p.probes[sentAtNanos]; ok {
+		probe.acked = true
+		probe.ackLatency = ackLatency
+		probe.offset = offset
+	}
+}
+
+// remove removes the probe and returns it, along with whether it was still pending.
+func (p *pendingProbes) remove(sentAtNanos int64) (pendingProbe, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	probe, ok := p.probes[sentAtNanos]
+	if !ok {
+		return pendingProbe{}, false
+	}
+	delete(p.probes, sentAtNanos)
+	return *probe, true
+}
+
+// expire removes and returns the probes that were sent before the deadline.
+func (p *pendingProbes) expire(deadline time.Time) []pendingProbe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var expired []pendingProbe
+	for key, probe := range p.probes {
+		if probe.sentAt.Before(deadline) {
+			delete(p.probes, key)
+			expired = append(expired, *probe)
+		}
+	}
+	return expired
+}
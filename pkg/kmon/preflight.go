@@ -0,0 +1,435 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+const (
+	preflightCheckConnectivity = "connectivity"
+	preflightCheckClusterID    = "cluster_id"
+	preflightCheckPermission   = "permission"
+
+	preflightPassed = "passed"
+	preflightFailed = "failed"
+	// Permissions that can't be checked yet, e.g. on a topic that doesn't exist, are unverified rather than failed
+	preflightUnverified = "unverified"
+
+	preflightTimeout = 10 * time.Second
+)
+
+// PreflightReport is the outcome of the connectivity and permission checks kmon runs at startup and periodically after.
+type PreflightReport struct {
+	CheckedAt time.Time         `json:"checkedAt"`
+	Passed    bool              `json:"passed"`
+	Checks    []*PreflightCheck `json:"checks"`
+}
+
+// PreflightCheck is a single preflight check. Resource is a seed broker for connectivity checks and a resource such
+// as topic:<name> or group:<name> for permission checks, in which case Operation is the ACL operation required on it.
+type PreflightCheck struct {
+	Cluster   string `json:"cluster"`
+	Check     string `json:"check"`
+	Resource  string `json:"resource"`
+	Operation string `json:"operation,omitempty"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// preflightPermissions are the operations kmon needs on the resources of one cluster given its config.
+type preflightPermissions struct {
+	cluster  []kmsg.ACLOperation
+	topic    string
+	topicOps []kmsg.ACLOperation
+	groups   []preflightGroup
+}
+
+type preflightGroup struct {
+	group string
+	ops   []kmsg.ACLOperation
+}
+
+// requiredPermissions returns the permissions kmon needs on the producer cluster and, when mirroring, on the consumer
+// cluster (nil otherwise). The groups of the canaries and transactional IDs are not covered, as their names are
+// derived from the cluster's coordinators.
+func requiredPermissions(cfg *config.KMonConfig) (*preflightPermissions, *preflightPermissions) {
+	mirror := cfg.ConsumerKafkaConfig != nil
+	managesTopic := cfg.ReadOnly == nil && !cfg.DryRun
+
+	producer := &preflightPermissions{
+		topic:    cfg.ProducerMonitoringTopic,
+		topicOps: []kmsg.ACLOperation{kmsg.ACLOperationDescribe, kmsg.ACLOperationWrite},
+	}
+	if !mirror {
+		producer.topicOps = append(producer.topicOps, kmsg.ACLOperationRead)
+	}
+	if cfg.ReadOnly == nil {
+		producer.topicOps = append(producer.topicOps, kmsg.ACLOperationDescribeConfigs)
+	}
+	if managesTopic {
+		// Partitions are reassigned through the cluster, and added and altered through the topic
+		producer.cluster = []kmsg.ACLOperation{kmsg.ACLOperationAlter}
+		producer.topicOps = append(producer.topicOps, kmsg.ACLOperationCreate, kmsg.ACLOperationDelete, kmsg.ACLOperationAlter, kmsg.ACLOperationAlterConfigs)
+		// Ownership is recorded as an offset commit
+		producer.groups = append(producer.groups, preflightGroup{ownershipGroup(cfg.ProducerMonitoringTopic), []kmsg.ACLOperation{kmsg.ACLOperationRead}})
+	}
+	if cfg.HighAvailability != nil {
+		producer.groups = append(producer.groups, preflightGroup{cfg.HighAvailability.GetLeaseTopic(cfg.ProducerMonitoringTopic), []kmsg.ACLOperation{kmsg.ACLOperationRead}})
+	}
+	if !mirror {
+		if cfg.ConsumerGroup != nil {
+			producer.groups = append(producer.groups, preflightGroup{cfg.ConsumerGroup.GroupID, []kmsg.ACLOperation{kmsg.ACLOperationRead}})
+		}
+		return producer, nil
+	}
+
+	consumer := &preflightPermissions{
+		topic:    cfg.ConsumerMonitoringTopic,
+		topicOps: []kmsg.ACLOperation{kmsg.ACLOperationDescribe, kmsg.ACLOperationRead},
+	}
+	if cfg.ConsumerGroup != nil {
+		consumer.groups = append(consumer.groups, preflightGroup{cfg.ConsumerGroup.GroupID, []kmsg.ACLOperation{kmsg.ACLOperationRead}})
+	}
+	return producer, consumer
+}
+
+// RunPreflight checks that every seed broker is reachable, looks up the ID of every cluster and checks, through the
+// authorized operations brokers report, that kmon has the permissions its config requires. Failures are exported as
+// kmon_preflight_failure, labeled with the missing permission.
+func RunPreflight(ctx context.Context, cfg *config.KMonConfig, metrics *Metrics) *PreflightReport {
+	report := &PreflightReport{CheckedAt: time.Now()}
+	producerPermissions, consumerPermissions := requiredPermissions(cfg)
+	report.Checks = append(report.Checks, preflightCluster(ctx, "producer", cfg.ProducerKafkaConfig, producerPermissions)...)
+	if consumerPermissions != nil {
+		report.Checks = append(report.Checks, preflightCluster(ctx, "consumer", cfg.ConsumerKafkaConfig, consumerPermissions)...)
+	}
+
+	report.Passed = true
+	for _, check := range report.Checks {
+		failed := 0.0
+		if check.Status == preflightFailed {
+			failed = 1
+			report.Passed = false
+		}
+		labels := check.labels()
+		metrics.PreflightFailure.WithLabelValues(labels[:]...).Set(failed)
+	}
+	return report
+}
+
+// log logs the report as a table, as an error if any check failed.
+func (r *PreflightReport) log() {
+	var table strings.Builder
+	if err := r.WriteTable(&table); err != nil {
+		log.Error().Err(err).Msg("failed to format preflight report")
+		return
+	}
+	if r.Passed {
+		log.Info().Msgf("Preflight checks passed:\n%s", table.String())
+	} else {
+		log.Error().Msgf("Preflight checks failed, kmon may not work until the failures are fixed:\n%s", table.String())
+	}
+}
+
+// preflighter re-runs the preflight checks every interval, so that the report served on /status and
+// kmon_preflight_failure reflect permissions granted or revoked since startup.
+type preflighter struct {
+	cfg      *config.KMonConfig
+	metrics  *Metrics
+	interval time.Duration
+
+	mu     sync.Mutex
+	report *PreflightReport
+}
+
+func newPreflighter(cfg *config.KMonConfig, metrics *Metrics) *preflighter {
+	return &preflighter{
+		cfg:      cfg,
+		metrics:  metrics,
+		interval: time.Duration(cfg.GetPreflightIntervalSeconds()) * time.Second,
+	}
+}
+
+func (p *preflighter) Start(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.run(ctx)
+		}
+	}
+}
+
+func (p *preflighter) run(ctx context.Context) {
+	p.update(RunPreflight(ctx, p.cfg, p.metrics))
+}
+
+// update replaces the last report. The report is logged when it is the first one or when its failures changed, so
+// that failures that persist aren't logged on every run.
+func (p *preflighter) update(report *PreflightReport) {
+	p.mu.Lock()
+	previous := p.report
+	p.report = report
+	p.mu.Unlock()
+
+	if previous == nil {
+		report.log()
+		return
+	}
+	// Checks the last report had and this one doesn't are reset, rather than left failing forever
+	current := make(map[[4]string]bool, len(report.Checks))
+	for _, check := range report.Checks {
+		current[check.labels()] = true
+	}
+	for _, check := range previous.Checks {
+		if labels := check.labels(); !current[labels] {
+			p.metrics.PreflightFailure.WithLabelValues(labels[:]...).Set(0)
+		}
+	}
+	if report.failures() != previous.failures() {
+		report.log()
+	}
+}
+
+// getReport returns the last report.
+func (p *preflighter) getReport() *PreflightReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.report
+}
+
+func (c *PreflightCheck) labels() [4]string {
+	return [4]string{c.Cluster, c.Check, c.Resource, c.Operation}
+}
+
+// failures returns the failed checks of the report, one per line.
+func (r *PreflightReport) failures() string {
+	var failures strings.Builder
+	for _, check := range r.Checks {
+		if check.Status == preflightFailed {
+			labels := check.labels()
+			fmt.Fprintln(&failures, strings.Join(labels[:], " "))
+		}
+	}
+	return failures.String()
+}
+
+func preflightCluster(ctx context.Context, cluster string, cfg *config.KafkaConfig, permissions *preflightPermissions) []*PreflightCheck {
+	var checks []*PreflightCheck
+	for _, seed := range cfg.SeedBrokers {
+		check := &PreflightCheck{Cluster: cluster, Check: preflightCheckConnectivity, Resource: seed, Status: preflightPassed}
+		if err := pingSeedBroker(ctx, cfg, seed); err != nil {
+			check.Status, check.Detail = preflightFailed, err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	clusterIDCheck := &PreflightCheck{Cluster: cluster, Check: preflightCheckClusterID, Resource: "cluster"}
+	checks = append(checks, clusterIDCheck)
+
+	// Permissions default to unverified, in case the cluster can't be reached at all
+	permissionChecks := map[string]map[kmsg.ACLOperation]*PreflightCheck{}
+	addPermissionChecks := func(resource string, ops []kmsg.ACLOperation) {
+		permissionChecks[resource] = map[kmsg.ACLOperation]*PreflightCheck{}
+		for _, op := range ops {
+			check := &PreflightCheck{Cluster: cluster, Check: preflightCheckPermission, Resource: resource, Operation: op.String(), Status: preflightUnverified}
+			permissionChecks[resource][op] = check
+			checks = append(checks, check)
+		}
+	}
+	clusterResource, topicResource := "cluster", "topic:"+permissions.topic
+	addPermissionChecks(clusterResource, permissions.cluster)
+	addPermissionChecks(topicResource, permissions.topicOps)
+	for _, g := range permissions.groups {
+		addPermissionChecks("group:"+g.group, g.ops)
+	}
+
+	client, err := clients.GetFranzGoClient(cfg, clients.RoleAdmin, nil)
+	if err != nil {
+		clusterIDCheck.Status, clusterIDCheck.Detail = preflightFailed, err.Error()
+		return checks
+	}
+	defer client.Close()
+
+	metadataReq := kmsg.NewPtrMetadataRequest()
+	metadataReq.AllowAutoTopicCreation = false
+	metadataReq.IncludeTopicAuthorizedOperations = true
+	metadataTopic := kmsg.NewMetadataRequestTopic()
+	metadataTopic.Topic = kmsg.StringPtr(permissions.topic)
+	metadataReq.Topics = append(metadataReq.Topics, metadataTopic)
+	metadataResp, err := metadataReq.RequestWith(ctx, client)
+	if err != nil {
+		clusterIDCheck.Status, clusterIDCheck.Detail = preflightFailed, err.Error()
+		return checks
+	}
+	if metadataResp.ClusterID == nil {
+		clusterIDCheck.Status, clusterIDCheck.Detail = preflightUnverified, "brokers don't report a cluster ID"
+	} else if cfg.ClusterID != "" && *metadataResp.ClusterID != cfg.ClusterID {
+		clusterIDCheck.Status, clusterIDCheck.Detail = preflightFailed, fmt.Sprintf("%s instead of %s", *metadataResp.ClusterID, cfg.ClusterID)
+	} else {
+		clusterIDCheck.Status, clusterIDCheck.Detail = preflightPassed, *metadataResp.ClusterID
+	}
+
+	if len(permissions.cluster) > 0 {
+		describeReq := kmsg.NewPtrDescribeClusterRequest()
+		describeReq.IncludeClusterAuthorizedOperations = true
+		describeResp, err := describeReq.RequestWith(ctx, client)
+		if err == nil {
+			err = kerr.ErrorForCode(describeResp.ErrorCode)
+		}
+		if err != nil {
+			markPermissionChecks(permissionChecks[clusterResource], err)
+		} else {
+			evaluatePermissionChecks(permissionChecks[clusterResource], describeResp.ClusterAuthorizedOperations)
+		}
+	}
+
+	for _, t := range metadataResp.Topics {
+		err := kerr.ErrorForCode(t.ErrorCode)
+		switch {
+		case errors.Is(err, kerr.UnknownTopicOrPartition):
+			checkTopicCreation(ctx, client, permissions.topic, permissionChecks[topicResource])
+		case err != nil:
+			markPermissionChecks(permissionChecks[topicResource], err)
+		default:
+			evaluatePermissionChecks(permissionChecks[topicResource], t.AuthorizedOperations)
+		}
+	}
+
+	for _, g := range permissions.groups {
+		groupChecks := permissionChecks["group:"+g.group]
+		describeReq := kmsg.NewPtrDescribeGroupsRequest()
+		describeReq.Groups = []string{g.group}
+		describeReq.IncludeAuthorizedOperations = true
+		describeResp, err := describeReq.RequestWith(ctx, client)
+		if err == nil && len(describeResp.Groups) == 0 {
+			err = errors.New("group missing from DescribeGroups response")
+		}
+		if err == nil {
+			err = kerr.ErrorForCode(describeResp.Groups[0].ErrorCode)
+		}
+		if err != nil {
+			markPermissionChecks(groupChecks, err)
+		} else {
+			evaluatePermissionChecks(groupChecks, describeResp.Groups[0].AuthorizedOperations)
+		}
+	}
+	return checks
+}
+
+// pingSeedBroker sends an ApiVersions request through a client that only knows the given seed broker.
+func pingSeedBroker(ctx context.Context, cfg *config.KafkaConfig, seed string) error {
+	client, err := clients.GetFranzGoClient(&config.KafkaConfig{SeedBrokers: []string{seed}, ClientID: cfg.ClientID}, clients.RoleAdmin, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	_, err = kmsg.NewPtrApiVersionsRequest().RequestWith(ctx, client)
+	return err
+}
+
+// checkTopicCreation checks that the topic can be created by validating its creation without creating it. Being told
+// that the topic doesn't exist means that it can be described, while every other operation can only be checked once
+// the topic exists.
+func checkTopicCreation(ctx context.Context, client *kgo.Client, topic string, checks map[kmsg.ACLOperation]*PreflightCheck) {
+	for op, check := range checks {
+		switch op {
+		case kmsg.ACLOperationDescribe:
+			check.Status = preflightPassed
+		case kmsg.ACLOperationCreate:
+		default:
+			check.Detail = "topic doesn't exist yet"
+		}
+	}
+	createCheck, ok := checks[kmsg.ACLOperationCreate]
+	if !ok {
+		return
+	}
+
+	resps, err := kadm.NewClient(client).ValidateCreateTopics(ctx, 1, -1, nil, topic)
+	if err == nil {
+		err = resps[topic].Err
+	}
+	// Being rejected by a creation policy still means that creation is authorized
+	switch {
+	case err == nil, errors.Is(err, kerr.PolicyViolation), errors.Is(err, kerr.TopicAlreadyExists):
+		createCheck.Status = preflightPassed
+	case isAuthorizationError(err):
+		createCheck.Status, createCheck.Detail = preflightFailed, err.Error()
+	default:
+		createCheck.Detail = err.Error()
+	}
+}
+
+// evaluatePermissionChecks grades checks against a bitfield of authorized operations, in which the broker already
+// accounts for operations implied by others (e.g. Describe by Read) and for ALL.
+func evaluatePermissionChecks(checks map[kmsg.ACLOperation]*PreflightCheck, authorizedOperations int32) {
+	for op, check := range checks {
+		switch {
+		case authorizedOperations == math.MinInt32:
+			check.Status, check.Detail = preflightUnverified, "brokers don't report authorized operations"
+		case authorizedOperations&(1<<op) != 0:
+			check.Status = preflightPassed
+		default:
+			check.Status, check.Detail = preflightFailed, "not authorized"
+		}
+	}
+}
+
+// markPermissionChecks fails checks if err is an authorization error, and otherwise leaves them unverified.
+func markPermissionChecks(checks map[kmsg.ACLOperation]*PreflightCheck, err error) {
+	for _, check := range checks {
+		check.Detail = err.Error()
+		if isAuthorizationError(err) {
+			check.Status = preflightFailed
+		}
+	}
+}
+
+func isAuthorizationError(err error) bool {
+	return errors.Is(err, kerr.TopicAuthorizationFailed) || errors.Is(err, kerr.GroupAuthorizationFailed) || errors.Is(err, kerr.ClusterAuthorizationFailed)
+}
+
+// WriteTable writes the report as a human readable table.
+func (r *PreflightReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tCHECK\tRESOURCE\tOPERATION\tSTATUS\tDETAIL")
+	for _, c := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Cluster, c.Check, c.Resource, c.Operation, strings.ToUpper(c.Status), c.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	result := "PASSED"
+	if !r.Passed {
+		result = "FAILED"
+	}
+	_, err := fmt.Fprintf(w, "\nPreflight %s\n", result)
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build integration
+
+package kmon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPreflight(t *testing.T) {
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: "kmon-preflight",
+		ProducerKafkaConfig: &config.KafkaConfig{
+			SeedBrokers: []string{"localhost:10000", "localhost:10001", "localhost:10002"},
+		},
+	}
+
+	report := RunPreflight(context.Background(), cfg, newTestMetrics())
+	require.True(t, report.Passed)
+	for _, check := range report.Checks {
+		if check.Check == preflightCheckClusterID {
+			require.NotEmpty(t, check.Detail)
+		}
+	}
+
+	// Unreachable seed brokers fail the preflight
+	cfg.ProducerKafkaConfig.SeedBrokers = append(cfg.ProducerKafkaConfig.SeedBrokers, "localhost:1")
+	report = RunPreflight(context.Background(), cfg, newTestMetrics())
+	require.False(t, report.Passed)
+}
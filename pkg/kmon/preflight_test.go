@@ -0,0 +1,116 @@
+package kmon
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestRequiredPermissions(t *testing.T) {
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: "kmon",
+		ConsumerGroup:           &config.ConsumerGroupConfig{GroupID: "kmon-group"},
+	}
+	producer, consumer := requiredPermissions(cfg)
+	require.Nil(t, consumer)
+	require.Equal(t, []kmsg.ACLOperation{kmsg.ACLOperationAlter}, producer.cluster)
+	require.Equal(t, []kmsg.ACLOperation{
+		kmsg.ACLOperationDescribe, kmsg.ACLOperationWrite, kmsg.ACLOperationRead, kmsg.ACLOperationDescribeConfigs,
+		kmsg.ACLOperationCreate, kmsg.ACLOperationDelete, kmsg.ACLOperationAlter, kmsg.ACLOperationAlterConfigs,
+	}, producer.topicOps)
+	require.Equal(t, []preflightGroup{
+		{"kmon-owner-kmon", []kmsg.ACLOperation{kmsg.ACLOperationRead}},
+		{"kmon-group", []kmsg.ACLOperation{kmsg.ACLOperationRead}},
+	}, producer.groups)
+
+	// Read-only mirroring only writes to the producer cluster and reads from the consumer cluster
+	cfg.ReadOnly = &config.ReadOnlyConfig{}
+	cfg.ConsumerKafkaConfig = &config.KafkaConfig{}
+	cfg.ConsumerMonitoringTopic = "kmon-mirror"
+	producer, consumer = requiredPermissions(cfg)
+	require.Empty(t, producer.cluster)
+	require.Equal(t, []kmsg.ACLOperation{kmsg.ACLOperationDescribe, kmsg.ACLOperationWrite}, producer.topicOps)
+	require.Empty(t, producer.groups)
+	require.Equal(t, "kmon-mirror", consumer.topic)
+	require.Equal(t, []kmsg.ACLOperation{kmsg.ACLOperationDescribe, kmsg.ACLOperationRead}, consumer.topicOps)
+	require.Equal(t, []preflightGroup{{"kmon-group", []kmsg.ACLOperation{kmsg.ACLOperationRead}}}, consumer.groups)
+}
+
+func TestEvaluatePermissionChecks(t *testing.T) {
+	newChecks := func() map[kmsg.ACLOperation]*PreflightCheck {
+		return map[kmsg.ACLOperation]*PreflightCheck{
+			kmsg.ACLOperationRead:  {Status: preflightUnverified},
+			kmsg.ACLOperationWrite: {Status: preflightUnverified},
+		}
+	}
+
+	checks := newChecks()
+	evaluatePermissionChecks(checks, 1<<kmsg.ACLOperationRead|1<<kmsg.ACLOperationDescribe)
+	require.Equal(t, preflightPassed, checks[kmsg.ACLOperationRead].Status)
+	require.Equal(t, preflightFailed, checks[kmsg.ACLOperationWrite].Status)
+
+	checks = newChecks()
+	evaluatePermissionChecks(checks, math.MinInt32)
+	require.Equal(t, preflightUnverified, checks[kmsg.ACLOperationRead].Status)
+
+	checks = newChecks()
+	markPermissionChecks(checks, kerr.GroupAuthorizationFailed)
+	require.Equal(t, preflightFailed, checks[kmsg.ACLOperationRead].Status)
+
+	checks = newChecks()
+	markPermissionChecks(checks, kerr.CoordinatorNotAvailable)
+	require.Equal(t, preflightUnverified, checks[kmsg.ACLOperationRead].Status)
+	require.Equal(t, kerr.CoordinatorNotAvailable.Error(), checks[kmsg.ACLOperationRead].Detail)
+}
+
+func TestPreflightReportWriteTable(t *testing.T) {
+	report := &PreflightReport{Checks: []*PreflightCheck{
+		{Cluster: "producer", Check: preflightCheckConnectivity, Resource: "localhost:10000", Status: preflightPassed},
+		{Cluster: "producer", Check: preflightCheckPermission, Resource: "topic:kmon", Operation: "WRITE", Status: preflightFailed, Detail: "not authorized"},
+	}}
+
+	var table bytes.Buffer
+	require.NoError(t, report.WriteTable(&table))
+	require.Contains(t, table.String(), "topic:kmon")
+	require.Contains(t, table.String(), "FAILED  not authorized")
+	require.Contains(t, table.String(), "Preflight FAILED")
+}
+
+func TestPreflighterUpdate(t *testing.T) {
+	metrics, registry := newTestMetricsWithRegistry()
+	p := newPreflighter(&config.KMonConfig{}, metrics)
+
+	connectivity := &PreflightCheck{Cluster: "producer", Check: preflightCheckConnectivity, Resource: "localhost:10000", Status: preflightPassed}
+	write := &PreflightCheck{Cluster: "producer", Check: preflightCheckPermission, Resource: "topic:kmon", Operation: "WRITE", Status: preflightFailed}
+	first := &PreflightReport{Passed: false, Checks: []*PreflightCheck{connectivity, write}}
+	// As RunPreflight exports them
+	metrics.PreflightFailure.WithLabelValues("producer", preflightCheckConnectivity, "localhost:10000", "").Set(0)
+	metrics.PreflightFailure.WithLabelValues("producer", preflightCheckPermission, "topic:kmon", "WRITE").Set(1)
+	p.update(first)
+	require.Same(t, first, p.getReport())
+
+	// A check that is no longer run stops being reported as failed
+	second := &PreflightReport{Passed: true, Checks: []*PreflightCheck{connectivity}}
+	p.update(second)
+	require.Same(t, second, p.getReport())
+	require.Equal(t, map[string]float64{
+		"connectivity,producer,,localhost:10000": 0,
+		"permission,producer,WRITE,topic:kmon":   0,
+	}, metricSamples(t, registry, "kmon_preflight_failure"))
+}
+
+func TestPreflightReportFailures(t *testing.T) {
+	report := &PreflightReport{Checks: []*PreflightCheck{
+		{Cluster: "producer", Check: preflightCheckConnectivity, Resource: "localhost:10000", Status: preflightPassed},
+		{Cluster: "producer", Check: preflightCheckPermission, Resource: "topic:kmon", Operation: "WRITE", Status: preflightFailed},
+	}}
+	require.Equal(t, "producer permission topic:kmon WRITE\n", report.failures())
+
+	report.Checks[1].Status = preflightUnverified
+	require.Empty(t, report.failures())
+}
@@ -0,0 +1,355 @@
+package kmon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/config"
+)
+
+const (
+	probeHistorySegmentPrefix = "probes-"
+	probeHistorySegmentSuffix = ".jsonl"
+	// Results waiting to be written, beyond which new ones are dropped rather than blocking the Monitor
+	probeHistoryQueueSize = 10000
+	defaultHistoryLimit   = 1000
+	maxHistoryLimit       = 10000
+)
+
+// probeHistory records probe results to append-only segment files of JSON lines, named after the time their first
+// result was written at, so that what kmon observed can be reconstructed after the fact. Results are queued and
+// written by Start, so that a slow disk never holds up probing.
+type probeHistory struct {
+	metrics         *Metrics
+	dir             string
+	segmentDuration time.Duration
+	retention       time.Duration
+	maxBytes        int64
+	results         chan ProbeResult
+
+	// Guards the set of segments, which queries list while Start creates and deletes them
+	mu           sync.Mutex
+	segment      *os.File
+	segmentStart time.Time
+}
+
+type historySegment struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// probeHistoryQuery selects the results of probes sent in [from, to], through broker if set and with a latency of
+// latencyType of at least minLatencyMs if set. Lost probes and probes that failed to be produced never completed, so
+// they always meet the latency threshold.
+type probeHistoryQuery struct {
+	from         time.Time
+	to           time.Time
+	broker       *int32
+	minLatencyMs *int64
+	latencyType  string
+	limit        int
+}
+
+type probeHistoryResponse struct {
+	Results []ProbeResult `json:"results"`
+	// Whether more results matched than the limit
+	Truncated bool `json:"truncated"`
+}
+
+func newProbeHistoryFromConfig(cfg *config.ProbeHistoryConfig, metrics *Metrics) (*probeHistory, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &probeHistory{
+		metrics:         metrics,
+		dir:             cfg.Dir,
+		segmentDuration: time.Duration(cfg.GetSegmentMinutes()) * time.Minute,
+		retention:       time.Duration(cfg.GetRetentionHours()) * time.Hour,
+		maxBytes:        int64(cfg.GetMaxSizeMB()) << 20,
+		results:         make(chan ProbeResult, probeHistoryQueueSize),
+	}, nil
+}
+
+// record queues the result to be written, or drops it if the queue is full.
+func (h *probeHistory) record(result ProbeResult) {
+	select {
+	case h.results <- result:
+	default:
+		h.metrics.ProbeHistoryDroppedCount.WithLabelValues("queue_full").Inc()
+	}
+}
+
+func (h *probeHistory) Start(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	defer h.closeSegment()
+
+	h.enforceRetention(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result := <-h.results:
+			if err := h.write(result, time.Now()); err != nil {
+				h.metrics.ProbeHistoryDroppedCount.WithLabelValues("write_failed").Inc()
+				log.Error().Err(err).Msg("failed to write probe result")
+			}
+		case <-ticker.C:
+			h.enforceRetention(time.Now())
+		}
+	}
+}
+
+// write appends the result to the current segment, starting a new one once the current one spans the segment
+// duration.
+func (h *probeHistory) write(result ProbeResult, now time.Time) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.segment == nil || now.Sub(h.segmentStart) >= h.segmentDuration {
+		h.closeSegmentLocked()
+		path := filepath.Join(h.dir, fmt.Sprintf("%s%d%s", probeHistorySegmentPrefix, now.UnixMilli(), probeHistorySegmentSuffix))
+		segment, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		h.segment, h.segmentStart = segment, now
+	}
+	_, err = h.segment.Write(append(data, '\n'))
+	return err
+}
+
+func (h *probeHistory) closeSegment() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeSegmentLocked()
+}
+
+func (h *probeHistory) closeSegmentLocked() {
+	if h.segment == nil {
+		return
+	}
+	if err := h.segment.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close probe history segment")
+	}
+	h.segment = nil
+}
+
+// segments returns the segments on disk, oldest first.
+func (h *probeHistory) segments() ([]historySegment, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []historySegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, probeHistorySegmentPrefix) || !strings.HasSuffix(name, probeHistorySegmentSuffix) {
+			continue
+		}
+		startMs, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, probeHistorySegmentPrefix), probeHistorySegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, historySegment{path: filepath.Join(h.dir, name), start: time.UnixMilli(startMs), size: info.Size()})
+	}
+	slices.SortFunc(segments, func(a, b historySegment) int {
+		return a.start.Compare(b.start)
+	})
+	return segments, nil
+}
+
+// enforceRetention deletes the segments that ended before the retention period, then the oldest ones while the
+// segments take more than the maximum size. The current segment is never deleted.
+func (h *probeHistory) enforceRetention(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	segments, err := h.segments()
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to list probe history segments in %s", h.dir)
+		return
+	}
+	var total int64
+	for _, segment := range segments {
+		total += segment.size
+	}
+	for i, segment := range segments {
+		current := h.segment != nil && segment.path == h.segment.Name()
+		// A segment ends when the next one starts
+		end := now
+		if i+1 < len(segments) {
+			end = segments[i+1].start
+		}
+		if current || (now.Sub(end) <= h.retention && total <= h.maxBytes) {
+			break
+		}
+		if err := os.Remove(segment.path); err != nil {
+			log.Error().Err(err).Msgf("failed to delete probe history segment %s", segment.path)
+			return
+		}
+		total -= segment.size
+	}
+}
+
+// query returns the results matching q, in the order they were recorded, along with whether more matched than the
+// limit.
+func (h *probeHistory) query(q probeHistoryQuery) ([]ProbeResult, bool, error) {
+	h.mu.Lock()
+	segments, err := h.segments()
+	h.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+
+	results := []ProbeResult{}
+	for i, segment := range segments {
+		// Lost probes are recorded a probe timeout after they are sent, far less than a segment's duration, so a
+		// segment may hold probes sent before it started but never after it ended
+		if segment.start.After(q.to.Add(h.segmentDuration)) {
+			break
+		}
+		if i+1 < len(segments) && segments[i+1].start.Before(q.from) {
+			continue
+		}
+		truncated, err := h.scanSegment(segment.path, q, &results)
+		if err != nil {
+			return nil, false, err
+		}
+		if truncated {
+			return results, true, nil
+		}
+	}
+	return results, false, nil
+}
+
+// scanSegment appends the results of the segment matching q, and returns whether the limit was exceeded. Lines that
+// don't parse, such as one being written, are skipped.
+func (h *probeHistory) scanSegment(path string, q probeHistoryQuery, results *[]ProbeResult) (bool, error) {
+	f, err := os.Open(path)
+	// The segment was deleted by retention since it was listed
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var result ProbeResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
+		}
+		if !q.matches(&result) {
+			continue
+		}
+		if len(*results) == q.limit {
+			return true, nil
+		}
+		*results = append(*results, result)
+	}
+	return false, scanner.Err()
+}
+
+func (q *probeHistoryQuery) matches(result *ProbeResult) bool {
+	if result.SentAt.Before(q.from) || result.SentAt.After(q.to) {
+		return false
+	}
+	if q.broker != nil && result.Broker != *q.broker {
+		return false
+	}
+	if q.minLatencyMs != nil && result.Status == probeConsumed {
+		latencyMs := result.latencyMs(q.latencyType)
+		return latencyMs != nil && *latencyMs >= *q.minLatencyMs
+	}
+	return true
+}
+
+// ServeHTTP serves the results matching the query parameters: from and to (RFC 3339, the last hour by default),
+// broker, minLatencyMs, latencyType (e2e by default) and limit.
+func (h *probeHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseProbeHistoryQuery(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, truncated, err := h.query(q)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query probe history")
+		http.Error(w, "failed to query probe history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(probeHistoryResponse{Results: results, Truncated: truncated}); err != nil {
+		log.Error().Err(err).Msg("failed to write probe history")
+	}
+}
+
+func parseProbeHistoryQuery(r *http.Request, now time.Time) (probeHistoryQuery, error) {
+	params := r.URL.Query()
+	q := probeHistoryQuery{to: now, latencyType: config.LatencyTypeE2E, limit: defaultHistoryLimit}
+	var err error
+	if to := params.Get("to"); to != "" {
+		if q.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	q.from = q.to.Add(-time.Hour)
+	if from := params.Get("from"); from != "" {
+		if q.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if broker := params.Get("broker"); broker != "" {
+		id, err := strconv.ParseInt(broker, 10, 32)
+		if err != nil {
+			return q, fmt.Errorf("invalid broker: %w", err)
+		}
+		q.broker = new(int32)
+		*q.broker = int32(id)
+	}
+	if minLatencyMs := params.Get("minLatencyMs"); minLatencyMs != "" {
+		threshold, err := strconv.ParseInt(minLatencyMs, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid minLatencyMs: %w", err)
+		}
+		q.minLatencyMs = &threshold
+	}
+	if latencyType := params.Get("latencyType"); latencyType != "" {
+		switch latencyType {
+		case config.LatencyTypeE2E, config.LatencyTypeP2B, config.LatencyTypeB2C, config.LatencyTypeAck:
+			q.latencyType = latencyType
+		default:
+			return q, fmt.Errorf("invalid latencyType %s", latencyType)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.limit, err = strconv.Atoi(limit); err != nil || q.limit <= 0 || q.limit > maxHistoryLimit {
+			return q, fmt.Errorf("invalid limit %s, must be between 1 and %d", limit, maxHistoryLimit)
+		}
+	}
+	return q, nil
+}
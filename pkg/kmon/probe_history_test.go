@@ -0,0 +1,199 @@
+package kmon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestMonitorProbeResults(t *testing.T) {
+	var producedRecords []*kgo.Record
+	mockProducerClient := &MockKgoClient{
+		ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+			producedRecords = append(producedRecords, r)
+			if r.Partition == 2 {
+				f(r, errors.New("produce failed"))
+				return
+			}
+			r.Offset = 42
+			f(r, nil)
+		},
+	}
+	m := NewMonitorWithClients(newTestMetrics(), mockProducerClient, "test-topic", nil, "test-uuid", 3, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m.partitionBrokers = []int32{1, 2, 3}
+	var results []ProbeResult
+	m.resultCallback = func(result ProbeResult) {
+		results = append(results, result)
+	}
+	m.trackingLoss.Store(true)
+
+	m.publishProbeBatch(context.Background())
+	require.Len(t, results, 1)
+	require.Equal(t, probeProduceFailed, results[0].Status)
+	require.Equal(t, "produce failed", results[0].Error)
+	require.Equal(t, int32(3), results[0].Broker)
+
+	// The probe of partition 0 is consumed, the one of partition 1 is lost
+	consumed := producedRecords[0]
+	consumed.Timestamp = time.Now()
+	m.handleConsumedRecord(consumed, time.Now())
+	m.expireLostProbes(time.Now().Add(m.probeTimeout + time.Second))
+	require.Len(t, results, 3)
+
+	require.Equal(t, probeConsumed, results[1].Status)
+	require.Equal(t, 0, results[1].Partition)
+	require.Equal(t, int32(1), results[1].Broker)
+	require.Equal(t, int64(42), *results[1].ProducedOffset)
+	require.Equal(t, int64(42), *results[1].ConsumedOffset)
+	require.NotNil(t, results[1].AckLatencyMs)
+	require.NotNil(t, results[1].E2ELatencyMs)
+	require.NotNil(t, results[1].P2BLatencyMs)
+	require.NotNil(t, results[1].B2CLatencyMs)
+
+	require.Equal(t, probeLost, results[2].Status)
+	require.Equal(t, 1, results[2].Partition)
+	require.Equal(t, int64(42), *results[2].ProducedOffset)
+	require.Nil(t, results[2].E2ELatencyMs)
+
+	// A probe consumed after being reported as lost, or consumed again, has no other result
+	lost := producedRecords[1]
+	lost.Timestamp = time.Now()
+	m.handleConsumedRecord(lost, time.Now().Add(m.probeTimeout+2*time.Second))
+	m.handleConsumedRecord(consumed, time.Now())
+	require.Len(t, results, 3)
+}
+
+func TestMonitorProbeResultsBeforeTracking(t *testing.T) {
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "test-topic", nil, "test-uuid", 1, time.Duration(1), time.Duration(5)*time.Minute, false)
+	var results []ProbeResult
+	m.resultCallback = func(result ProbeResult) {
+		results = append(results, result)
+	}
+
+	// Probes sent before loss tracking started were never pending, but are still reported once consumed
+	sentAt := time.Now()
+	m.handleConsumedRecord(&kgo.Record{Key: []byte("test-uuid"), Value: []byte(strconv.FormatInt(sentAt.UnixNano(), 10)), Timestamp: sentAt}, time.Now())
+	require.Len(t, results, 1)
+	require.Equal(t, probeConsumed, results[0].Status)
+}
+
+func historyResult(sentAt time.Time, broker int32, status string, e2eLatencyMs int64) ProbeResult {
+	result := ProbeResult{SentAt: sentAt, Broker: broker, Status: status}
+	if status == probeConsumed {
+		result.E2ELatencyMs = &e2eLatencyMs
+	}
+	return result
+}
+
+func TestProbeHistory(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newProbeHistoryFromConfig(&config.ProbeHistoryConfig{Dir: dir, SegmentMinutes: 1, RetentionHours: 1}, newTestMetrics())
+	require.NoError(t, err)
+
+	start := time.Now().Add(-3 * time.Hour).Truncate(time.Minute)
+	// Two segments a couple of hours old and one recent
+	require.NoError(t, h.write(historyResult(start, 1, probeConsumed, 10), start))
+	require.NoError(t, h.write(historyResult(start.Add(30*time.Second), 2, probeConsumed, 500), start.Add(30*time.Second)))
+	require.NoError(t, h.write(historyResult(start.Add(time.Minute), 1, probeLost, 0), start.Add(time.Minute+10*time.Second)))
+	recent := time.Now().Add(-time.Minute)
+	require.NoError(t, h.write(historyResult(recent, 2, probeConsumed, 20), recent))
+	segments, err := h.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 3)
+
+	query := func(q probeHistoryQuery) ([]time.Time, bool) {
+		if q.to.IsZero() {
+			q.from, q.to = start, time.Now()
+		}
+		if q.limit == 0 {
+			q.limit = defaultHistoryLimit
+		}
+		if q.latencyType == "" {
+			q.latencyType = config.LatencyTypeE2E
+		}
+		results, truncated, err := h.query(q)
+		require.NoError(t, err)
+		var sentAt []time.Time
+		for _, result := range results {
+			sentAt = append(sentAt, result.SentAt)
+		}
+		return sentAt, truncated
+	}
+	equalTimes := func(expected []time.Time, actual []time.Time) {
+		require.Len(t, actual, len(expected))
+		for i := range expected {
+			require.True(t, expected[i].Equal(actual[i]), "expected %s, got %s", expected[i], actual[i])
+		}
+	}
+
+	sentAt, truncated := query(probeHistoryQuery{})
+	equalTimes([]time.Time{start, start.Add(30 * time.Second), start.Add(time.Minute), recent}, sentAt)
+	require.False(t, truncated)
+
+	// Lost probes always meet the latency threshold
+	minLatencyMs := int64(100)
+	sentAt, _ = query(probeHistoryQuery{minLatencyMs: &minLatencyMs})
+	equalTimes([]time.Time{start.Add(30 * time.Second), start.Add(time.Minute)}, sentAt)
+
+	broker := int32(2)
+	sentAt, _ = query(probeHistoryQuery{broker: &broker})
+	equalTimes([]time.Time{start.Add(30 * time.Second), recent}, sentAt)
+
+	// The lost probe was recorded in the second segment, but sent during the first one
+	sentAt, _ = query(probeHistoryQuery{from: start, to: start.Add(time.Minute), limit: 2})
+	equalTimes([]time.Time{start, start.Add(30 * time.Second)}, sentAt)
+	sentAt, truncated = query(probeHistoryQuery{from: start.Add(time.Minute), to: time.Now(), limit: 1})
+	equalTimes([]time.Time{start.Add(time.Minute)}, sentAt)
+	require.True(t, truncated)
+
+	// Segments that ended before the retention period are deleted, but not the current one
+	h.enforceRetention(time.Now())
+	segments, err = h.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+
+	h.maxBytes = 0
+	h.enforceRetention(time.Now())
+	segments, err = h.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	h.closeSegment()
+	_, err = os.Stat(segments[0].path)
+	require.NoError(t, err)
+}
+
+func TestProbeHistoryHandler(t *testing.T) {
+	h, err := newProbeHistoryFromConfig(&config.ProbeHistoryConfig{Dir: t.TempDir()}, newTestMetrics())
+	require.NoError(t, err)
+	defer h.closeSegment()
+	now := time.Now()
+	require.NoError(t, h.write(historyResult(now.Add(-2*time.Hour), 1, probeConsumed, 10), now))
+	require.NoError(t, h.write(historyResult(now.Add(-time.Minute), 1, probeConsumed, 20), now))
+	require.NoError(t, h.write(historyResult(now.Add(-time.Minute), 2, probeConsumed, 30), now))
+
+	// Only the last hour is served by default
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/history?broker=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var response probeHistoryResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Results, 1)
+	require.Equal(t, int64(20), *response.Results[0].E2ELatencyMs)
+
+	for _, query := range []string{"from=yesterday", "broker=a", "minLatencyMs=1.5", "latencyType=total", "limit=0"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/history?"+query, nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
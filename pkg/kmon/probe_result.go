@@ -0,0 +1,70 @@
+package kmon
+
+import (
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+)
+
+const (
+	probeConsumed      = "consumed"
+	probeLost          = "lost"
+	probeProduceFailed = "produce_failed"
+)
+
+// ProbeResult is the outcome of a single probe, reported once it is consumed, lost or fails to be produced. Latencies
+// and offsets that weren't measured are left unset: a probe's ack is only recorded if it was sent after loss tracking
+// started, and the ack may also arrive after the probe was consumed.
+type ProbeResult struct {
+	SentAt time.Time `json:"sentAt"`
+	// Partition of the Monitor's measurements, which is always 0 when mirroring
+	Partition int `json:"partition"`
+	// Broker leading the partition, or -1 if unknown
+	Broker         int32  `json:"broker"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+	ProducedOffset *int64 `json:"producedOffset,omitempty"`
+	ConsumedOffset *int64 `json:"consumedOffset,omitempty"`
+	AckLatencyMs   *int64 `json:"ackLatencyMs,omitempty"`
+	P2BLatencyMs   *int64 `json:"p2bLatencyMs,omitempty"`
+	B2CLatencyMs   *int64 `json:"b2cLatencyMs,omitempty"`
+	E2ELatencyMs   *int64 `json:"e2eLatencyMs,omitempty"`
+	Throttled      bool   `json:"throttled,omitempty"`
+}
+
+// latencyMs returns the latency of the given type, or nil if it wasn't measured.
+func (r *ProbeResult) latencyMs(latencyType string) *int64 {
+	switch latencyType {
+	case config.LatencyTypeAck:
+		return r.AckLatencyMs
+	case config.LatencyTypeP2B:
+		return r.P2BLatencyMs
+	case config.LatencyTypeB2C:
+		return r.B2CLatencyMs
+	default:
+		return r.E2ELatencyMs
+	}
+}
+
+// newProbeResult returns the result of a probe with what was recorded while it was pending, if anything.
+func (m *Monitor) newProbeResult(partition int, sentAt time.Time, status string, probe pendingProbe) ProbeResult {
+	result := ProbeResult{
+		SentAt:    sentAt,
+		Partition: partition,
+		Broker:    m.partitionBroker(partition),
+		Status:    status,
+	}
+	if probe.acked {
+		result.ProducedOffset = &probe.offset
+		ackLatencyMs := probe.ackLatency.Milliseconds()
+		result.AckLatencyMs = &ackLatencyMs
+	}
+	return result
+}
+
+// reportResult passes the result to the result callback, if set.
+func (m *Monitor) reportResult(result ProbeResult) {
+	if m.resultCallback != nil {
+		m.resultCallback(result)
+	}
+}
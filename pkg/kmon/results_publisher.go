@@ -0,0 +1,106 @@
+package kmon
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Results produced but not acked yet, beyond which new ones are dropped rather than blocking the Monitor
+const maxInFlightResults = 10000
+
+// publishedProbeResult is the message published for every probe result.
+type publishedProbeResult struct {
+	// ID of the producer cluster, once discovered
+	Cluster         string `json:"cluster"`
+	Instance        string `json:"instance"`
+	MonitoringTopic string `json:"monitoringTopic"`
+	ProbeResult
+}
+
+// resultsPublisher publishes probe results to a topic for other tools to build on, keyed by the broker the probe went
+// through. Publishing never blocks: results are dropped when too many are in flight, and every failure is counted.
+type resultsPublisher struct {
+	metrics         *Metrics
+	client          clients.KgoClient
+	topic           string
+	instance        string
+	monitoringTopic string
+	clusterID       func() string
+	inFlight        atomic.Int64
+}
+
+func newResultsPublisherFromConfig(cfg *config.KMonConfig, metrics *Metrics, clusterID func() string) (*resultsPublisher, error) {
+	client, err := clients.GetFranzGoClient(cfg.ResultsTopic.GetKafkaConfig(cfg.ProducerKafkaConfig), clients.RoleProducer, nil,
+		kgo.DefaultProduceTopic(cfg.ResultsTopic.Topic),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.MaxBufferedRecords(2*maxInFlightResults),
+		kgo.RecordDeliveryTimeout(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newResultsPublisher(metrics, client, cfg.ResultsTopic.Topic, cfg.GetInstanceName(), cfg.ProducerMonitoringTopic, clusterID), nil
+}
+
+func newResultsPublisher(metrics *Metrics, client clients.KgoClient, topic string, instance string, monitoringTopic string, clusterID func() string) *resultsPublisher {
+	return &resultsPublisher{
+		metrics:         metrics,
+		client:          client,
+		topic:           topic,
+		instance:        instance,
+		monitoringTopic: monitoringTopic,
+		clusterID:       clusterID,
+	}
+}
+
+func (p *resultsPublisher) close() {
+	p.client.Close()
+}
+
+func (p *resultsPublisher) Start(ctx context.Context) {
+	<-ctx.Done()
+	p.close()
+}
+
+// publish produces the result, or drops it if too many results are in flight.
+func (p *resultsPublisher) publish(result ProbeResult) {
+	value, err := json.Marshal(publishedProbeResult{
+		Cluster:         p.clusterID(),
+		Instance:        p.instance,
+		MonitoringTopic: p.monitoringTopic,
+		ProbeResult:     result,
+	})
+	if err != nil {
+		p.metrics.ResultsPublishFailureCount.WithLabelValues(p.topic, "encode_failed").Inc()
+		return
+	}
+	if p.inFlight.Add(1) > maxInFlightResults {
+		p.inFlight.Add(-1)
+		p.metrics.ResultsPublishFailureCount.WithLabelValues(p.topic, "buffer_full").Inc()
+		return
+	}
+
+	record := &kgo.Record{
+		Topic: p.topic,
+		Key:   []byte(strconv.FormatInt(int64(result.Broker), 10)),
+		Value: value,
+	}
+	// The Monitor's context may already be done, but results in flight are still worth publishing
+	p.client.Produce(context.Background(), record, func(_ *kgo.Record, err error) {
+		p.inFlight.Add(-1)
+		if err != nil {
+			p.metrics.ResultsPublishFailureCount.WithLabelValues(p.topic, "produce_failed").Inc()
+			log.Debug().Err(err).Msgf("failed to publish probe result to %s", p.topic)
+			return
+		}
+		p.metrics.ResultsPublishedCount.WithLabelValues(p.topic).Inc()
+	})
+}
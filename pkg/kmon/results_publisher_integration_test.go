@@ -0,0 +1,67 @@
+//go:build integration
+
+package kmon
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestResultsPublisherIntegration(t *testing.T) {
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: "kmon-results-source",
+		ProducerKafkaConfig: &config.KafkaConfig{
+			SeedBrokers: []string{"localhost:10000"},
+		},
+		InstanceName: "kmon-a",
+		ResultsTopic: &config.ResultsTopicConfig{Topic: "kmon-results"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	consumer, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleConsumer, nil, kgo.ConsumeTopics(cfg.ResultsTopic.Topic),
+		// The topic is recreated by the test, so everything in it was published by the test
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	require.NoError(t, err)
+	defer consumer.Close()
+	adm := kadm.NewClient(consumer)
+	_, _ = adm.DeleteTopic(ctx, cfg.ResultsTopic.Topic)
+	require.Eventually(t, func() bool {
+		resp, err := adm.CreateTopic(ctx, 3, -1, nil, cfg.ResultsTopic.Topic)
+		return err == nil && resp.Err == nil
+	}, 20*time.Second, 500*time.Millisecond)
+
+	metrics, registry := newTestMetricsWithRegistry()
+	p, err := newResultsPublisherFromConfig(cfg, metrics, func() string { return "cluster-a" })
+	require.NoError(t, err)
+	publisherCtx, cancelPublisher := context.WithCancel(ctx)
+	defer cancelPublisher()
+	go p.Start(publisherCtx)
+
+	e2eLatencyMs := int64(7)
+	p.publish(ProbeResult{SentAt: time.Now(), Partition: 2, Broker: 1, Status: probeConsumed, E2ELatencyMs: &e2eLatencyMs})
+
+	var published publishedProbeResult
+	require.Eventually(t, func() bool {
+		pollCtx, cancelPoll := context.WithTimeout(ctx, time.Second)
+		defer cancelPoll()
+		records := consumer.PollFetches(pollCtx).Records()
+		if len(records) == 0 {
+			return false
+		}
+		require.NoError(t, json.Unmarshal(records[0].Value, &published))
+		return true
+	}, 20*time.Second, 100*time.Millisecond)
+	require.Equal(t, "kmon-a", published.Instance)
+	require.Equal(t, 2, published.Partition)
+	require.Equal(t, int64(7), *published.E2ELatencyMs)
+	require.Equal(t, map[string]float64{"kmon-results": 1}, metricSamples(t, registry, "kmon_results_published_total"))
+}
@@ -0,0 +1,55 @@
+package kmon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestResultsPublisher(t *testing.T) {
+	var records []*kgo.Record
+	var produceErr error
+	client := &MockKgoClient{
+		ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+			records = append(records, r)
+			f(r, produceErr)
+		},
+	}
+	metrics, registry := newTestMetricsWithRegistry()
+	p := newResultsPublisher(metrics, client, "kmon-results", "kmon-a", "kmon", func() string { return "cluster-a" })
+
+	e2eLatencyMs := int64(12)
+	sentAt := time.Now()
+	p.publish(ProbeResult{SentAt: sentAt, Partition: 1, Broker: 3, Status: probeConsumed, E2ELatencyMs: &e2eLatencyMs})
+	require.Len(t, records, 1)
+	require.Equal(t, "kmon-results", records[0].Topic)
+	// Results are keyed by broker
+	require.Equal(t, "3", string(records[0].Key))
+	var published publishedProbeResult
+	require.NoError(t, json.Unmarshal(records[0].Value, &published))
+	require.Equal(t, "cluster-a", published.Cluster)
+	require.Equal(t, "kmon-a", published.Instance)
+	require.Equal(t, "kmon", published.MonitoringTopic)
+	require.True(t, sentAt.Equal(published.SentAt))
+	require.Equal(t, 1, published.Partition)
+	require.Equal(t, probeConsumed, published.Status)
+	require.Equal(t, int64(12), *published.E2ELatencyMs)
+
+	produceErr = errors.New("produce failed")
+	p.publish(ProbeResult{Broker: 3, Status: probeLost})
+	// Results are dropped without being produced while too many are in flight
+	p.inFlight.Store(maxInFlightResults)
+	p.publish(ProbeResult{Broker: 3, Status: probeLost})
+	require.Len(t, records, 2)
+
+	require.Equal(t, map[string]float64{"kmon-results": 1}, metricSamples(t, registry, "kmon_results_published_total"))
+	require.Equal(t, map[string]float64{
+		"buffer_full,kmon-results":    1,
+		"produce_failed,kmon-results": 1,
+	}, metricSamples(t, registry, "kmon_results_publish_failures_total"))
+}
@@ -0,0 +1,272 @@
+package kmon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+)
+
+// Burn rates are computed over minutes to hours, so they get fine buckets, while the compliance window spans days
+// and only needs coarse ones.
+const (
+	sloFineResolution   = time.Minute
+	sloCoarseResolution = time.Hour
+)
+
+// eventWindow counts good and total events in fixed-size time buckets kept in a ring, which lets the same window
+// answer "how many events in the last N minutes" for any N up to its span.
+type eventWindow struct {
+	mu         sync.Mutex
+	resolution time.Duration
+	buckets    []eventBucket
+}
+
+type eventBucket struct {
+	slot  int64
+	good  uint64
+	total uint64
+}
+
+func newEventWindow(span time.Duration, resolution time.Duration) *eventWindow {
+	return &eventWindow{
+		resolution: resolution,
+		buckets:    make([]eventBucket, int(span/resolution)+1),
+	}
+}
+
+func (w *eventWindow) add(now time.Time, good bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	slot := now.UnixNano() / int64(w.resolution)
+	bucket := &w.buckets[slot%int64(len(w.buckets))]
+	if bucket.slot != slot {
+		*bucket = eventBucket{slot: slot}
+	}
+	bucket.total++
+	if good {
+		bucket.good++
+	}
+}
+
+func (w *eventWindow) span() time.Duration {
+	return time.Duration(len(w.buckets)-1) * w.resolution
+}
+
+// counts returns the number of good and total events in the span ending now, rounded up to whole buckets.
+func (w *eventWindow) counts(now time.Time, span time.Duration) (uint64, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	current := now.UnixNano() / int64(w.resolution)
+	numSlots := min(int64((span+w.resolution-1)/w.resolution), int64(len(w.buckets)))
+	var good, total uint64
+	for slot := current - numSlots + 1; slot <= current; slot++ {
+		bucket := w.buckets[slot%int64(len(w.buckets))]
+		if bucket.slot == slot {
+			good += bucket.good
+			total += bucket.total
+		}
+	}
+	return good, total
+}
+
+// sloWindow counts the events of an SLO at a fine resolution over its burn rate windows and at a coarse one over its
+// compliance window, which would otherwise take tens of thousands of buckets.
+type sloWindow struct {
+	fine   *eventWindow
+	coarse *eventWindow
+}
+
+func (w *sloWindow) add(now time.Time, good bool) {
+	w.fine.add(now, good)
+	w.coarse.add(now, good)
+}
+
+// counts returns the number of good and total events in the span ending now, from the fine buckets if they cover it.
+func (w *sloWindow) counts(now time.Time, span time.Duration) (uint64, uint64) {
+	if span <= w.fine.span() {
+		return w.fine.counts(now, span)
+	}
+	return w.coarse.counts(now, span)
+}
+
+// sloTracker turns probe outcomes into SLO events for every configured SLO, per partition and for the whole cluster.
+// It outlives the Monitors, which are attached to it in turn, so that reconciling the topic doesn't restart the
+// compliance and burn rate windows.
+type sloTracker struct {
+	metrics *Metrics
+	slos    []*sloState
+
+	mu sync.RWMutex
+	// labels returns the partition and broker labels of a partition of the attached Monitor
+	labels func(partition int) (string, string)
+}
+
+type sloState struct {
+	cfg              *config.SLOConfig
+	thresholdMs      int64
+	complianceWindow time.Duration
+	burnRateWindows  []time.Duration
+	// Guarded by the tracker's mu, replaced when a Monitor is attached
+	partitions map[int]*sloWindow
+	cluster    *sloWindow
+}
+
+// newSLOTracker creates a tracker with no partitions, which records nothing until a Monitor is attached to it.
+func newSLOTracker(metrics *Metrics, slos []*config.SLOConfig) *sloTracker {
+	tracker := &sloTracker{metrics: metrics}
+	for _, cfg := range slos {
+		state := &sloState{
+			cfg:              cfg,
+			thresholdMs:      int64(cfg.LatencyThresholdMs),
+			complianceWindow: time.Duration(cfg.GetComplianceWindowDays()) * 24 * time.Hour,
+			partitions:       make(map[int]*sloWindow),
+		}
+		for _, minutes := range cfg.GetBurnRateWindowsMinutes() {
+			state.burnRateWindows = append(state.burnRateWindows, time.Duration(minutes)*time.Minute)
+		}
+		state.cluster = state.newWindow()
+		tracker.slos = append(tracker.slos, state)
+	}
+	return tracker
+}
+
+// attach makes the tracker record the events of a Monitor with the given number of partitions, labeled by labels.
+// The windows of the partitions that still exist are kept, those of the partitions that don't are dropped.
+func (t *sloTracker) attach(partitions int, labels func(partition int) (string, string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.labels = labels
+	for _, slo := range t.slos {
+		windows := make(map[int]*sloWindow, partitions)
+		for p := range partitions {
+			if window, ok := slo.partitions[p]; ok {
+				windows[p] = window
+			} else {
+				windows[p] = slo.newWindow()
+			}
+		}
+		slo.partitions = windows
+	}
+}
+
+func (s *sloState) newWindow() *sloWindow {
+	var fineSpan time.Duration
+	for _, window := range s.burnRateWindows {
+		fineSpan = max(fineSpan, window)
+	}
+	return &sloWindow{
+		fine:   newEventWindow(fineSpan, sloFineResolution),
+		coarse: newEventWindow(s.complianceWindow, sloCoarseResolution),
+	}
+}
+
+// recordLatency records a successful measurement of the given latency type, which is good if it is within the
+// SLO's threshold.
+func (t *sloTracker) recordLatency(now time.Time, partition int, latencyType string, latencyMs int64) {
+	for _, slo := range t.slos {
+		if slo.cfg.GetLatencyType() == latencyType {
+			t.record(now, slo, partition, latencyMs <= slo.thresholdMs)
+		}
+	}
+}
+
+// recordProduceFailure records a bad event for every SLO, as a probe that could not be produced never satisfies any
+// of them.
+func (t *sloTracker) recordProduceFailure(now time.Time, partition int) {
+	for _, slo := range t.slos {
+		t.record(now, slo, partition, false)
+	}
+}
+
+// recordLoss records a bad event for every SLO measured on the consumer side. A lost probe was acked, so it has
+// already been accounted for by ack SLOs.
+func (t *sloTracker) recordLoss(now time.Time, partition int) {
+	for _, slo := range t.slos {
+		if slo.cfg.GetLatencyType() != config.LatencyTypeAck {
+			t.record(now, slo, partition, false)
+		}
+	}
+}
+
+func (t *sloTracker) record(now time.Time, slo *sloState, partition int, good bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	window, ok := slo.partitions[partition]
+	if !ok {
+		return
+	}
+	window.add(now, good)
+	slo.cluster.add(now, good)
+
+	partitionLabel, brokerLabel := t.labels(partition)
+	t.metrics.SLOEventCount.WithLabelValues(slo.cfg.Name, partitionLabel, brokerLabel).Inc()
+	t.metrics.SLOClusterEventCount.WithLabelValues(slo.cfg.Name).Inc()
+	if good {
+		t.metrics.SLOGoodEventCount.WithLabelValues(slo.cfg.Name, partitionLabel, brokerLabel).Inc()
+		t.metrics.SLOClusterGoodEventCount.WithLabelValues(slo.cfg.Name).Inc()
+	}
+}
+
+// update refreshes the error budget and burn rate gauges. Windows without any events are left untouched rather than
+// reported as healthy.
+func (t *sloTracker) update(now time.Time) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, slo := range t.slos {
+		for partition, window := range slo.partitions {
+			partitionLabel, brokerLabel := t.labels(partition)
+			if remaining, ok := slo.errorBudgetRemaining(now, window); ok {
+				t.metrics.SLOErrorBudgetRemaining.WithLabelValues(slo.cfg.Name, partitionLabel, brokerLabel).Set(remaining)
+			}
+			for _, burnRateWindow := range slo.burnRateWindows {
+				if burnRate, ok := slo.burnRate(now, window, burnRateWindow); ok {
+					t.metrics.SLOBurnRate.WithLabelValues(slo.cfg.Name, partitionLabel, brokerLabel, windowLabel(burnRateWindow)).Set(burnRate)
+				}
+			}
+		}
+
+		if remaining, ok := slo.errorBudgetRemaining(now, slo.cluster); ok {
+			t.metrics.SLOClusterErrorBudgetRemaining.WithLabelValues(slo.cfg.Name).Set(remaining)
+		}
+		for _, burnRateWindow := range slo.burnRateWindows {
+			if burnRate, ok := slo.burnRate(now, slo.cluster, burnRateWindow); ok {
+				t.metrics.SLOClusterBurnRate.WithLabelValues(slo.cfg.Name, windowLabel(burnRateWindow)).Set(burnRate)
+			}
+		}
+	}
+}
+
+// errorBudgetRemaining is the fraction of the compliance window's error budget that has not been spent yet. It goes
+// negative once the SLO is breached.
+func (s *sloState) errorBudgetRemaining(now time.Time, window *sloWindow) (float64, bool) {
+	burnRate, ok := s.burnRate(now, window, s.complianceWindow)
+	if !ok {
+		return 0, false
+	}
+	return 1 - burnRate, true
+}
+
+// burnRate is the rate at which the error budget is being spent over the given span, where 1 means the budget
+// would be exactly used up at the end of the compliance window.
+func (s *sloState) burnRate(now time.Time, window *sloWindow, span time.Duration) (float64, bool) {
+	good, total := window.counts(now, span)
+	if total == 0 {
+		return 0, false
+	}
+	errorRatio := float64(total-good) / float64(total)
+	return errorRatio / (1 - s.cfg.GetTarget()), true
+}
+
+func windowLabel(window time.Duration) string {
+	if window%time.Hour == 0 {
+		return fmt.Sprintf("%dh", int(window.Hours()))
+	}
+	return fmt.Sprintf("%dm", int(window.Minutes()))
+}
@@ -0,0 +1,173 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestEventWindow(t *testing.T) {
+	w := newEventWindow(10*time.Minute, time.Minute)
+	start := time.Unix(0, 0)
+
+	for i := range 20 {
+		now := start.Add(time.Duration(i) * time.Minute)
+		w.add(now, true)
+		w.add(now, i%2 == 0)
+	}
+
+	now := start.Add(19 * time.Minute)
+	good, total := w.counts(now, 5*time.Minute)
+	require.Equal(t, uint64(7), good)
+	require.Equal(t, uint64(10), total)
+
+	// Spans longer than the window are capped, and buckets that rolled over are not counted
+	good, total = w.counts(now, time.Hour)
+	require.Equal(t, uint64(16), good)
+	require.Equal(t, uint64(22), total)
+
+	good, total = w.counts(now.Add(time.Hour), 5*time.Minute)
+	require.Equal(t, uint64(0), good)
+	require.Equal(t, uint64(0), total)
+}
+
+func TestSLOWindowResolutions(t *testing.T) {
+	state := &sloState{complianceWindow: 30 * 24 * time.Hour, burnRateWindows: []time.Duration{5 * time.Minute, time.Hour}}
+	w := state.newWindow()
+	require.Len(t, w.fine.buckets, 61)
+	require.Len(t, w.coarse.buckets, 30*24+1)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.add(start, false)
+	w.add(start.Add(2*time.Hour), true)
+
+	// The fine buckets answer the burn rate windows, the coarse ones everything longer
+	now := start.Add(2 * time.Hour)
+	good, total := w.counts(now, time.Hour)
+	require.Equal(t, uint64(1), good)
+	require.Equal(t, uint64(1), total)
+	good, total = w.counts(now, 24*time.Hour)
+	require.Equal(t, uint64(1), good)
+	require.Equal(t, uint64(2), total)
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	slo := &config.SLOConfig{Name: "e2e-500", LatencyThresholdMs: 500, Target: 0.9, BurnRateWindowsMinutes: []int{5}}
+	tracker := newSLOTracker(newTestMetrics(), []*config.SLOConfig{slo})
+	tracker.attach(2, func(partition int) (string, string) {
+		return fmt.Sprintf("%d", partition), "unknown"
+	})
+	now := time.Now()
+
+	for range 8 {
+		tracker.recordLatency(now, 0, config.LatencyTypeE2E, 100)
+	}
+	tracker.recordLatency(now, 0, config.LatencyTypeE2E, 600)
+	// Ack latencies don't apply to an e2e SLO, but failed and lost probes do
+	tracker.recordLatency(now, 0, config.LatencyTypeAck, 600)
+	tracker.recordLoss(now, 0)
+	tracker.recordProduceFailure(now, 1)
+
+	state := tracker.slos[0]
+	burnRate, ok := state.burnRate(now, state.partitions[0], 5*time.Minute)
+	require.True(t, ok)
+	require.InDelta(t, 2.0, burnRate, 1e-9)
+	remaining, ok := state.errorBudgetRemaining(now, state.partitions[0])
+	require.True(t, ok)
+	require.InDelta(t, -1.0, remaining, 1e-9)
+
+	burnRate, ok = state.burnRate(now, state.cluster, 5*time.Minute)
+	require.True(t, ok)
+	require.InDelta(t, 3.0/11/0.1, burnRate, 1e-9)
+}
+
+func TestMonitorSLOEvents(t *testing.T) {
+	mockProducerClient := &MockKgoClient{
+		ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+			if r.Partition == 1 {
+				f(r, errors.New("produce failed"))
+				return
+			}
+			f(r, nil)
+		},
+	}
+	partitions := 2
+	m := NewMonitorWithClients(newTestMetrics(), mockProducerClient, "test-topic", nil, "test-uuid", partitions, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m.slos = newSLOTracker(m.metrics, []*config.SLOConfig{{Name: "e2e", LatencyThresholdMs: 500}})
+	m.slos.attach(partitions, m.labels)
+	m.trackingLoss.Store(true)
+
+	m.publishProbeBatch(context.Background())
+	// The failed probe is no longer pending, the acked one is lost once the timeout elapses
+	expiredAt := time.Now().Add(m.probeTimeout + time.Second)
+	m.expireLostProbes(expiredAt)
+
+	// Events are counted over a span covering both the produce failure and the expiration
+	state := m.slos.slos[0]
+	good, total := state.partitions[0].counts(expiredAt, time.Hour)
+	require.Equal(t, uint64(0), good)
+	require.Equal(t, uint64(1), total)
+	good, total = state.partitions[1].counts(expiredAt, time.Hour)
+	require.Equal(t, uint64(0), good)
+	require.Equal(t, uint64(1), total)
+}
+
+func TestMonitorSLOEventsWithoutConsumption(t *testing.T) {
+	mockProducerClient := &MockKgoClient{
+		ProduceFunc: func(ctx context.Context, r *kgo.Record, f func(*kgo.Record, error)) {
+			f(r, nil)
+		},
+	}
+	m := NewMonitorWithClients(newTestMetrics(), mockProducerClient, "test-topic", nil, "test-uuid", 1, time.Duration(1), time.Duration(5)*time.Minute, false)
+	m.slos = newSLOTracker(m.metrics, []*config.SLOConfig{{Name: "e2e", LatencyThresholdMs: 500}})
+	m.slos.attach(1, m.labels)
+
+	// Loss is tracked from the first acked produce, even though nothing is ever consumed
+	m.publishProbeBatch(context.Background())
+	require.True(t, m.trackingLoss.Load())
+	m.publishProbeBatch(context.Background())
+	expiredAt := time.Now().Add(m.probeTimeout + time.Second)
+	m.expireLostProbes(expiredAt)
+
+	good, total := m.slos.slos[0].partitions[0].counts(expiredAt, time.Hour)
+	require.Equal(t, uint64(0), good)
+	require.Equal(t, uint64(1), total)
+}
+
+func TestSLOTrackerSurvivesMonitorSwap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := newTestMetrics()
+	k := &KMon{
+		rootCtx: ctx,
+		slos:    newSLOTracker(metrics, []*config.SLOConfig{{Name: "e2e", LatencyThresholdMs: 500}}),
+		newMonitor: func(partitionBrokers []int32) (*Monitor, error) {
+			return NewMonitorWithClients(metrics, &MockKgoClient{}, "test-topic", &MockKgoClient{}, "test-uuid", len(partitionBrokers), time.Hour, time.Minute, false), nil
+		},
+	}
+	now := time.Now()
+
+	k.doneReconcilingCallback(make([]int32, 2))
+	k.getMonitor().slos.recordProduceFailure(now, 0)
+	k.getMonitor().slos.recordProduceFailure(now, 1)
+
+	// The partition that still exists keeps its events, the one that was removed is dropped
+	k.changeDetectedCallback()
+	k.doneReconcilingCallback(make([]int32, 1))
+	require.Same(t, k.slos, k.getMonitor().slos)
+	state := k.slos.slos[0]
+	require.Len(t, state.partitions, 1)
+	good, total := state.partitions[0].counts(now, time.Hour)
+	require.Equal(t, uint64(0), good)
+	require.Equal(t, uint64(1), total)
+	good, total = state.cluster.counts(now, time.Hour)
+	require.Equal(t, uint64(0), good)
+	require.Equal(t, uint64(2), total)
+}
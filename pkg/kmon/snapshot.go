@@ -0,0 +1,269 @@
+package kmon
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/phuslu/log"
+	"github.com/pliu/datastructs/pkg/stats"
+	"github.com/pliu/kmon/pkg/config"
+)
+
+// statsSnapshot holds the samples of a Monitor's windows, so that a new Monitor doesn't start with empty windows.
+type statsSnapshot struct {
+	TakenAt          time.Time `json:"takenAt"`
+	Mirror           bool      `json:"mirror"`
+	PartitionBrokers []int32   `json:"partitionBrokers"`
+	// Keyed by window name, then partition
+	Windows map[string]map[int][]snapshotSample `json:"windows"`
+}
+
+type snapshotSample struct {
+	TimestampMs int64 `json:"t"`
+	Value       int64 `json:"v"`
+}
+
+// sampleJournal keeps the timestamps of the samples of a stats window, which stats.Stats doesn't expose. Samples
+// older than the window are dropped as new ones are added.
+type sampleJournal struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []snapshotSample
+}
+
+func (j *sampleJournal) add(now time.Time, value int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.samples = append(j.samples, snapshotSample{TimestampMs: now.UnixMilli(), Value: value})
+	j.trim(now)
+}
+
+// restore adds samples taken by a previous Monitor, which are older than any added since.
+func (j *sampleJournal) restore(now time.Time, samples []snapshotSample) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.samples = append(slices.Clone(samples), j.samples...)
+	j.trim(now)
+}
+
+// snapshot returns the samples still within the window.
+func (j *sampleJournal) snapshot(now time.Time) []snapshotSample {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.trim(now)
+	return slices.Clone(j.samples)
+}
+
+func (j *sampleJournal) trim(now time.Time) {
+	cutoff := now.Add(-j.window).UnixMilli()
+	expired := 0
+	for expired < len(j.samples) && j.samples[expired].TimestampMs < cutoff {
+		expired++
+	}
+	j.samples = slices.Delete(j.samples, 0, expired)
+}
+
+// snapshotWindows returns the windows that are snapshotted, by name. Mesh windows are keyed by the instances seen so
+// far and are left out.
+func (m *Monitor) snapshotWindows() map[string]map[int]*stats.Stats {
+	windows := map[string]map[int]*stats.Stats{
+		config.LatencyTypeE2E: m.e2eStats,
+		config.LatencyTypeP2B: m.p2bStats,
+		config.LatencyTypeB2C: m.b2cStats,
+		config.LatencyTypeAck: m.producerAckStats,
+		"produceFailure":      m.produceFailureStats,
+		"lost":                m.lostStats,
+	}
+	for _, latencyType := range throttledLatencyTypes {
+		windows["throttled/"+latencyType] = m.throttledStats[latencyType]
+	}
+	return windows
+}
+
+// journalWindows keeps the timestamps of the samples added to every snapshotted window from now on, so that they can
+// be snapshotted. It must be called before the Monitor is started.
+func (m *Monitor) journalWindows(statsWindow time.Duration) {
+	m.journals = make(map[*stats.Stats]*sampleJournal)
+	for _, partitions := range m.snapshotWindows() {
+		for _, window := range partitions {
+			m.journals[window] = &sampleJournal{window: statsWindow}
+		}
+	}
+}
+
+// addSample adds a sample to the window, and to its journal if it has one.
+func (m *Monitor) addSample(window *stats.Stats, value int64) {
+	window.Add(value)
+	if journal, ok := m.journals[window]; ok {
+		journal.add(time.Now(), value)
+	}
+}
+
+// takeSnapshot returns the samples of every journaled window.
+func (m *Monitor) takeSnapshot(now time.Time) *statsSnapshot {
+	snapshot := &statsSnapshot{
+		TakenAt:          now,
+		Mirror:           m.isMirror,
+		PartitionBrokers: m.getPartitionBrokers(),
+		Windows:          make(map[string]map[int][]snapshotSample),
+	}
+	for name, partitions := range m.snapshotWindows() {
+		snapshot.Windows[name] = make(map[int][]snapshotSample)
+		for partition, window := range partitions {
+			if journal, ok := m.journals[window]; ok {
+				snapshot.Windows[name][partition] = journal.snapshot(now)
+			}
+		}
+	}
+	return snapshot
+}
+
+// restoreSnapshot adds the samples of a snapshot to the windows of the partitions whose leader hasn't changed since
+// it was taken, as the samples of a partition measure the broker leading it. It returns the restored partitions and
+// must be called before the Monitor is started.
+func (m *Monitor) restoreSnapshot(snapshot *statsSnapshot, now time.Time) []int {
+	if snapshot.Mirror != m.isMirror {
+		return nil
+	}
+	var restored []int
+	for partition := range m.pending {
+		if !m.snapshotCompatible(snapshot, partition) {
+			continue
+		}
+		for name, partitions := range m.snapshotWindows() {
+			samples := snapshot.Windows[name][partition]
+			window := partitions[partition]
+			restoreSamples(window, samples)
+			if journal, ok := m.journals[window]; ok {
+				journal.restore(now, samples)
+			}
+		}
+		restored = append(restored, partition)
+	}
+	slices.Sort(restored)
+	return restored
+}
+
+// snapshotCompatible returns whether the partition's samples in the snapshot were measured through the broker that
+// leads it now. Mirrored measurements aggregate all partitions, so their leaders must all be the same.
+func (m *Monitor) snapshotCompatible(snapshot *statsSnapshot, partition int) bool {
+	if m.isMirror {
+		return slices.Equal(snapshot.PartitionBrokers, m.partitionBrokers)
+	}
+	return partition < len(snapshot.PartitionBrokers) && partition < len(m.partitionBrokers) &&
+		snapshot.PartitionBrokers[partition] == m.partitionBrokers[partition]
+}
+
+// restoreSamples adds samples to the window with the time they were originally taken at, so that they expire from it
+// as they would have had the window never been recreated.
+func restoreSamples(window *stats.Stats, samples []snapshotSample) {
+	if len(samples) == 0 {
+		return
+	}
+	// The clock a window takes sample times from only moves forward
+	samples = slices.SortedStableFunc(slices.Values(samples), func(a, b snapshotSample) int {
+		return cmp.Compare(a.TimestampMs, b.TimestampMs)
+	})
+	clk := clock.NewMock()
+	// The window size only matters to the window the samples are merged into
+	restored := stats.NewStatsWithClock(time.Duration(1<<63-1), clk)
+	for _, sample := range samples {
+		clk.Set(time.UnixMilli(sample.TimestampMs))
+		restored.Add(sample.Value)
+	}
+	window.Merge(restored)
+}
+
+// statsSnapshotter saves the windows of the current Monitor to a file every interval, and when a Monitor is
+// stopped, so that the next Monitor, in this process or the next one, can restore them.
+type statsSnapshotter struct {
+	path     string
+	interval time.Duration
+	maxAge   time.Duration
+	monitor  func() *Monitor
+
+	// Serializes writes to the file
+	mu sync.Mutex
+}
+
+func newStatsSnapshotterFromConfig(cfg *config.StatsSnapshotConfig, monitor func() *Monitor) *statsSnapshotter {
+	return &statsSnapshotter{
+		path:     cfg.Path,
+		interval: time.Duration(cfg.GetIntervalSeconds()) * time.Second,
+		maxAge:   time.Duration(cfg.GetMaxAgeSeconds()) * time.Second,
+		monitor:  monitor,
+	}
+}
+
+func (s *statsSnapshotter) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.save(s.monitor()); err != nil {
+				log.Error().Err(err).Msgf("failed to save stats snapshot to %s", s.path)
+			}
+		}
+	}
+}
+
+// save writes the snapshot of the Monitor's windows. The snapshot is written to a temporary file first and renamed,
+// so that a crash while writing never leaves a truncated snapshot behind. A nil snapshotter or Monitor saves nothing.
+func (s *statsSnapshotter) save(m *Monitor) error {
+	if s == nil || m == nil {
+		return nil
+	}
+	data, err := json.Marshal(m.takeSnapshot(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// restore restores the last snapshot into the Monitor, unless there is none or it is older than the maximum age. A nil
+// snapshotter restores nothing.
+func (s *statsSnapshotter) restore(m *Monitor) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := os.ReadFile(s.path)
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	now := time.Now()
+	if age := now.Sub(snapshot.TakenAt); age > s.maxAge {
+		log.Info().Msgf("Not restoring the stats snapshot in %s, taken %s ago", s.path, age.Round(time.Second))
+		return nil
+	}
+	restored := m.restoreSnapshot(&snapshot, now)
+	log.Info().Msgf("Restored the stats of partitions %v from the snapshot in %s", restored, s.path)
+	return nil
+}
@@ -0,0 +1,83 @@
+package kmon
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotTestMonitor(partitionBrokers []int32) *Monitor {
+	m := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", len(partitionBrokers), time.Duration(1), time.Minute, false)
+	m.partitionBrokers = partitionBrokers
+	m.journalWindows(time.Minute)
+	return m
+}
+
+func TestMonitorSnapshot(t *testing.T) {
+	m := newSnapshotTestMonitor([]int32{1, 2})
+	m.addLatency(m.e2eStats[0], config.LatencyTypeE2E, 0, 10, false)
+	m.addLatency(m.e2eStats[0], config.LatencyTypeE2E, 0, 30, true)
+	m.addLatency(m.e2eStats[1], config.LatencyTypeE2E, 1, 20, false)
+	m.addSample(m.lostStats[0], 1)
+
+	now := time.Now()
+	snapshot := m.takeSnapshot(now)
+	// Samples that have expired by the time the snapshot is restored are left out
+	expired := snapshotSample{TimestampMs: now.Add(-2 * time.Minute).UnixMilli(), Value: 1000}
+	snapshot.Windows[config.LatencyTypeE2E][0] = slices.Insert(snapshot.Windows[config.LatencyTypeE2E][0], 0, expired)
+
+	// Partition 1 moved to another broker, so its samples measured a broker it is no longer on
+	restored := newSnapshotTestMonitor([]int32{1, 3, 2})
+	require.Equal(t, []int{0}, restored.restoreSnapshot(snapshot, now))
+	require.Equal(t, []int64{10, 30}, restored.e2eStats[0].Values())
+	require.Equal(t, []int64{30}, restored.throttledStats[config.LatencyTypeE2E][0].Values())
+	require.Equal(t, 1, restored.lostStats[0].Len())
+	require.Zero(t, restored.e2eStats[1].Len())
+	require.Zero(t, restored.e2eStats[2].Len())
+
+	// Restored samples are snapshotted again along with new ones
+	restored.addLatency(restored.e2eStats[0], config.LatencyTypeE2E, 0, 50, false)
+	var values []int64
+	for _, sample := range restored.takeSnapshot(time.Now()).Windows[config.LatencyTypeE2E][0] {
+		values = append(values, sample.Value)
+	}
+	require.Equal(t, []int64{10, 30, 50}, values)
+
+	// Mirrored measurements only restore from mirrored snapshots
+	mirror := NewMonitorWithClients(newTestMetrics(), &MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", 2, time.Duration(1), time.Minute, true)
+	mirror.partitionBrokers = []int32{1, 2}
+	require.Empty(t, mirror.restoreSnapshot(snapshot, now))
+}
+
+func TestStatsSnapshotter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	snapshotter := newStatsSnapshotterFromConfig(&config.StatsSnapshotConfig{Path: path}, nil)
+
+	// Nothing is restored until a snapshot has been saved
+	m := newSnapshotTestMonitor([]int32{1})
+	require.NoError(t, snapshotter.restore(m))
+	m.addLatency(m.e2eStats[0], config.LatencyTypeE2E, 0, 10, false)
+	require.NoError(t, snapshotter.save(m))
+	_, err := os.Stat(path + ".tmp")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	restored := newSnapshotTestMonitor([]int32{1})
+	require.NoError(t, snapshotter.restore(restored))
+	require.Equal(t, []int64{10}, restored.e2eStats[0].Values())
+
+	// Snapshots older than the maximum age are ignored
+	snapshotter.maxAge = 0
+	stale := newSnapshotTestMonitor([]int32{1})
+	require.NoError(t, snapshotter.restore(stale))
+	require.Zero(t, stale.e2eStats[0].Len())
+
+	// A nil snapshotter, as when snapshots are disabled, does nothing
+	var disabled *statsSnapshotter
+	require.NoError(t, disabled.save(m))
+	require.NoError(t, disabled.restore(m))
+}
@@ -0,0 +1,75 @@
+package kmon
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// anyBroker matches throttling by any broker, for when the broker a probe went through is unknown.
+const anyBroker int32 = -1
+
+type throttleWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// throttleTracker is a kgo hook recording when each broker throttled a monitoring client. Kafka responds straight
+// away with the throttle time and expects the client to hold off sending to it for that long, so a probe that was in
+// flight while any part of a throttle window elapsed may have been delayed by the quota rather than by the broker.
+// Only the latest window is kept per broker, with overlapping windows merged, which is enough for probes as they are
+// checked against it as soon as they complete.
+type throttleTracker struct {
+	metrics *Metrics
+	cluster string
+
+	mu      sync.Mutex
+	windows map[int32]throttleWindow
+}
+
+var _ kgo.HookBrokerThrottle = (*throttleTracker)(nil)
+
+func newThrottleTracker(metrics *Metrics, cluster string) *throttleTracker {
+	return &throttleTracker{
+		metrics: metrics,
+		cluster: cluster,
+		windows: make(map[int32]throttleWindow),
+	}
+}
+
+func (t *throttleTracker) OnBrokerThrottle(meta kgo.BrokerMetadata, throttleInterval time.Duration, _ bool) {
+	t.record(meta.NodeID, time.Now(), throttleInterval)
+}
+
+func (t *throttleTracker) record(broker int32, now time.Time, throttleInterval time.Duration) {
+	t.metrics.ProbeThrottleTime.WithLabelValues(t.cluster, strconv.Itoa(int(broker))).Observe(float64(throttleInterval.Milliseconds()))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window, exists := t.windows[broker]
+	end := now.Add(throttleInterval)
+	if !exists || now.After(window.end) {
+		t.windows[broker] = throttleWindow{start: now, end: end}
+	} else if end.After(window.end) {
+		t.windows[broker] = throttleWindow{start: window.start, end: end}
+	}
+}
+
+// throttledDuring returns whether the broker (or any broker for anyBroker) throttled the client at some point between
+// from and to. A nil tracker never reports throttling.
+func (t *throttleTracker) throttledDuring(broker int32, from time.Time, to time.Time) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for b, window := range t.windows {
+		if (broker == anyBroker || b == broker) && !window.start.After(to) && !window.end.Before(from) {
+			return true
+		}
+	}
+	return false
+}
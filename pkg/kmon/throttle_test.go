@@ -0,0 +1,70 @@
+package kmon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestThrottleTracker(t *testing.T) {
+	tracker := newThrottleTracker(newTestMetrics(), "producer")
+	start := time.Now()
+
+	tracker.record(1, start, 100*time.Millisecond)
+	// Overlapping windows are merged
+	tracker.record(1, start.Add(50*time.Millisecond), 100*time.Millisecond)
+
+	require.True(t, tracker.throttledDuring(1, start.Add(-time.Second), start))
+	require.True(t, tracker.throttledDuring(1, start.Add(140*time.Millisecond), start.Add(time.Second)))
+	require.False(t, tracker.throttledDuring(1, start.Add(200*time.Millisecond), start.Add(time.Second)))
+	require.False(t, tracker.throttledDuring(1, start.Add(-time.Second), start.Add(-time.Millisecond)))
+	require.False(t, tracker.throttledDuring(2, start, start.Add(time.Second)))
+	require.True(t, tracker.throttledDuring(anyBroker, start, start.Add(time.Second)))
+
+	// A window that doesn't overlap replaces the previous one
+	tracker.record(1, start.Add(time.Second), 100*time.Millisecond)
+	require.False(t, tracker.throttledDuring(1, start, start.Add(500*time.Millisecond)))
+
+	var nilTracker *throttleTracker
+	require.False(t, nilTracker.throttledDuring(anyBroker, start, start.Add(time.Second)))
+}
+
+func TestHandleConsumedRecordThrottled(t *testing.T) {
+	for _, excludeThrottled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("exclude=%t", excludeThrottled), func(t *testing.T) {
+			metrics, registry := newTestMetricsWithRegistry()
+			m := NewMonitorWithClients(metrics, &MockKgoClient{}, "", &MockKgoClient{}, "test-uuid", 2, time.Duration(1), 5*time.Minute, false)
+			m.partitionBrokers = []int32{1, 2}
+			m.producerThrottle = newThrottleTracker(metrics, "producer")
+			m.consumerThrottle = m.producerThrottle
+			m.excludeThrottled = excludeThrottled
+
+			now := time.Now()
+			m.producerThrottle.record(1, now.Add(-500*time.Millisecond), 200*time.Millisecond)
+			for p := range 2 {
+				sentAt := now.Add(-time.Second)
+				m.handleConsumedRecord(&kgo.Record{
+					Key:       []byte("test-uuid"),
+					Value:     []byte(fmt.Sprintf("%d", sentAt.UnixNano())),
+					Partition: int32(p),
+					Timestamp: sentAt.Add(10 * time.Millisecond),
+				}, now)
+			}
+
+			// Only partition 0 is led by the broker that throttled
+			require.Equal(t, map[string]float64{"0": 1}, metricSamples(t, registry, "kmon_throttled_probe_count"))
+			require.Equal(t, 1, m.throttledStats[config.LatencyTypeE2E][0].Len())
+			require.Equal(t, 0, m.throttledStats[config.LatencyTypeE2E][1].Len())
+			require.Equal(t, 1, m.e2eStats[1].Len())
+			if excludeThrottled {
+				require.Equal(t, 0, m.e2eStats[0].Len())
+			} else {
+				require.Equal(t, 1, m.e2eStats[0].Len())
+			}
+		})
+	}
+}
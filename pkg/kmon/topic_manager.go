@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/phuslu/log"
@@ -18,28 +21,75 @@ import (
 
 // TODO: Figure out how topic manager manages topics across clusters for cross-cluster measurement
 type TopicManager struct {
+	metrics                 *Metrics
 	client                  *kgo.Client
 	admClient               *kadm.Client
 	topicName               string
 	reconciliationInterval  time.Duration
 	previousBrokerSet       *set.Set[int32]
 	changeDetectedCallback  func()
-	doneReconcilingCallback func(int)
-	reconciling             bool
+	doneReconcilingCallback func([]int32)
+	// Called when only the leaders of the followed topic's partitions change, if set
+	leadersChangedCallback func([]int32)
+	reconciling            bool
+	// In dry run mode, plans are logged and exported but never executed, and the topic is monitored as it is
+	dryRun bool
+	// Layout the current Monitor was started on
+	followedLayout []int32
+	// In read-only mode, the topic is only ever discovered through metadata and monitored as it is
+	readOnly bool
+	// When running alongside other replicas, only the leader reconciles the topic and the others behave as in
+	// read-only mode. Without leader, kmon always leads.
+	leader func() bool
+	// Only topics marked with owner are modified, unless adoptTopic is set
+	owner      string
+	adoptTopic bool
+	// Set once this process creates the topic, which is then kmon's even if marking it failed
+	createdTopic bool
+	// Reconciliation is skipped while paused returns true, if set
+	paused func() bool
+
+	// Guards status, which is read from other goroutines
+	statusMu sync.Mutex
+	status   topicStatus
 }
 
-func NewTopicManagerFromConfig(cfg *config.KMonConfig) (*TopicManager, error) {
-	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig)
+// topicStatus is what the TopicManager last did with the monitoring topic.
+type topicStatus struct {
+	// One of managed, dry_run, read_only or follower, when another replica leads
+	Mode             string                  `json:"mode"`
+	LastCheckAt      time.Time               `json:"lastCheckAt"`
+	LastReconciledAt time.Time               `json:"lastReconciledAt"`
+	LastError        string                  `json:"lastError,omitempty"`
+	Reconciling      bool                    `json:"reconciling"`
+	PlannedActions   map[TopicActionType]int `json:"plannedActions"`
+}
+
+func NewTopicManagerFromConfig(cfg *config.KMonConfig, metrics *Metrics) (*TopicManager, error) {
+	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleAdmin, metrics.Clients)
 	if err != nil {
 		return nil, err
 	}
 
+	reconciliationInterval := time.Duration(cfg.GetTopicReconciliationFrequencyMin()) * time.Minute
+	if cfg.ReadOnly != nil {
+		reconciliationInterval = time.Duration(cfg.ReadOnly.GetRefreshIntervalSeconds()) * time.Second
+	} else if cfg.HighAvailability != nil {
+		// Replicas that don't lead need to notice the leader's changes quickly
+		reconciliationInterval = time.Duration(cfg.HighAvailability.GetRefreshIntervalSeconds()) * time.Second
+	}
+
 	return &TopicManager{
+		metrics:                metrics,
 		client:                 client,
 		admClient:              kadm.NewClient(client),
 		topicName:              cfg.ProducerMonitoringTopic,
-		reconciliationInterval: time.Duration(cfg.GetTopicReconciliationFrequencyMin()) * time.Minute,
+		reconciliationInterval: reconciliationInterval,
 		reconciling:            false,
+		dryRun:                 cfg.DryRun,
+		owner:                  monitoringTopicOwner(cfg.ProducerMonitoringTopic),
+		adoptTopic:             cfg.AdoptTopic,
+		readOnly:               cfg.ReadOnly != nil,
 	}, nil
 }
 
@@ -50,7 +100,16 @@ func (tm *TopicManager) Start(ctx context.Context) {
 	defer ticker.Stop()
 
 	for {
-		if err := tm.maybeReconcileTopic(ctx); err != nil {
+		err := tm.maybeReconcileTopic(ctx)
+		tm.updateStatus(func(status *topicStatus) {
+			status.LastCheckAt = time.Now()
+			status.LastError = ""
+			if err != nil {
+				status.LastError = err.Error()
+			}
+		})
+		if err != nil {
+			tm.metrics.TopicReconciliationFailureCount.WithLabelValues(tm.topicName).Inc()
 			log.Error().Err(err).Msg("failed to reconcile topic - retrying in 5s")
 			time.Sleep(5 * time.Second)
 			continue
@@ -67,32 +126,130 @@ func (tm *TopicManager) Start(ctx context.Context) {
 func (tm *TopicManager) maybeReconcileTopic(ctx context.Context) error {
 	log.Info().Msg("Checking whether to reconcile topic")
 
+	if tm.paused != nil && tm.paused() {
+		log.Warn().Msg("Topic reconciliation is paused")
+		return nil
+	}
+
 	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer timeoutCancel()
 
-	numPartitions, err := tm.getTopicNumPartitions(timeoutCtx)
+	if tm.readOnly || (tm.leader != nil && !tm.leader()) {
+		// Once leading again, monitoring restarts on the reconciled topic
+		tm.previousBrokerSet = nil
+		partitionLeaders, err := tm.getPartitionLeaders(timeoutCtx)
+		if err != nil {
+			return err
+		}
+		if partitionLeaders == nil {
+			log.Error().Msgf("Monitoring topic %s no longer exists, stopping monitoring until it is recreated", tm.topicName)
+		}
+		tm.followTopic(partitionLeaders)
+		return nil
+	}
+
+	brokerIDs, err := tm.getAllBrokers(timeoutCtx)
 	if err != nil {
 		return err
 	}
 
-	brokerIDs, err := tm.getAllBrokers(timeoutCtx)
+	plan, state, err := tm.plan(timeoutCtx, brokerIDs)
 	if err != nil {
 		return err
 	}
+	tm.reportPlan(plan)
+	if tm.dryRun {
+		tm.followTopic(state.partitionBrokers())
+		return nil
+	}
 
-	if tm.reconciling || numPartitions != brokerIDs.Len() || !brokerIDs.Equals(tm.previousBrokerSet) {
+	if tm.reconciling || len(plan.Actions) > 0 || !brokerIDs.Equals(tm.previousBrokerSet) {
 		tm.reconciling = true
+		tm.updateStatus(func(status *topicStatus) { status.Reconciling = true })
 		tm.changeDetectedCallback()
-		if err = tm.reconcileTopic(timeoutCtx, brokerIDs); err != nil {
+		if err = tm.executePlan(timeoutCtx, plan, state); err != nil {
 			return err
 		}
-		tm.doneReconcilingCallback(brokerIDs.Len())
+		tm.previousBrokerSet = brokerIDs
+		tm.metrics.TopicReconciliationCount.WithLabelValues(tm.topicName).Inc()
+		tm.followedLayout = plan.PartitionBrokers
+		tm.doneReconcilingCallback(plan.PartitionBrokers)
 		tm.reconciling = false
+		tm.updateStatus(func(status *topicStatus) {
+			status.Reconciling = false
+			status.LastReconciledAt = time.Now()
+		})
+	} else if err := tm.refreshOwnership(timeoutCtx); err != nil {
+		log.Warn().Err(err).Msg("failed to refresh topic ownership marker")
 	}
 
 	return nil
 }
 
+// followTopic restarts monitoring whenever the number of partitions of the topic changes, without reconciling it, and
+// otherwise only passes new leaders on to the current Monitor. Monitoring stops while the topic doesn't exist, which
+// partitionBrokers is nil for.
+func (tm *TopicManager) followTopic(partitionBrokers []int32) {
+	if tm.followedLayout != nil && slices.Equal(partitionBrokers, tm.followedLayout) {
+		return
+	}
+	if tm.followedLayout != nil && partitionBrokers != nil && len(partitionBrokers) == len(tm.followedLayout) {
+		log.Info().Msgf("Leaders of topic %s changed to %v", tm.topicName, partitionBrokers)
+		tm.followedLayout = partitionBrokers
+		if tm.leadersChangedCallback != nil {
+			tm.leadersChangedCallback(partitionBrokers)
+		}
+		return
+	}
+
+	tm.changeDetectedCallback()
+	tm.followedLayout = partitionBrokers
+	if partitionBrokers != nil {
+		tm.doneReconcilingCallback(partitionBrokers)
+	}
+}
+
+// reportPlan logs the plan's actions and exports how many of each type are planned.
+func (tm *TopicManager) reportPlan(plan *TopicPlan) {
+	counts := make(map[TopicActionType]int)
+	for _, action := range plan.Actions {
+		counts[action.Type]++
+		if tm.dryRun {
+			log.Info().Msgf("Dry run: would %s on topic %s: %s", action.Type, plan.Topic, action.Reason)
+		}
+	}
+	for _, actionType := range topicActionTypes {
+		tm.metrics.TopicPlannedActions.WithLabelValues(tm.topicName, string(actionType)).Set(float64(counts[actionType]))
+	}
+	tm.updateStatus(func(status *topicStatus) { status.PlannedActions = counts })
+}
+
+func (tm *TopicManager) updateStatus(update func(status *topicStatus)) {
+	tm.statusMu.Lock()
+	defer tm.statusMu.Unlock()
+	update(&tm.status)
+}
+
+// getStatus returns what the TopicManager last did with the monitoring topic.
+func (tm *TopicManager) getStatus() topicStatus {
+	tm.statusMu.Lock()
+	status := tm.status
+	status.PlannedActions = maps.Clone(tm.status.PlannedActions)
+	tm.statusMu.Unlock()
+
+	switch {
+	case tm.readOnly:
+		status.Mode = "read_only"
+	case tm.leader != nil && !tm.leader():
+		status.Mode = "follower"
+	case tm.dryRun:
+		status.Mode = "dry_run"
+	default:
+		status.Mode = "managed"
+	}
+	return status
+}
+
 func (tm *TopicManager) getTopicNumPartitions(ctx context.Context) (int, error) {
 	topicDetails, err := tm.admClient.ListTopics(ctx, tm.topicName)
 	if err != nil {
@@ -112,7 +269,40 @@ func (tm *TopicManager) getTopicNumPartitions(ctx context.Context) (int, error)
 	return 0, nil
 }
 
-func (tm *TopicManager) createTopic(ctx context.Context, brokerIDs *set.Set[int32]) error {
+// getPartitionLeaders returns the current leader of each partition of the topic, indexed by partition, or nil if the
+// topic doesn't exist. Partitions without a leader are attributed to their preferred leader, which probes failing
+// while it is down should count against, or to anyBroker if they have no replicas.
+func (tm *TopicManager) getPartitionLeaders(ctx context.Context) ([]int32, error) {
+	topicDetails, err := tm.admClient.ListTopics(ctx, tm.topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	td, exists := topicDetails[tm.topicName]
+	if !exists || errors.Is(td.Err, kerr.UnknownTopicOrPartition) {
+		return nil, nil
+	}
+	if td.Err != nil {
+		return nil, td.Err
+	}
+	partitionLeaders := make([]int32, len(td.Partitions))
+	for partition, pd := range td.Partitions {
+		if int(partition) >= len(partitionLeaders) {
+			continue
+		}
+		switch {
+		case pd.Leader >= 0:
+			partitionLeaders[partition] = pd.Leader
+		case len(pd.Replicas) > 0:
+			partitionLeaders[partition] = pd.Replicas[0]
+		default:
+			partitionLeaders[partition] = anyBroker
+		}
+	}
+	return partitionLeaders, nil
+}
+
+func (tm *TopicManager) createTopic(ctx context.Context, assignment map[int32][]int32, configs map[string]string) error {
 	log.Info().Msg("Creating topic")
 
 	createTopicsRequest := kmsg.NewCreateTopicsRequest()
@@ -120,8 +310,8 @@ func (tm *TopicManager) createTopic(ctx context.Context, brokerIDs *set.Set[int3
 	topic.Topic = tm.topicName
 	topic.NumPartitions = -1
 	topic.ReplicationFactor = -1
-	topic.Configs = tm.generateTopicConfigs()
-	topic.ReplicaAssignment = tm.generatePartitionAssignment(brokerIDs)
+	topic.Configs = tm.generateTopicConfigs(configs)
+	topic.ReplicaAssignment = tm.generatePartitionAssignment(assignment)
 	createTopicsRequest.Topics = append(createTopicsRequest.Topics, topic)
 
 	resp, err := createTopicsRequest.RequestWith(ctx, tm.client)
@@ -134,19 +324,22 @@ func (tm *TopicManager) createTopic(ctx context.Context, brokerIDs *set.Set[int3
 	if resp.Topics[0].ErrorCode != 0 && resp.Topics[0].ErrorCode != kerr.TopicAlreadyExists.Code {
 		return fmt.Errorf("failed to create topic: %s", *resp.Topics[0].ErrorMessage)
 	}
+	// A topic that already exists was created by someone else since it was planned
+	tm.createdTopic = resp.Topics[0].ErrorCode == 0
 
-	tm.previousBrokerSet = brokerIDs
-
-	return nil
+	return tm.waitUntilTopicExists(ctx)
 }
 
-func (tm *TopicManager) generateTopicConfigs() []kmsg.CreateTopicsRequestTopicConfig {
-	topicConfigs := []kmsg.CreateTopicsRequestTopicConfig{}
-	configs := map[string]string{
+func (tm *TopicManager) desiredTopicConfigs() map[string]string {
+	return map[string]string{
 		"message.timestamp.type": "LogAppendTime",
 		"min.insync.replicas":    "1",
 		"retention.ms":           "1800000",
 	}
+}
+
+func (tm *TopicManager) generateTopicConfigs(configs map[string]string) []kmsg.CreateTopicsRequestTopicConfig {
+	topicConfigs := []kmsg.CreateTopicsRequestTopicConfig{}
 	for k, v := range configs {
 		topicConfig := kmsg.NewCreateTopicsRequestTopicConfig()
 		topicConfig.Name = k
@@ -159,66 +352,125 @@ func (tm *TopicManager) generateTopicConfigs() []kmsg.CreateTopicsRequestTopicCo
 // Partitions are given only 1 replica to avoid the leader automatically moving if the desired primary broker is down
 // (this allows us to test individual brokers)
 // TODO: Use more replicas for cross-cluster testing?
-func (tm *TopicManager) generatePartitionAssignment(brokerIDs *set.Set[int32]) []kmsg.CreateTopicsRequestTopicReplicaAssignment {
+func (tm *TopicManager) generatePartitionAssignment(assignment map[int32][]int32) []kmsg.CreateTopicsRequestTopicReplicaAssignment {
 	replicaAssignments := []kmsg.CreateTopicsRequestTopicReplicaAssignment{}
-	for i, brokerID := range brokerIDs.Items() {
+	for _, partition := range slices.Sorted(maps.Keys(assignment)) {
 		replicaAssignment := kmsg.NewCreateTopicsRequestTopicReplicaAssignment()
-		replicaAssignment.Partition = int32(i)
-		replicaAssignment.Replicas = []int32{brokerID}
+		replicaAssignment.Partition = partition
+		replicaAssignment.Replicas = assignment[partition]
 		replicaAssignments = append(replicaAssignments, replicaAssignment)
 	}
 	return replicaAssignments
 }
 
-// This waits for 5 successes as each ListTopics is a metadata call to a random broker.
-// Writes (e.g., create, delete) go through the coordinator but take time to propogate to other brokers, resulting in eventual consistency.
+// partitionBrokers returns the broker that each partition is assigned to, indexed by partition. Brokers are sorted so
+// that the assignment is the same every time for a given set of brokers.
+func (tm *TopicManager) partitionBrokers(brokerIDs *set.Set[int32]) []int32 {
+	brokers := brokerIDs.Items()
+	slices.Sort(brokers)
+	return brokers
+}
+
+// waitUntilTopicExists waits until the metadata of every live broker has the topic. Writes (e.g., create, delete) go
+// through the controller but take time to propagate to other brokers, resulting in eventual consistency.
 func (tm *TopicManager) waitUntilTopicExists(ctx context.Context) error {
-	for i := 0; i < 5; {
-		topics, err := tm.admClient.ListTopics(ctx, tm.topicName)
-		if err == nil {
-			td, exists := topics[tm.topicName]
-			if exists && td.Err == nil {
-				i += 1
-			}
-		} else if errors.Is(err, context.DeadlineExceeded) {
-			return err
-		}
-		time.Sleep(200 * time.Millisecond)
+	brokerIDs, err := liveBrokers(ctx, tm.admClient)
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = waitForTopicPropagation(ctx, tm.client, tm.topicName, brokerIDs, true)
+	return err
 }
 
 func (tm *TopicManager) waitUntilTopicNoLongerExists(ctx context.Context) error {
-	for i := 0; i < 5; {
-		topics, err := tm.admClient.ListTopics(ctx)
-		if err == nil {
-			td, exists := topics[tm.topicName]
-			if !exists || errors.Is(td.Err, kerr.UnknownTopicOrPartition) {
-				i += 1
+	brokerIDs, err := liveBrokers(ctx, tm.admClient)
+	if err != nil {
+		return err
+	}
+	_, err = waitForTopicPropagation(ctx, tm.client, tm.topicName, brokerIDs, false)
+	return err
+}
+
+// liveBrokers returns the brokers currently registered with the cluster, which unlike getAllBrokers leaves out the
+// brokers that are down.
+func liveBrokers(ctx context.Context, admClient *kadm.Client) ([]int32, error) {
+	brokerDetails, err := admClient.ListBrokers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return brokerDetails.NodeIDs(), nil
+}
+
+// waitForTopicPropagation polls every given broker directly until its metadata agrees on whether the topic exists,
+// returning how long each broker took. Brokers that don't catch up before ctx is done are left out, and an error is
+// returned if there are any.
+func waitForTopicPropagation(ctx context.Context, client *kgo.Client, topic string, brokerIDs []int32, exists bool) (map[int32]time.Duration, error) {
+	start := time.Now()
+	var mu sync.Mutex
+	durations := make(map[int32]time.Duration, len(brokerIDs))
+	var wg sync.WaitGroup
+	for _, brokerID := range brokerIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			broker := client.Broker(int(brokerID))
+			for {
+				if e, err := topicExistsOn(ctx, broker, topic); err == nil && e == exists {
+					mu.Lock()
+					durations[brokerID] = time.Since(start)
+					mu.Unlock()
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
 			}
-		} else if errors.Is(err, context.DeadlineExceeded) {
-			return err
-		}
-		time.Sleep(200 * time.Millisecond)
+		}()
 	}
-	return nil
+	wg.Wait()
+
+	if len(durations) < len(brokerIDs) {
+		return durations, fmt.Errorf("topic %s didn't propagate to %d of %d brokers: %w", topic, len(brokerIDs)-len(durations), len(brokerIDs), ctx.Err())
+	}
+	return durations, nil
 }
 
-func (tm *TopicManager) reconcileTopic(ctx context.Context, brokerIDs *set.Set[int32]) error {
-	log.Info().Msg("Reconciling topic")
+// topicExistsOn returns whether the metadata of the broker r sends requests to has the topic.
+func topicExistsOn(ctx context.Context, r kmsg.Requestor, topic string) (bool, error) {
+	req := kmsg.NewPtrMetadataRequest()
+	reqTopic := kmsg.NewMetadataRequestTopic()
+	reqTopic.Topic = kmsg.StringPtr(topic)
+	req.Topics = append(req.Topics, reqTopic)
+	req.AllowAutoTopicCreation = false
+	resp, err := req.RequestWith(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Topics) != 1 {
+		return false, fmt.Errorf("unexpected number of topics in response: %d", len(resp.Topics))
+	}
+	switch err := kerr.ErrorForCode(resp.Topics[0].ErrorCode); {
+	case err == nil:
+		return len(resp.Topics[0].Partitions) > 0, nil
+	case errors.Is(err, kerr.UnknownTopicOrPartition):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (tm *TopicManager) deleteTopic(ctx context.Context) error {
+	log.Info().Msg("Deleting topic")
 
 	if _, err := tm.admClient.DeleteTopic(ctx, tm.topicName); err != nil {
 		if !errors.Is(err, kerr.UnknownTopicOrPartition) {
 			return err
 		}
 	}
-	if err := tm.waitUntilTopicNoLongerExists(ctx); err != nil {
-		return err
-	}
-	if err := tm.createTopic(ctx, brokerIDs); err != nil {
-		return err
-	}
-	return tm.waitUntilTopicExists(ctx)
+	tm.createdTopic = false
+	return tm.waitUntilTopicNoLongerExists(ctx)
 }
 
 // GetAllBrokers gets all unique broker IDs from both the admin client's list of brokers
@@ -5,6 +5,7 @@ package kmon
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/pliu/kmon/pkg/config"
 	"github.com/stretchr/testify/require"
@@ -19,10 +20,10 @@ func setupTopicManager(t *testing.T, topic string) (*TopicManager, context.Conte
 		},
 	}
 
-	tm, err := NewTopicManagerFromConfig(cfg)
+	tm, err := NewTopicManagerFromConfig(cfg, newTestMetrics())
 	require.NoError(t, err)
 	tm.changeDetectedCallback = func() {}
-	tm.doneReconcilingCallback = func(i int) {}
+	tm.doneReconcilingCallback = func(partitionBrokers []int32) {}
 
 	t.Cleanup(func() {
 		_, _ = tm.admClient.DeleteTopics(ctx, topic)
@@ -61,8 +62,101 @@ func TestTopicManagerMaybeReconcileTopicIncorrectTopic(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, numPartitions)
 
+	tm.adoptTopic = true
 	require.NoError(t, tm.maybeReconcileTopic(ctx))
 	numPartitions, err = tm.getTopicNumPartitions(ctx)
 	require.NoError(t, err)
 	require.Equal(t, 3, numPartitions)
 }
+
+func TestTopicManagerMaybeReconcileTopicUnownedTopic(t *testing.T) {
+	topic := "kmon-unowned"
+	tm, ctx := setupTopicManager(t, topic)
+
+	_, _ = tm.admClient.DeleteTopics(ctx, topic)
+	tm.waitUntilTopicNoLongerExists(ctx)
+
+	_, err := tm.admClient.CreateTopics(context.Background(), 1, 1, nil, topic)
+	require.NoError(t, err)
+	tm.waitUntilTopicExists(ctx)
+
+	require.Error(t, tm.maybeReconcileTopic(ctx))
+	numPartitions, err := tm.getTopicNumPartitions(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, numPartitions)
+
+	// Topics kmon creates are marked as its own, so they can be reconciled later
+	require.NoError(t, tm.deleteTopic(ctx))
+	require.NoError(t, tm.maybeReconcileTopic(ctx))
+	owner, err := getTopicOwner(ctx, tm.admClient, topic)
+	require.NoError(t, err)
+	require.Equal(t, monitoringTopicOwner(topic), owner)
+}
+
+func TestTopicManagerMaybeReconcileTopicReadOnly(t *testing.T) {
+	topic := "kmon-read-only"
+	tm, ctx := setupTopicManager(t, topic)
+	tm.readOnly = true
+	var layouts [][]int32
+	tm.doneReconcilingCallback = func(partitionBrokers []int32) { layouts = append(layouts, partitionBrokers) }
+
+	_, _ = tm.admClient.DeleteTopics(ctx, topic)
+	tm.waitUntilTopicNoLongerExists(ctx)
+
+	// A missing topic is never created
+	require.NoError(t, tm.maybeReconcileTopic(ctx))
+	numPartitions, err := tm.getTopicNumPartitions(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, numPartitions)
+	require.Empty(t, layouts)
+
+	// An existing topic is monitored as it is, and followed when its partitions change
+	_, err = tm.admClient.CreateTopics(context.Background(), 1, 1, nil, topic)
+	require.NoError(t, err)
+	tm.waitUntilTopicExists(ctx)
+	require.NoError(t, tm.maybeReconcileTopic(ctx))
+	require.Len(t, layouts, 1)
+	require.Len(t, layouts[0], 1)
+
+	_, err = tm.admClient.CreatePartitions(ctx, 1, topic)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		require.NoError(t, tm.maybeReconcileTopic(ctx))
+		return len(layouts) == 2
+	}, 10*time.Second, 500*time.Millisecond)
+	require.Len(t, layouts[1], 2)
+}
+
+func TestTopicManagerVerifyOwnershipOfCreatedTopic(t *testing.T) {
+	topic := "kmon-created-unmarked"
+	tm, ctx := setupTopicManager(t, topic)
+
+	_, _ = tm.admClient.DeleteTopics(ctx, topic)
+	tm.waitUntilTopicNoLongerExists(ctx)
+
+	// The topic is kmon's even if marking it failed after creating it
+	require.NoError(t, tm.createTopic(ctx, nil, tm.desiredTopicConfigs()))
+	require.NoError(t, tm.verifyOwnership(ctx))
+	owner, err := getTopicOwner(ctx, tm.admClient, topic)
+	require.NoError(t, err)
+	require.Equal(t, monitoringTopicOwner(topic), owner)
+}
+
+func TestTopicManagerExecutePlanRefusesTopicCreatedConcurrently(t *testing.T) {
+	topic := "kmon-created-concurrently"
+	tm, ctx := setupTopicManager(t, topic)
+
+	_, _ = tm.admClient.DeleteTopics(ctx, topic)
+	tm.waitUntilTopicNoLongerExists(ctx)
+	plan := planTopic(topic, topicState{}, []int32{1}, tm.desiredTopicConfigs())
+
+	// Someone else creates the topic between planning and execution
+	_, err := tm.admClient.CreateTopics(ctx, 1, 1, nil, topic)
+	require.NoError(t, err)
+	defer tm.admClient.DeleteTopics(ctx, topic)
+
+	require.ErrorContains(t, tm.executePlan(ctx, plan, topicState{}), "set adoptTopic to take it over")
+	owner, err := getTopicOwner(ctx, tm.admClient, topic)
+	require.NoError(t, err)
+	require.Empty(t, owner)
+}
@@ -0,0 +1,389 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/datastructs/pkg/set"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/pliu/kmon/pkg/metrics"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+type TopicActionType string
+
+const (
+	TopicActionDelete        TopicActionType = "delete_topic"
+	TopicActionCreate        TopicActionType = "create_topic"
+	TopicActionReassign      TopicActionType = "reassign_partitions"
+	TopicActionAddPartitions TopicActionType = "add_partitions"
+	TopicActionAlterConfigs  TopicActionType = "alter_configs"
+)
+
+var topicActionTypes = []TopicActionType{TopicActionDelete, TopicActionCreate, TopicActionReassign, TopicActionAddPartitions, TopicActionAlterConfigs}
+
+// TopicAction is a single change to the monitoring topic. Assignment maps partitions to their replicas for creations,
+// reassignments and added partitions, and Configs holds the configs to set for config changes.
+type TopicAction struct {
+	Type       TopicActionType   `json:"type"`
+	Reason     string            `json:"reason"`
+	Assignment map[int32][]int32 `json:"assignment,omitempty"`
+	Configs    map[string]string `json:"configs,omitempty"`
+}
+
+// TopicPlan is the list of actions that turn the observed monitoring topic into the desired one, in the order they
+// must be executed. PartitionBrokers is the desired broker of each partition, indexed by partition.
+type TopicPlan struct {
+	Topic            string        `json:"topic"`
+	PartitionBrokers []int32       `json:"partitionBrokers"`
+	Actions          []TopicAction `json:"actions"`
+}
+
+// topicState is the observed state of the monitoring topic. Offline partitions are those without a leader, i.e.
+// whose replicas are all offline.
+type topicState struct {
+	exists   bool
+	replicas map[int32][]int32
+	offline  map[int32]bool
+	configs  map[string]string
+}
+
+// planTopic returns the actions turning the observed topic into one with a partition per broker, each only replicated
+// on its broker, and the desired configs. Partitions can't be removed, and reassignments copy partitions from their
+// current replicas, so a topic with too many partitions or with offline partitions to move is recreated; otherwise
+// misplaced partitions are reassigned and missing ones added.
+func planTopic(topic string, state topicState, partitionBrokers []int32, desiredConfigs map[string]string) *TopicPlan {
+	plan := &TopicPlan{Topic: topic, PartitionBrokers: partitionBrokers, Actions: []TopicAction{}}
+	desiredAssignment := make(map[int32][]int32)
+	for partition, broker := range partitionBrokers {
+		desiredAssignment[int32(partition)] = []int32{broker}
+	}
+
+	if state.exists {
+		stranded := []int32{}
+		for partition, replicas := range desiredAssignment {
+			if current, exists := state.replicas[partition]; exists && state.offline[partition] && !slices.Equal(current, replicas) {
+				stranded = append(stranded, partition)
+			}
+		}
+		slices.Sort(stranded)
+
+		reason := ""
+		if len(state.replicas) > len(partitionBrokers) {
+			reason = fmt.Sprintf("topic has %d partitions but there are only %d brokers", len(state.replicas), len(partitionBrokers))
+		} else if len(stranded) > 0 {
+			reason = fmt.Sprintf("partitions %v must be moved but are offline", stranded)
+		}
+		if reason != "" {
+			plan.Actions = append(plan.Actions, TopicAction{Type: TopicActionDelete, Reason: reason})
+			state = topicState{}
+		}
+	}
+	if !state.exists {
+		plan.Actions = append(plan.Actions, TopicAction{
+			Type:       TopicActionCreate,
+			Reason:     "topic does not exist",
+			Assignment: desiredAssignment,
+			Configs:    desiredConfigs,
+		})
+		return plan
+	}
+
+	reassign := make(map[int32][]int32)
+	add := make(map[int32][]int32)
+	for partition, replicas := range desiredAssignment {
+		current, exists := state.replicas[partition]
+		if !exists {
+			add[partition] = replicas
+		} else if !slices.Equal(current, replicas) {
+			reassign[partition] = replicas
+		}
+	}
+	if len(reassign) > 0 {
+		plan.Actions = append(plan.Actions, TopicAction{
+			Type:       TopicActionReassign,
+			Reason:     fmt.Sprintf("%d partitions are not on their broker", len(reassign)),
+			Assignment: reassign,
+		})
+	}
+	if len(add) > 0 {
+		plan.Actions = append(plan.Actions, TopicAction{
+			Type:       TopicActionAddPartitions,
+			Reason:     fmt.Sprintf("topic has %d partitions but there are %d brokers", len(state.replicas), len(partitionBrokers)),
+			Assignment: add,
+		})
+	}
+
+	changedConfigs := make(map[string]string)
+	for name, value := range desiredConfigs {
+		if state.configs[name] != value {
+			changedConfigs[name] = value
+		}
+	}
+	if len(changedConfigs) > 0 {
+		plan.Actions = append(plan.Actions, TopicAction{
+			Type:    TopicActionAlterConfigs,
+			Reason:  fmt.Sprintf("%d configs differ", len(changedConfigs)),
+			Configs: changedConfigs,
+		})
+	}
+	return plan
+}
+
+// WriteTable writes the plan as a human readable table.
+func (p *TopicPlan) WriteTable(w io.Writer) error {
+	if len(p.Actions) == 0 {
+		_, err := fmt.Fprintf(w, "Topic %s is up to date\n", p.Topic)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tREASON\tDETAILS")
+	for _, action := range p.Actions {
+		details := []string{}
+		for _, partition := range slices.Sorted(maps.Keys(action.Assignment)) {
+			details = append(details, fmt.Sprintf("%d->%v", partition, action.Assignment[partition]))
+		}
+		for _, name := range slices.Sorted(maps.Keys(action.Configs)) {
+			details = append(details, fmt.Sprintf("%s=%s", name, action.Configs[name]))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", action.Type, action.Reason, strings.Join(details, " "))
+	}
+	return tw.Flush()
+}
+
+// PlanTopic returns the plan for reconciling the monitoring topic described by cfg, without executing it.
+func PlanTopic(ctx context.Context, cfg *config.KMonConfig) (*TopicPlan, error) {
+	tm, err := NewTopicManagerFromConfig(cfg, NewMetrics(metrics.NewNopSink()))
+	if err != nil {
+		return nil, err
+	}
+	defer tm.admClient.Close()
+	return tm.Plan(ctx)
+}
+
+// Plan observes the cluster and returns the actions that reconciling the monitoring topic would take, without
+// executing them.
+func (tm *TopicManager) Plan(ctx context.Context) (*TopicPlan, error) {
+	brokerIDs, err := tm.getAllBrokers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan, _, err := tm.plan(ctx, brokerIDs)
+	return plan, err
+}
+
+// plan returns the plan along with the observed state it was made from.
+func (tm *TopicManager) plan(ctx context.Context, brokerIDs *set.Set[int32]) (*TopicPlan, topicState, error) {
+	state, err := tm.observeTopic(ctx)
+	if err != nil {
+		return nil, state, err
+	}
+	return planTopic(tm.topicName, state, tm.partitionBrokers(brokerIDs), tm.desiredTopicConfigs()), state, nil
+}
+
+// partitionBrokers returns the preferred leader of each partition, indexed by partition, or nil if the topic doesn't
+// exist.
+func (s topicState) partitionBrokers() []int32 {
+	if !s.exists {
+		return nil
+	}
+	partitionBrokers := make([]int32, len(s.replicas))
+	for partition, replicas := range s.replicas {
+		if int(partition) < len(partitionBrokers) && len(replicas) > 0 {
+			partitionBrokers[partition] = replicas[0]
+		}
+	}
+	return partitionBrokers
+}
+
+func (tm *TopicManager) observeTopic(ctx context.Context) (topicState, error) {
+	state := topicState{}
+	topics, err := tm.admClient.ListTopics(ctx, tm.topicName)
+	if err != nil {
+		return state, err
+	}
+	td, exists := topics[tm.topicName]
+	if !exists || errors.Is(td.Err, kerr.UnknownTopicOrPartition) {
+		return state, nil
+	}
+	if td.Err != nil {
+		return state, td.Err
+	}
+
+	state.exists = true
+	state.replicas = make(map[int32][]int32)
+	state.offline = make(map[int32]bool)
+	for partition, pd := range td.Partitions {
+		state.replicas[partition] = pd.Replicas
+		state.offline[partition] = pd.Leader < 0
+	}
+
+	configs, err := tm.admClient.DescribeTopicConfigs(ctx, tm.topicName)
+	if err != nil {
+		return state, err
+	}
+	rc, err := configs.On(tm.topicName, nil)
+	if err != nil {
+		return state, err
+	}
+	if rc.Err != nil {
+		return state, rc.Err
+	}
+	state.configs = make(map[string]string)
+	for _, c := range rc.Configs {
+		state.configs[c.Key] = c.MaybeValue()
+	}
+	return state, nil
+}
+
+// executePlan runs the plan's actions in order, waiting for each to take effect before moving on to the next. An
+// existing topic is only ever modified if it is kmon's, and topics are marked as soon as they are created.
+func (tm *TopicManager) executePlan(ctx context.Context, plan *TopicPlan, state topicState) error {
+	if state.exists && len(plan.Actions) > 0 {
+		if err := tm.verifyOwnership(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, action := range plan.Actions {
+		log.Info().Msgf("Executing %s on topic %s: %s", action.Type, plan.Topic, action.Reason)
+
+		var err error
+		switch action.Type {
+		case TopicActionDelete:
+			err = tm.deleteTopic(ctx)
+		case TopicActionCreate:
+			err = tm.createTopic(ctx, action.Assignment, action.Configs)
+			if err == nil && tm.createdTopic {
+				err = tm.markCreatedTopic(ctx)
+			} else if err == nil {
+				// Only a topic this process created is marked, anyone else's must already be kmon's
+				err = tm.verifyOwnership(ctx)
+			}
+		case TopicActionReassign:
+			err = tm.reassignPartitions(ctx, action.Assignment)
+		case TopicActionAddPartitions:
+			err = tm.addPartitions(ctx, len(plan.PartitionBrokers), action.Assignment)
+		case TopicActionAlterConfigs:
+			err = tm.alterConfigs(ctx, action.Configs)
+		default:
+			err = fmt.Errorf("unknown topic action %s", action.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %s: %w", action.Type, err)
+		}
+	}
+	return nil
+}
+
+func (tm *TopicManager) reassignPartitions(ctx context.Context, assignment map[int32][]int32) error {
+	req := kadm.AlterPartitionAssignmentsReq{}
+	for partition, replicas := range assignment {
+		req.Assign(tm.topicName, partition, replicas)
+	}
+	resp, err := tm.admClient.AlterPartitionAssignments(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := resp.Error(); err != nil {
+		return err
+	}
+
+	partitions := slices.Collect(maps.Keys(assignment))
+	topicsSet := kadm.TopicsSet{}
+	topicsSet.Add(tm.topicName, partitions...)
+	for {
+		reassignments, err := tm.admClient.ListPartitionReassignments(ctx, topicsSet)
+		if err == nil && len(reassignments[tm.topicName]) == 0 {
+			return nil
+		} else if ctx.Err() != nil {
+			// A reassignment left running blocks the next ones of its partitions, which reconciliation retries
+			tm.cancelReassignments(ctx, partitions)
+			return ctx.Err()
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// cancelReassignments cancels the ongoing reassignments of the partitions, which is attempted even once ctx is done.
+func (tm *TopicManager) cancelReassignments(ctx context.Context, partitions []int32) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	req := kadm.AlterPartitionAssignmentsReq{}
+	for _, partition := range partitions {
+		req.CancelAssign(tm.topicName, partition)
+	}
+	resp, err := tm.admClient.AlterPartitionAssignments(ctx, req)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to cancel the reassignments of topic %s", tm.topicName)
+		return
+	}
+	for _, r := range resp[tm.topicName] {
+		// Reassignments that completed in the meantime have nothing to cancel
+		if r.Err != nil && !errors.Is(r.Err, kerr.NoReassignmentInProgress) {
+			log.Error().Err(r.Err).Msgf("failed to cancel the reassignment of partition %d of topic %s", r.Partition, tm.topicName)
+		}
+	}
+}
+
+func (tm *TopicManager) addPartitions(ctx context.Context, count int, assignment map[int32][]int32) error {
+	req := kmsg.NewCreatePartitionsRequest()
+	topic := kmsg.NewCreatePartitionsRequestTopic()
+	topic.Topic = tm.topicName
+	topic.Count = int32(count)
+	// Added partitions are numbered after the existing ones
+	for _, partition := range slices.Sorted(maps.Keys(assignment)) {
+		a := kmsg.NewCreatePartitionsRequestTopicAssignment()
+		a.Replicas = assignment[partition]
+		topic.Assignment = append(topic.Assignment, a)
+	}
+	req.Topics = append(req.Topics, topic)
+
+	resp, err := req.RequestWith(ctx, tm.client)
+	if err != nil {
+		return err
+	}
+	for _, t := range resp.Topics {
+		if err := kerr.ErrorForCode(t.ErrorCode); err != nil {
+			return err
+		}
+	}
+
+	for {
+		numPartitions, err := tm.getTopicNumPartitions(ctx)
+		if err == nil && numPartitions == count {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (tm *TopicManager) alterConfigs(ctx context.Context, configs map[string]string) error {
+	alterConfigs := []kadm.AlterConfig{}
+	for name, value := range configs {
+		alterConfigs = append(alterConfigs, kadm.AlterConfig{Op: kadm.SetConfig, Name: name, Value: kadm.StringPtr(value)})
+	}
+	resp, err := tm.admClient.AlterTopicConfigs(ctx, alterConfigs, tm.topicName)
+	if err != nil {
+		return err
+	}
+	r, err := resp.On(tm.topicName, nil)
+	if err != nil {
+		return err
+	}
+	return r.Err
+}
@@ -0,0 +1,116 @@
+package kmon
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanTopic(t *testing.T) {
+	desiredConfigs := map[string]string{"retention.ms": "1800000"}
+	upToDate := map[string]string{"retention.ms": "1800000", "cleanup.policy": "delete"}
+
+	t.Run("missing", func(t *testing.T) {
+		plan := planTopic("kmon", topicState{}, []int32{1, 2}, desiredConfigs)
+		require.Equal(t, []TopicAction{{
+			Type:       TopicActionCreate,
+			Reason:     "topic does not exist",
+			Assignment: map[int32][]int32{0: {1}, 1: {2}},
+			Configs:    desiredConfigs,
+		}}, plan.Actions)
+	})
+
+	t.Run("up to date", func(t *testing.T) {
+		state := topicState{exists: true, replicas: map[int32][]int32{0: {1}, 1: {2}}, configs: upToDate}
+		plan := planTopic("kmon", state, []int32{1, 2}, desiredConfigs)
+		require.Empty(t, plan.Actions)
+		require.Equal(t, []int32{1, 2}, state.partitionBrokers())
+	})
+
+	t.Run("too many partitions", func(t *testing.T) {
+		state := topicState{exists: true, replicas: map[int32][]int32{0: {1}, 1: {2}, 2: {3}}, configs: upToDate}
+		plan := planTopic("kmon", state, []int32{1, 2}, desiredConfigs)
+		require.Len(t, plan.Actions, 2)
+		require.Equal(t, TopicActionDelete, plan.Actions[0].Type)
+		require.Equal(t, TopicActionCreate, plan.Actions[1].Type)
+	})
+
+	t.Run("broker replaced and added", func(t *testing.T) {
+		state := topicState{exists: true, replicas: map[int32][]int32{0: {1}, 1: {2}}, configs: map[string]string{"retention.ms": "60000"}}
+		plan := planTopic("kmon", state, []int32{1, 3, 4}, desiredConfigs)
+		require.Equal(t, []TopicAction{
+			{Type: TopicActionReassign, Reason: "1 partitions are not on their broker", Assignment: map[int32][]int32{1: {3}}},
+			{Type: TopicActionAddPartitions, Reason: "topic has 2 partitions but there are 3 brokers", Assignment: map[int32][]int32{2: {4}}},
+			{Type: TopicActionAlterConfigs, Reason: "1 configs differ", Configs: desiredConfigs},
+		}, plan.Actions)
+
+		var table bytes.Buffer
+		require.NoError(t, plan.WriteTable(&table))
+		require.Contains(t, table.String(), "1->[3]")
+		require.Contains(t, table.String(), "retention.ms=1800000")
+	})
+
+	t.Run("offline partition to move", func(t *testing.T) {
+		state := topicState{
+			exists:   true,
+			replicas: map[int32][]int32{0: {1}, 1: {3}},
+			offline:  map[int32]bool{1: true},
+			configs:  upToDate,
+		}
+		plan := planTopic("kmon", state, []int32{1, 2, 3}, desiredConfigs)
+		require.Equal(t, []TopicAction{
+			{Type: TopicActionDelete, Reason: "partitions [1] must be moved but are offline"},
+			{Type: TopicActionCreate, Reason: "topic does not exist", Assignment: map[int32][]int32{0: {1}, 1: {2}, 2: {3}}, Configs: desiredConfigs},
+		}, plan.Actions)
+
+		// Offline partitions that stay on their broker wait for it to come back
+		state.replicas[1] = []int32{2}
+		plan = planTopic("kmon", state, []int32{1, 2, 3}, desiredConfigs)
+		require.Len(t, plan.Actions, 1)
+		require.Equal(t, TopicActionAddPartitions, plan.Actions[0].Type)
+	})
+}
+
+func TestTopicManagerFollowTopic(t *testing.T) {
+	changes := 0
+	layouts := [][]int32{}
+	leaders := [][]int32{}
+	tm := &TopicManager{
+		changeDetectedCallback:  func() { changes++ },
+		doneReconcilingCallback: func(partitionBrokers []int32) { layouts = append(layouts, partitionBrokers) },
+		leadersChangedCallback:  func(partitionBrokers []int32) { leaders = append(leaders, partitionBrokers) },
+	}
+
+	tm.followTopic([]int32{1, 2})
+	tm.followTopic([]int32{1, 2})
+	require.Equal(t, 1, changes)
+	require.Equal(t, [][]int32{{1, 2}}, layouts)
+
+	// A leader election only relabels the current Monitor
+	tm.followTopic([]int32{1, 1})
+	require.Equal(t, 1, changes)
+	require.Equal(t, [][]int32{{1, 1}}, leaders)
+
+	// A new partition restarts monitoring on the new layout
+	tm.followTopic([]int32{1, 2, 3})
+	require.Equal(t, [][]int32{{1, 2}, {1, 2, 3}}, layouts)
+
+	// Monitoring stops while the topic doesn't exist
+	tm.followTopic(nil)
+	require.Equal(t, 3, changes)
+	require.Len(t, layouts, 2)
+	require.Len(t, leaders, 1)
+}
+
+func TestTopicManagerOwnsTopic(t *testing.T) {
+	tm := &TopicManager{owner: monitoringTopicOwner("kmon")}
+	require.True(t, tm.ownsTopic(monitoringTopicOwner("kmon")))
+	require.False(t, tm.ownsTopic(""))
+	require.False(t, tm.ownsTopic("someone-else"))
+
+	// An unmarked topic created by this process is kmon's, but not a topic marked by someone else
+	tm.createdTopic = true
+	require.True(t, tm.ownsTopic(""))
+	require.False(t, tm.ownsTopic("someone-else"))
+}
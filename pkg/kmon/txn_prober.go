@@ -0,0 +1,326 @@
+package kmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/clients"
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// txnProber runs a transactional probe stream next to the Monitor: for every broker acting as a transaction
+// coordinator, it periodically begins a transaction, produces a probe to every partition and commits, and a
+// read_committed consumer measures how long it takes for the committed probes to become visible.
+//
+// Each coordinator gets its own producer, with a transactional ID chosen to hash to a __transaction_state partition
+// led by that broker. Transactional IDs only depend on the instance name and the coordinator, so that every Monitor
+// and every run of the instance reuses them, fencing the previous producers, instead of leaving new ones behind.
+// InitProducerID is measured separately with a second transactional ID mapping to the same coordinator, as bumping
+// the epoch of the producer's own ID would fence it.
+type txnProber struct {
+	metrics         *Metrics
+	kafkaCfg        *config.KafkaConfig
+	topic           string
+	partitions      int
+	keyPrefix       string
+	txnIDPrefix     string
+	interval        time.Duration
+	refreshInterval time.Duration
+	client          *kgo.Client
+	consumerClient  clients.KgoClient
+	paused          func() bool
+
+	// Only accessed from the probe loop
+	producers     map[int32]*txnProducer
+	lastRefreshed time.Time
+	seq           int64
+
+	mu sync.Mutex
+	// Commit start time of every transaction that has not become visible yet, keyed by probe ID
+	commits map[string]time.Time
+}
+
+type txnProducer struct {
+	client        *kgo.Client
+	txnID         string
+	initTxnID     string
+	coordinatorID int32
+	fenced        atomic.Bool
+}
+
+func newTxnProberFromConfig(cfg *config.KMonConfig, metrics *Metrics, partitions int, instanceID string) (*txnProber, error) {
+	client, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleProducer, metrics.Clients)
+	if err != nil {
+		return nil, err
+	}
+	consumerClient, err := clients.GetFranzGoClient(cfg.ProducerKafkaConfig, clients.RoleConsumer, metrics.Clients,
+		kgo.ConsumeTopics(cfg.ProducerMonitoringTopic),
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+	)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &txnProber{
+		metrics:         metrics,
+		kafkaCfg:        cfg.ProducerKafkaConfig,
+		topic:           cfg.ProducerMonitoringTopic,
+		partitions:      partitions,
+		keyPrefix:       "kmon-txn/" + instanceID + "/",
+		txnIDPrefix:     cfg.TransactionalProbes.GetTransactionalIDPrefix() + "-" + cfg.GetInstanceName(),
+		interval:        time.Duration(cfg.TransactionalProbes.GetIntervalMs()) * time.Millisecond,
+		refreshInterval: 5 * time.Minute,
+		client:          client,
+		consumerClient:  consumerClient,
+		producers:       make(map[int32]*txnProducer),
+		commits:         make(map[string]time.Time),
+	}, nil
+}
+
+func (t *txnProber) Start(ctx context.Context) {
+	defer t.client.Close()
+	defer t.consumerClient.Close()
+	defer func() {
+		for _, producer := range t.producers {
+			producer.client.Close()
+		}
+	}()
+
+	go t.consumeLoop(ctx)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if t.paused == nil || !t.paused() {
+				t.probe(ctx)
+			}
+		}
+	}
+}
+
+func (t *txnProber) probe(ctx context.Context) {
+	if time.Since(t.lastRefreshed) >= t.refreshInterval || len(t.producers) == 0 {
+		if err := t.refreshProducers(ctx); err != nil {
+			log.Warn().Err(err).Msg("failed to refresh transaction coordinators")
+		}
+	}
+
+	t.seq++
+	var wg sync.WaitGroup
+	for _, producer := range t.producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.measureInitProducerID(ctx, producer)
+			t.probeTransaction(ctx, producer, t.seq)
+		}()
+	}
+	wg.Wait()
+
+	// A fenced producer can't be used anymore, so it is replaced on the next refresh
+	for coordinatorID, producer := range t.producers {
+		if producer.fenced.Load() {
+			producer.client.Close()
+			delete(t.producers, coordinatorID)
+			t.lastRefreshed = time.Time{}
+		}
+	}
+
+	t.expireCommits(time.Now().Add(-time.Minute))
+}
+
+// refreshProducers makes sure that there is exactly one producer per broker currently leading a __transaction_state
+// partition.
+func (t *txnProber) refreshProducers(ctx context.Context) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	leaders, err := getCoordinatorPartitionLeaders(timeoutCtx, t.client, transactionStateTopic)
+	if err != nil {
+		// Looking up a transaction coordinator makes the brokers create the topic
+		req := kmsg.NewFindCoordinatorRequest()
+		req.CoordinatorType = 1
+		req.CoordinatorKey = t.txnIDPrefix
+		_, _ = req.RequestWith(timeoutCtx, t.client)
+		return err
+	}
+	t.lastRefreshed = time.Now()
+
+	txnIDs := coordinatorKeys(t.txnIDPrefix, leaders)
+	for coordinatorID, producer := range t.producers {
+		if txnIDs[coordinatorID] != producer.txnID {
+			producer.client.Close()
+			delete(t.producers, coordinatorID)
+		}
+	}
+
+	for coordinatorID, txnID := range txnIDs {
+		if _, exists := t.producers[coordinatorID]; exists {
+			continue
+		}
+		client, err := clients.GetFranzGoClient(t.kafkaCfg, clients.RoleProducer, t.metrics.Clients, kgo.TransactionalID(txnID))
+		if err != nil {
+			return err
+		}
+		t.producers[coordinatorID] = &txnProducer{
+			client:        client,
+			txnID:         txnID,
+			initTxnID:     coordinatorKeys(txnID+"-init", leaders)[coordinatorID],
+			coordinatorID: coordinatorID,
+		}
+	}
+	return nil
+}
+
+func (t *txnProber) measureInitProducerID(ctx context.Context, producer *txnProducer) {
+	if producer.initTxnID == "" {
+		return
+	}
+	coordinatorLabel := strconv.Itoa(int(producer.coordinatorID))
+
+	req := kmsg.NewInitProducerIDRequest()
+	req.TransactionalID = &producer.initTxnID
+	req.TransactionTimeoutMillis = 60000
+	req.ProducerID = -1
+	req.ProducerEpoch = -1
+
+	start := time.Now()
+	resp, err := req.RequestWith(ctx, t.client)
+	if err == nil {
+		err = kerr.ErrorForCode(resp.ErrorCode)
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("InitProducerID failed on coordinator %s", coordinatorLabel)
+		t.metrics.TxnInitProducerIDFailureCount.WithLabelValues(coordinatorLabel).Inc()
+		return
+	}
+	t.metrics.TxnInitProducerIDLatency.WithLabelValues(coordinatorLabel).Observe(float64(time.Since(start).Milliseconds()))
+}
+
+func (t *txnProber) probeTransaction(ctx context.Context, producer *txnProducer, seq int64) {
+	coordinatorLabel := strconv.Itoa(int(producer.coordinatorID))
+	timeoutCtx, cancel := context.WithTimeout(ctx, t.interval)
+	defer cancel()
+
+	begin := time.Now()
+	if err := producer.client.BeginTransaction(); err != nil {
+		t.handleTxnError(producer, "begin", err)
+		return
+	}
+
+	probeID := fmt.Sprintf("%d/%d", producer.coordinatorID, seq)
+	records := make([]*kgo.Record, 0, t.partitions)
+	for partition := range t.partitions {
+		records = append(records, &kgo.Record{
+			Topic:     t.topic,
+			Partition: int32(partition),
+			Key:       []byte(t.keyPrefix + probeID),
+		})
+	}
+	if err := producer.client.ProduceSync(timeoutCtx, records...).FirstErr(); err != nil {
+		t.handleTxnError(producer, "produce", err)
+		t.abort(ctx, producer)
+		return
+	}
+
+	commitStart := time.Now()
+	t.mu.Lock()
+	t.commits[probeID] = commitStart
+	t.mu.Unlock()
+
+	if err := producer.client.EndTransaction(timeoutCtx, kgo.TryCommit); err != nil {
+		t.mu.Lock()
+		delete(t.commits, probeID)
+		t.mu.Unlock()
+		t.handleTxnError(producer, "commit", err)
+		t.abort(ctx, producer)
+		return
+	}
+	t.metrics.TxnCommitLatency.WithLabelValues(coordinatorLabel).Observe(float64(time.Since(begin).Milliseconds()))
+}
+
+func (t *txnProber) abort(ctx context.Context, producer *txnProducer) {
+	coordinatorLabel := strconv.Itoa(int(producer.coordinatorID))
+	t.metrics.TxnAbortCount.WithLabelValues(coordinatorLabel).Inc()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, t.interval)
+	defer cancel()
+	if err := producer.client.AbortBufferedRecords(timeoutCtx); err != nil {
+		t.handleTxnError(producer, "abort", err)
+		return
+	}
+	if err := producer.client.EndTransaction(timeoutCtx, kgo.TryAbort); err != nil {
+		t.handleTxnError(producer, "abort", err)
+	}
+}
+
+// handleTxnError counts the error and flags the producer if it was fenced.
+func (t *txnProber) handleTxnError(producer *txnProducer, operation string, err error) {
+	coordinatorLabel := strconv.Itoa(int(producer.coordinatorID))
+	log.Warn().Err(err).Msgf("transactional probe failed to %s on coordinator %s", operation, coordinatorLabel)
+	t.metrics.TxnFailureCount.WithLabelValues(coordinatorLabel, operation).Inc()
+
+	if errors.Is(err, kerr.ProducerFenced) || errors.Is(err, kerr.InvalidProducerEpoch) {
+		t.metrics.TxnFencedCount.WithLabelValues(coordinatorLabel).Inc()
+		producer.fenced.Store(true)
+	}
+}
+
+func (t *txnProber) consumeLoop(ctx context.Context) {
+	for {
+		fetches := t.consumerClient.PollFetches(ctx)
+		if ctx.Err() != nil || fetches.IsClientClosed() {
+			return
+		}
+
+		now := time.Now()
+		fetches.EachRecord(func(record *kgo.Record) {
+			t.handleConsumedRecord(record, now)
+		})
+	}
+}
+
+func (t *txnProber) handleConsumedRecord(record *kgo.Record, consumeTime time.Time) {
+	probeID, ok := strings.CutPrefix(string(record.Key), t.keyPrefix)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	commitStart, ok := t.commits[probeID]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	coordinatorLabel, _, _ := strings.Cut(probeID, "/")
+	t.metrics.TxnCommitToVisibleLatency.WithLabelValues(coordinatorLabel, strconv.Itoa(int(record.Partition))).Observe(float64(consumeTime.Sub(commitStart).Milliseconds()))
+}
+
+// expireCommits forgets transactions that were committed before the deadline, whose probes must have all been
+// consumed by now (or never will be).
+func (t *txnProber) expireCommits(deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for probeID, commitStart := range t.commits {
+		if commitStart.Before(deadline) {
+			delete(t.commits, probeID)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package kmon
+
+import (
+	"testing"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxnProberTransactionalIDs(t *testing.T) {
+	cfg := &config.KMonConfig{
+		ProducerMonitoringTopic: "test-topic",
+		ProducerKafkaConfig:     &config.KafkaConfig{SeedBrokers: []string{"localhost:10000"}},
+		TransactionalProbes:     &config.TransactionalProbesConfig{},
+		InstanceName:            "kmon-a",
+	}
+	first, err := newTxnProberFromConfig(cfg, newTestMetrics(), 3, "kmon-a/1/1")
+	require.NoError(t, err)
+	defer first.client.Close()
+	defer first.consumerClient.Close()
+	second, err := newTxnProberFromConfig(cfg, newTestMetrics(), 3, "kmon-a/2/1")
+	require.NoError(t, err)
+	defer second.client.Close()
+	defer second.consumerClient.Close()
+
+	// Probes are told apart by Monitor, but transactional IDs are the same across Monitors and runs
+	require.NotEqual(t, first.keyPrefix, second.keyPrefix)
+	require.Equal(t, "kmon-txn-kmon-a", first.txnIDPrefix)
+	require.Equal(t, first.txnIDPrefix, second.txnIDPrefix)
+}
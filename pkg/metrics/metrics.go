@@ -0,0 +1,208 @@
+// Package metrics decouples kmon from any particular metrics backend. Collectors create their instruments from a
+// Sink, and the Sink decides where the measurements end up (a Prometheus registry, an OTLP collector, a StatsD
+// daemon or several of them at once).
+package metrics
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pliu/kmon/pkg/config"
+)
+
+type Counter interface {
+	Inc()
+	Add(delta float64)
+}
+
+type Gauge interface {
+	Set(value float64)
+}
+
+type Histogram interface {
+	Observe(value float64)
+}
+
+type CounterVec interface {
+	WithLabelValues(labelValues ...string) Counter
+}
+
+type GaugeVec interface {
+	WithLabelValues(labelValues ...string) Gauge
+}
+
+type HistogramVec interface {
+	WithLabelValues(labelValues ...string) Histogram
+}
+
+// Sink creates labeled instruments. Creating an instrument with a name that already exists on the sink returns an
+// instrument that reports to the same series, so callers can safely create their instruments more than once.
+type Sink interface {
+	NewCounterVec(name, help string, labelNames []string) CounterVec
+	NewGaugeVec(name, help string, labelNames []string) GaugeVec
+	NewHistogramVec(name, help string, buckets []float64, labelNames []string) HistogramVec
+	Close() error
+}
+
+// NewSinkFromConfig returns a Sink that reports to the given Prometheus sink and to every push sink enabled in cfg.
+func NewSinkFromConfig(ctx context.Context, cfg *config.MetricsConfig, prometheusSink *PrometheusSink) (Sink, error) {
+	sinks := []Sink{prometheusSink}
+	if cfg == nil {
+		return NewMultiSink(sinks...), nil
+	}
+
+	if cfg.OTLP != nil {
+		otlpSink, err := NewOTLPSink(ctx, cfg.OTLP)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, otlpSink)
+	}
+	if cfg.StatsD != nil {
+		statsDSink, err := NewStatsDSink(cfg.StatsD)
+		if err != nil {
+			_ = NewMultiSink(sinks...).Close()
+			return nil, err
+		}
+		sinks = append(sinks, statsDSink)
+	}
+
+	return NewMultiSink(sinks...), nil
+}
+
+// MultiSink fans every measurement out to all of its sinks.
+type MultiSink struct {
+	sinks []Sink
+}
+
+func NewMultiSink(sinks ...Sink) *MultiSink {
+	return &MultiSink{sinks: sinks}
+}
+
+func (s *MultiSink) NewCounterVec(name, help string, labelNames []string) CounterVec {
+	vecs := make(multiCounterVec, 0, len(s.sinks))
+	for _, sink := range s.sinks {
+		vecs = append(vecs, sink.NewCounterVec(name, help, labelNames))
+	}
+	return vecs
+}
+
+func (s *MultiSink) NewGaugeVec(name, help string, labelNames []string) GaugeVec {
+	vecs := make(multiGaugeVec, 0, len(s.sinks))
+	for _, sink := range s.sinks {
+		vecs = append(vecs, sink.NewGaugeVec(name, help, labelNames))
+	}
+	return vecs
+}
+
+func (s *MultiSink) NewHistogramVec(name, help string, buckets []float64, labelNames []string) HistogramVec {
+	vecs := make(multiHistogramVec, 0, len(s.sinks))
+	for _, sink := range s.sinks {
+		vecs = append(vecs, sink.NewHistogramVec(name, help, buckets, labelNames))
+	}
+	return vecs
+}
+
+func (s *MultiSink) Close() error {
+	var errs []error
+	for _, sink := range s.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type multiCounterVec []CounterVec
+
+func (v multiCounterVec) WithLabelValues(labelValues ...string) Counter {
+	counters := make(multiCounter, 0, len(v))
+	for _, vec := range v {
+		counters = append(counters, vec.WithLabelValues(labelValues...))
+	}
+	return counters
+}
+
+type multiCounter []Counter
+
+func (c multiCounter) Inc() {
+	for _, counter := range c {
+		counter.Inc()
+	}
+}
+
+func (c multiCounter) Add(delta float64) {
+	for _, counter := range c {
+		counter.Add(delta)
+	}
+}
+
+type multiGaugeVec []GaugeVec
+
+func (v multiGaugeVec) WithLabelValues(labelValues ...string) Gauge {
+	gauges := make(multiGauge, 0, len(v))
+	for _, vec := range v {
+		gauges = append(gauges, vec.WithLabelValues(labelValues...))
+	}
+	return gauges
+}
+
+type multiGauge []Gauge
+
+func (g multiGauge) Set(value float64) {
+	for _, gauge := range g {
+		gauge.Set(value)
+	}
+}
+
+type multiHistogramVec []HistogramVec
+
+func (v multiHistogramVec) WithLabelValues(labelValues ...string) Histogram {
+	histograms := make(multiHistogram, 0, len(v))
+	for _, vec := range v {
+		histograms = append(histograms, vec.WithLabelValues(labelValues...))
+	}
+	return histograms
+}
+
+type multiHistogram []Histogram
+
+func (h multiHistogram) Observe(value float64) {
+	for _, histogram := range h {
+		histogram.Observe(value)
+	}
+}
+
+// NopSink discards every measurement.
+type NopSink struct{}
+
+func NewNopSink() NopSink {
+	return NopSink{}
+}
+
+func (NopSink) NewCounterVec(string, string, []string) CounterVec { return nopCounterVec{} }
+
+func (NopSink) NewGaugeVec(string, string, []string) GaugeVec { return nopGaugeVec{} }
+
+func (NopSink) NewHistogramVec(string, string, []float64, []string) HistogramVec {
+	return nopHistogramVec{}
+}
+
+func (NopSink) Close() error { return nil }
+
+type nopCounterVec struct{}
+
+func (nopCounterVec) WithLabelValues(...string) Counter { return nop{} }
+
+type nopGaugeVec struct{}
+
+func (nopGaugeVec) WithLabelValues(...string) Gauge { return nop{} }
+
+type nopHistogramVec struct{}
+
+func (nopHistogramVec) WithLabelValues(...string) Histogram { return nop{} }
+
+type nop struct{}
+
+func (nop) Inc()            {}
+func (nop) Add(float64)     {}
+func (nop) Set(float64)     {}
+func (nop) Observe(float64) {}
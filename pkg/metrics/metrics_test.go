@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pliu/kmon/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestPrometheusSinksAreIndependent(t *testing.T) {
+	first := NewPrometheusSink(prometheus.NewRegistry())
+	second := NewPrometheusSink(prometheus.NewRegistry())
+
+	first.NewCounterVec("kmon_test_count", "help", []string{"partition"}).WithLabelValues("0").Add(2)
+	second.NewCounterVec("kmon_test_count", "help", []string{"partition"}).WithLabelValues("0").Inc()
+	// Creating the same instrument again must report to the existing series rather than panic
+	first.NewCounterVec("kmon_test_count", "help", []string{"partition"}).WithLabelValues("0").Inc()
+
+	count, err := testutil.GatherAndCount(first.registry, "kmon_test_count")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Equal(t, 3.0, testutil.ToFloat64(first.NewCounterVec("kmon_test_count", "help", []string{"partition"}).(promCounterVec).vec))
+	require.Equal(t, 1.0, testutil.ToFloat64(second.NewCounterVec("kmon_test_count", "help", []string{"partition"}).(promCounterVec).vec))
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	receive := func() string {
+		buf := make([]byte, 1024)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	plain, err := NewStatsDSink(&config.StatsDConfig{Address: conn.LocalAddr().String(), Prefix: "kmon"})
+	require.NoError(t, err)
+	defer plain.Close()
+	plain.NewCounterVec("produce_count", "", []string{"partition"}).WithLabelValues("1").Inc()
+	require.Equal(t, "kmon.produce_count.1:1|c", receive())
+	plain.NewHistogramVec("e2e_latency", "", nil, []string{"partition"}).WithLabelValues("2").Observe(12.5)
+	require.Equal(t, "kmon.e2e_latency.2:12.5|ms", receive())
+
+	dog, err := NewStatsDSink(&config.StatsDConfig{Address: conn.LocalAddr().String(), DogStatsD: true})
+	require.NoError(t, err)
+	defer dog.Close()
+	dog.NewGaugeVec("latency_quantile", "", []string{"partition", "quantile"}).WithLabelValues("0", "p99").Set(7)
+	require.Equal(t, "latency_quantile:7|g|#partition:0,quantile:p99", receive())
+	dog.NewGaugeVec("error_budget", "", nil).WithLabelValues().Set(-0.5)
+	require.Equal(t, "error_budget:0|g\nerror_budget:-0.5|g", receive())
+	dog.NewHistogramVec("e2e_latency", "", nil, []string{"broker"}).WithLabelValues("a:b").Observe(3)
+	require.Equal(t, "e2e_latency:3|h|#broker:a_b", receive())
+}
+
+func TestOTLPSink(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	sink := newOTLPSinkWithReader(reader)
+	defer sink.Close()
+
+	sink.NewCounterVec("kmon_test_count", "help", []string{"partition"}).WithLabelValues("0").Add(2)
+	sink.NewGaugeVec("kmon_test_gauge", "help", []string{"partition"}).WithLabelValues("1").Set(5)
+	sink.NewHistogramVec("kmon_test_histogram", "help", []float64{1, 10}, []string{"partition"}).WithLabelValues("2").Observe(3)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+
+	got := map[string]metricdata.Aggregation{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		got[m.Name] = m.Data
+	}
+
+	sum := got["kmon_test_count"].(metricdata.Sum[float64])
+	require.Len(t, sum.DataPoints, 1)
+	require.Equal(t, 2.0, sum.DataPoints[0].Value)
+	partition, _ := sum.DataPoints[0].Attributes.Value(attribute.Key("partition"))
+	require.Equal(t, "0", partition.AsString())
+
+	gauge := got["kmon_test_gauge"].(metricdata.Gauge[float64])
+	require.Len(t, gauge.DataPoints, 1)
+	require.Equal(t, 5.0, gauge.DataPoints[0].Value)
+
+	histogram := got["kmon_test_histogram"].(metricdata.Histogram[float64])
+	require.Len(t, histogram.DataPoints, 1)
+	require.Equal(t, []float64{1, 10}, histogram.DataPoints[0].Bounds)
+	require.Equal(t, []uint64{0, 1, 0}, histogram.DataPoints[0].BucketCounts)
+}
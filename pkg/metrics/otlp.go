@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const otelScope = "github.com/pliu/kmon"
+
+// OTLPSink pushes measurements to an OpenTelemetry collector. Measurements are aggregated in-process and exported
+// every push interval by the SDK's periodic reader.
+type OTLPSink struct {
+	provider *sdkmetric.MeterProvider
+	meter    metric.Meter
+}
+
+func NewOTLPSink(ctx context.Context, cfg *config.OTLPConfig) (*OTLPSink, error) {
+	exporter, err := newOTLPExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(time.Duration(cfg.GetPushIntervalSeconds())*time.Second))
+	return newOTLPSinkWithReader(reader), nil
+}
+
+func newOTLPSinkWithReader(reader sdkmetric.Reader) *OTLPSink {
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", "kmon"))),
+	)
+	return &OTLPSink{
+		provider: provider,
+		meter:    provider.Meter(otelScope),
+	}
+}
+
+func newOTLPExporter(ctx context.Context, cfg *config.OTLPConfig) (sdkmetric.Exporter, error) {
+	switch cfg.GetProtocol() {
+	case config.OTLPProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.Headers))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case config.OTLPProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.URLPath != "" {
+			opts = append(opts, otlpmetrichttp.WithURLPath(cfg.URLPath))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(cfg.Headers))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", cfg.Protocol)
+	}
+}
+
+func (s *OTLPSink) NewCounterVec(name, help string, labelNames []string) CounterVec {
+	counter, err := s.meter.Float64Counter(name, metric.WithDescription(help))
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to create OTLP counter %s", name)
+	}
+	return otlpCounterVec{counter: counter, labelNames: labelNames}
+}
+
+func (s *OTLPSink) NewGaugeVec(name, help string, labelNames []string) GaugeVec {
+	gauge, err := s.meter.Float64Gauge(name, metric.WithDescription(help))
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to create OTLP gauge %s", name)
+	}
+	return otlpGaugeVec{gauge: gauge, labelNames: labelNames}
+}
+
+func (s *OTLPSink) NewHistogramVec(name, help string, buckets []float64, labelNames []string) HistogramVec {
+	histogram, err := s.meter.Float64Histogram(name, metric.WithDescription(help), metric.WithExplicitBucketBoundaries(buckets...))
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to create OTLP histogram %s", name)
+	}
+	return otlpHistogramVec{histogram: histogram, labelNames: labelNames}
+}
+
+// Close flushes any pending measurements before shutting the exporter down.
+func (s *OTLPSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.provider.Shutdown(ctx)
+}
+
+func attributes(labelNames []string, labelValues []string) metric.MeasurementOption {
+	kvs := make([]attribute.KeyValue, 0, len(labelNames))
+	for i, name := range labelNames {
+		if i < len(labelValues) {
+			kvs = append(kvs, attribute.String(name, labelValues[i]))
+		}
+	}
+	return metric.WithAttributeSet(attribute.NewSet(kvs...))
+}
+
+type otlpCounterVec struct {
+	counter    metric.Float64Counter
+	labelNames []string
+}
+
+func (v otlpCounterVec) WithLabelValues(labelValues ...string) Counter {
+	return otlpCounter{counter: v.counter, attrs: attributes(v.labelNames, labelValues)}
+}
+
+type otlpCounter struct {
+	counter metric.Float64Counter
+	attrs   metric.MeasurementOption
+}
+
+func (c otlpCounter) Inc() {
+	c.Add(1)
+}
+
+func (c otlpCounter) Add(delta float64) {
+	c.counter.Add(context.Background(), delta, c.attrs)
+}
+
+type otlpGaugeVec struct {
+	gauge      metric.Float64Gauge
+	labelNames []string
+}
+
+func (v otlpGaugeVec) WithLabelValues(labelValues ...string) Gauge {
+	return otlpGauge{gauge: v.gauge, attrs: attributes(v.labelNames, labelValues)}
+}
+
+type otlpGauge struct {
+	gauge metric.Float64Gauge
+	attrs metric.MeasurementOption
+}
+
+func (g otlpGauge) Set(value float64) {
+	g.gauge.Record(context.Background(), value, g.attrs)
+}
+
+type otlpHistogramVec struct {
+	histogram  metric.Float64Histogram
+	labelNames []string
+}
+
+func (v otlpHistogramVec) WithLabelValues(labelValues ...string) Histogram {
+	return otlpHistogram{histogram: v.histogram, attrs: attributes(v.labelNames, labelValues)}
+}
+
+type otlpHistogram struct {
+	histogram metric.Float64Histogram
+	attrs     metric.MeasurementOption
+}
+
+func (h otlpHistogram) Observe(value float64) {
+	h.histogram.Record(context.Background(), value, h.attrs)
+}
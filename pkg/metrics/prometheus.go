@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusSink registers instruments on its own registry rather than the global one, so several sinks (and the
+// Monitors using them) can coexist in one process.
+type PrometheusSink struct {
+	registry *prometheus.Registry
+}
+
+func NewPrometheusSink(registry *prometheus.Registry) *PrometheusSink {
+	return &PrometheusSink{registry: registry}
+}
+
+// Handler serves the sink's registry in the Prometheus exposition format.
+func (s *PrometheusSink) Handler() http.Handler {
+	return promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{Registry: s.registry})
+}
+
+func (s *PrometheusSink) NewCounterVec(name, help string, labelNames []string) CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+	return promCounterVec{register(s.registry, vec)}
+}
+
+func (s *PrometheusSink) NewGaugeVec(name, help string, labelNames []string) GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)
+	return promGaugeVec{register(s.registry, vec)}
+}
+
+func (s *PrometheusSink) NewHistogramVec(name, help string, buckets []float64, labelNames []string) HistogramVec {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)
+	return promHistogramVec{register(s.registry, vec)}
+}
+
+func (s *PrometheusSink) Close() error {
+	return nil
+}
+
+// register returns the collector that was already registered under the same name, if any, so that instruments can
+// be created repeatedly (e.g. every time a Monitor is recreated).
+func register[T prometheus.Collector](registry *prometheus.Registry, collector T) T {
+	if err := registry.Register(collector); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return collector
+}
+
+type promCounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+func (v promCounterVec) WithLabelValues(labelValues ...string) Counter {
+	return v.vec.WithLabelValues(labelValues...)
+}
+
+type promGaugeVec struct {
+	vec *prometheus.GaugeVec
+}
+
+func (v promGaugeVec) WithLabelValues(labelValues ...string) Gauge {
+	return v.vec.WithLabelValues(labelValues...)
+}
+
+type promHistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+func (v promHistogramVec) WithLabelValues(labelValues ...string) Histogram {
+	return v.vec.WithLabelValues(labelValues...)
+}
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/log"
+	"github.com/pliu/kmon/pkg/config"
+)
+
+// StatsDSink sends every measurement as its own UDP datagram. With DogStatsD enabled, labels are sent as tags;
+// otherwise the label values are appended to the metric name, since plain StatsD has no notion of labels.
+type StatsDSink struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+}
+
+func NewStatsDSink(cfg *config.StatsDConfig) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := cfg.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsDSink{
+		conn:      conn,
+		prefix:    prefix,
+		dogStatsD: cfg.DogStatsD,
+	}, nil
+}
+
+func (s *StatsDSink) NewCounterVec(name, _ string, labelNames []string) CounterVec {
+	return statsDVec{sink: s, name: name, labelNames: labelNames}
+}
+
+func (s *StatsDSink) NewGaugeVec(name, _ string, labelNames []string) GaugeVec {
+	return statsDGaugeVec{statsDVec{sink: s, name: name, labelNames: labelNames}}
+}
+
+func (s *StatsDSink) NewHistogramVec(name, _ string, _ []float64, labelNames []string) HistogramVec {
+	return statsDHistogramVec{statsDVec{sink: s, name: name, labelNames: labelNames}}
+}
+
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsDSink) send(metric string, value float64, metricType string) {
+	s.write(statsDLine(metric, value, metricType))
+}
+
+// write sends the lines as a single datagram. Losing a datagram is acceptable for StatsD, so write failures are only
+// logged.
+func (s *StatsDSink) write(lines ...string) {
+	if _, err := s.conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		log.Debug().Err(err).Msg("failed to send StatsD datagram")
+	}
+}
+
+func statsDLine(metric string, value float64, metricType string) string {
+	return fmt.Sprintf("%s:%s|%s", metric, strconv.FormatFloat(value, 'f', -1, 64), metricType)
+}
+
+type statsDVec struct {
+	sink       *StatsDSink
+	name       string
+	labelNames []string
+}
+
+// metric returns the name (and, for DogStatsD, the tags) that a series with the given label values is sent as.
+// The result is split around the value so that it can be computed once per series.
+func (v statsDVec) metric(labelValues []string) (string, string) {
+	var name strings.Builder
+	name.WriteString(v.sink.prefix)
+	name.WriteString(v.name)
+	if !v.sink.dogStatsD {
+		for _, value := range labelValues {
+			name.WriteByte('.')
+			name.WriteString(sanitizeStatsD(value))
+		}
+		return name.String(), ""
+	}
+
+	tags := make([]string, 0, len(v.labelNames))
+	for i, labelName := range v.labelNames {
+		if i < len(labelValues) {
+			tags = append(tags, sanitizeStatsD(labelName)+":"+sanitizeStatsD(labelValues[i]))
+		}
+	}
+	if len(tags) == 0 {
+		return name.String(), ""
+	}
+	return name.String(), "|#" + strings.Join(tags, ",")
+}
+
+func (v statsDVec) WithLabelValues(labelValues ...string) Counter {
+	name, tags := v.metric(labelValues)
+	return statsDSeries{sink: v.sink, name: name, tags: tags}
+}
+
+type statsDGaugeVec struct {
+	statsDVec
+}
+
+func (v statsDGaugeVec) WithLabelValues(labelValues ...string) Gauge {
+	name, tags := v.metric(labelValues)
+	return statsDSeries{sink: v.sink, name: name, tags: tags}
+}
+
+type statsDHistogramVec struct {
+	statsDVec
+}
+
+func (v statsDHistogramVec) WithLabelValues(labelValues ...string) Histogram {
+	name, tags := v.metric(labelValues)
+	return statsDSeries{sink: v.sink, name: name, tags: tags}
+}
+
+type statsDSeries struct {
+	sink *StatsDSink
+	name string
+	tags string
+}
+
+func (s statsDSeries) Inc() {
+	s.Add(1)
+}
+
+func (s statsDSeries) Add(delta float64) {
+	s.sink.send(s.name, delta, "c"+s.tags)
+}
+
+// A signed gauge value is a delta in StatsD, so a negative value is set by first resetting the gauge to 0, in the same
+// datagram so that the two can't be reordered.
+func (s statsDSeries) Set(value float64) {
+	if value < 0 {
+		s.sink.write(statsDLine(s.name, 0, "g"+s.tags), statsDLine(s.name, value, "g"+s.tags))
+		return
+	}
+	s.sink.send(s.name, value, "g"+s.tags)
+}
+
+// Plain StatsD daemons only understand timers, so histograms are sent as timers there and as DogStatsD histograms
+// otherwise.
+func (s statsDSeries) Observe(value float64) {
+	if s.sink.dogStatsD {
+		s.sink.send(s.name, value, "h"+s.tags)
+		return
+	}
+	s.sink.send(s.name, value, "ms")
+}
+
+var statsDReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+func sanitizeStatsD(s string) string {
+	return statsDReplacer.Replace(s)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phuslu/log"
+
+	"github.com/pliu/kmon/pkg/kmon"
+)
+
+// runTopic runs a topic subcommand and returns the process' exit code.
+func runTopic(args []string) int {
+	if len(args) == 0 || args[0] != "plan" {
+		fmt.Fprintln(os.Stderr, "usage: kmon topic plan [flags]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("topic plan", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	configPath := flags.String("config.path", "config.yaml", "Path to the configuration file")
+	output := flags.String("output", "table", "Plan format, table or json")
+	_ = flags.Parse(args[1:])
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	setupLogging(*debug)
+	config := loadConfig(*configPath)
+
+	plan, err := kmon.PlanTopic(signalContext(), config)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to plan topic reconciliation")
+		return 1
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(plan)
+	} else {
+		err = plan.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write plan")
+		return 1
+	}
+	return 0
+}